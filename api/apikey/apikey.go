@@ -0,0 +1,155 @@
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	prefix = "tps"
+	// usageResolution limits how often last-used times are written back.
+	usageResolution = time.Minute
+)
+
+var (
+	ErrNotFound = errors.New("api key not found")
+	ErrInvalid  = errors.New("invalid api key")
+	ErrExpired  = errors.New("api key expired")
+	ErrRevoked  = errors.New("api key revoked")
+)
+
+// Key is an API key of a service account. Only the hash of its secret is
+// stored; the plain key is shown once, when it is created.
+type Key struct {
+	ID             string `json:"id"`
+	ServiceAccount string `json:"service_account"`
+	// Subject is the casbin subject requests made with the key are
+	// authorized as.
+	Subject string `json:"subject"`
+	// Scopes optionally narrows the key to "METHOD /route/template"
+	// entries; an empty list allows whatever Subject is allowed. Keys are
+	// not held to the ownership checks of routes, which are about users, so
+	// a key may act on any record of the routes it may call.
+	Scopes     []string  `json:"scopes"`
+	Hash       string    `json:"-"`
+	CreatedBy  string    `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	RevokedAt  time.Time `json:"revoked_at"`
+}
+
+// Allows reports whether the key's scopes permit method on the route template path.
+func (k *Key) Allows(method, path string) bool {
+	if len(k.Scopes) == 0 {
+		return true
+	}
+	for _, scope := range k.Scopes {
+		m, p, ok := strings.Cut(scope, " ")
+		if !ok {
+			continue
+		}
+		if (m == "*" || strings.EqualFold(m, method)) && (p == path || (strings.HasSuffix(p, "*") && strings.HasPrefix(path, strings.TrimSuffix(p, "*")))) {
+			return true
+		}
+	}
+	return false
+}
+
+type Store interface {
+	Create(ctx context.Context, key *Key) error
+	Get(ctx context.Context, id string) (*Key, error)
+	List(ctx context.Context) ([]*Key, error)
+	Revoke(ctx context.Context, id string, at time.Time) error
+	MarkUsed(ctx context.Context, id string, at time.Time) error
+}
+
+type Service struct {
+	store Store
+}
+
+func NewService(store Store) *Service {
+	return &Service{store: store}
+}
+
+// Create issues a key for serviceAccount and returns it with its plain text
+// value, which cannot be recovered later.
+func (s *Service) Create(ctx context.Context, key *Key) (*Key, string, error) {
+	id, err := randomString(9)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	key.ID = id
+	key.Hash = hash(secret)
+	key.CreatedAt = time.Now()
+	if err := s.store.Create(ctx, key); err != nil {
+		return nil, "", err
+	}
+	return key, prefix + "_" + id + "_" + secret, nil
+}
+
+func (s *Service) List(ctx context.Context) ([]*Key, error) {
+	return s.store.List(ctx)
+}
+
+func (s *Service) Revoke(ctx context.Context, id string) error {
+	return s.store.Revoke(ctx, id, time.Now())
+}
+
+// Authenticate resolves the plain key raw to its stored key.
+func (s *Service) Authenticate(ctx context.Context, raw string) (*Key, error) {
+	parts := strings.SplitN(raw, "_", 3)
+	if len(parts) != 3 || parts[0] != prefix {
+		return nil, ErrInvalid
+	}
+	key, err := s.store.Get(ctx, parts[1])
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hash(parts[2]))) != 1 {
+		return nil, ErrInvalid
+	}
+
+	now := time.Now()
+	if !key.RevokedAt.IsZero() {
+		return nil, ErrRevoked
+	}
+	if !key.ExpiresAt.IsZero() && now.After(key.ExpiresAt) {
+		return nil, ErrExpired
+	}
+	if now.Sub(key.LastUsedAt) >= usageResolution {
+		if err := s.store.MarkUsed(ctx, key.ID, now); err != nil {
+			return nil, err
+		}
+		key.LastUsedAt = now
+	}
+	return key, nil
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return strings.NewReplacer("-", "", "_", "").Replace(base64.RawURLEncoding.EncodeToString(b)), nil
+}
@@ -0,0 +1,173 @@
+package apikey
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type MemoryStore struct {
+	mu   sync.Mutex
+	keys map[string]*Key
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{keys: make(map[string]*Key)}
+}
+
+func (s *MemoryStore) Create(ctx context.Context, key *Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	saved := *key
+	s.keys[key.ID] = &saved
+	return nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, id string) (*Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	res := *key
+	return &res, nil
+}
+
+func (s *MemoryStore) List(ctx context.Context) ([]*Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]*Key, 0, len(s.keys))
+	for _, key := range s.keys {
+		res := *key
+		keys = append(keys, &res)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (s *MemoryStore) Revoke(ctx context.Context, id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if key.RevokedAt.IsZero() {
+		key.RevokedAt = at
+	}
+	return nil
+}
+
+func (s *MemoryStore) MarkUsed(ctx context.Context, id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key, ok := s.keys[id]; ok {
+		key.LastUsedAt = at
+	}
+	return nil
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) (*PostgresStore, error) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS api_keys (
+			id              TEXT PRIMARY KEY,
+			service_account TEXT NOT NULL,
+			subject         TEXT NOT NULL,
+			scopes          TEXT[] NOT NULL DEFAULT '{}',
+			hash            TEXT NOT NULL,
+			created_by      TEXT NOT NULL,
+			created_at      TIMESTAMPTZ NOT NULL,
+			expires_at      TIMESTAMPTZ,
+			last_used_at    TIMESTAMPTZ,
+			revoked_at      TIMESTAMPTZ
+		)`)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresStore{db: db}, nil
+}
+
+func (s *PostgresStore) Create(ctx context.Context, key *Key) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO api_keys (id, service_account, subject, scopes, hash, created_by, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		key.ID, key.ServiceAccount, key.Subject, pq.Array(key.Scopes), key.Hash, key.CreatedBy, key.CreatedAt, nullTime(key.ExpiresAt))
+	return err
+}
+
+func (s *PostgresStore) Get(ctx context.Context, id string) (*Key, error) {
+	keys, err := s.query(ctx, `WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, ErrNotFound
+	}
+	return keys[0], nil
+}
+
+func (s *PostgresStore) List(ctx context.Context) ([]*Key, error) {
+	return s.query(ctx, `ORDER BY created_at DESC`)
+}
+
+func (s *PostgresStore) Revoke(ctx context.Context, id string, at time.Time) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE api_keys SET revoked_at = COALESCE(revoked_at, $2) WHERE id = $1`, id, at)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) MarkUsed(ctx context.Context, id string, at time.Time) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE api_keys SET last_used_at = $2 WHERE id = $1`, id, at)
+	return err
+}
+
+func (s *PostgresStore) query(ctx context.Context, where string, args ...interface{}) ([]*Key, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, service_account, subject, scopes, hash, created_by, created_at, expires_at, last_used_at, revoked_at
+		FROM api_keys `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*Key{}
+	for rows.Next() {
+		var key Key
+		var expiresAt, lastUsedAt, revokedAt sql.NullTime
+		err := rows.Scan(&key.ID, &key.ServiceAccount, &key.Subject, pq.Array(&key.Scopes), &key.Hash,
+			&key.CreatedBy, &key.CreatedAt, &expiresAt, &lastUsedAt, &revokedAt)
+		if err != nil {
+			return nil, err
+		}
+		key.ExpiresAt, key.LastUsedAt, key.RevokedAt = expiresAt.Time, lastUsedAt.Time, revokedAt.Time
+		keys = append(keys, &key)
+	}
+	if err := rows.Err(); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
@@ -0,0 +1,194 @@
+package flags
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Flag decides who a feature is on for. A flag is on for a caller when it is
+// enabled, the caller is in one of its segments, if it has any, and in its
+// rollout percentage. Users listed by id skip the percentage.
+type Flag struct {
+	// Enabled is the boolean rule. A disabled flag is off for everyone.
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Percentage rolls the flag out to a stable share of users, from 0 to
+	// 100. Nil is everyone.
+	Percentage *int `json:"percentage,omitempty" yaml:"percentage"`
+	// Roles, Users and Groups are segments: role names, user ids and group
+	// ids. When any is set, only callers in one of them get the flag.
+	Roles  []string `json:"roles,omitempty" yaml:"roles"`
+	Users  []string `json:"users,omitempty" yaml:"users"`
+	Groups []string `json:"groups,omitempty" yaml:"groups"`
+}
+
+func (f Flag) Validate() error {
+	if f.Percentage != nil && (*f.Percentage < 0 || *f.Percentage > 100) {
+		return fmt.Errorf("percentage must be between 0 and 100, got %d", *f.Percentage)
+	}
+	return nil
+}
+
+// Subject is the caller a flag is evaluated for.
+type Subject struct {
+	UserID string
+	Role   string
+	// Groups returns the ids of the groups of the caller. It is only called
+	// for flags with group segments.
+	Groups func() ([]string, error)
+}
+
+// on reports whether f is on for sub. name seeds the rollout, so that
+// different flags reach different users at the same percentage.
+func (f Flag) on(name string, sub Subject) (bool, error) {
+	if !f.Enabled {
+		return false, nil
+	}
+	if sub.UserID != "" && slices.Contains(f.Users, sub.UserID) {
+		return true, nil
+	}
+	if len(f.Roles) > 0 || len(f.Users) > 0 || len(f.Groups) > 0 {
+		in := slices.Contains(f.Roles, sub.Role)
+		if !in && len(f.Groups) > 0 && sub.Groups != nil {
+			groups, err := sub.Groups()
+			if err != nil {
+				return false, err
+			}
+			in = slices.ContainsFunc(groups, func(id string) bool { return slices.Contains(f.Groups, id) })
+		}
+		if !in {
+			return false, nil
+		}
+	}
+	if f.Percentage == nil || *f.Percentage >= 100 {
+		return true, nil
+	}
+	// Anonymous callers cannot be placed in a rollout.
+	if sub.UserID == "" {
+		return false, nil
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name + ":" + sub.UserID))
+	return int(h.Sum32()%100) < *f.Percentage, nil
+}
+
+// Parse reads flag definitions keyed by flag name, in YAML or JSON:
+//
+//	new_checker:
+//	  enabled: true
+//	  percentage: 20
+//	  groups: ["42"]
+func Parse(text string) (map[string]Flag, error) {
+	defined := make(map[string]Flag)
+	dec := yaml.NewDecoder(strings.NewReader(text))
+	dec.KnownFields(true)
+	if err := dec.Decode(&defined); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	for name, flag := range defined {
+		if err := flag.Validate(); err != nil {
+			return nil, fmt.Errorf("flag %s: %w", name, err)
+		}
+	}
+	return defined, nil
+}
+
+// State is a flag as it is in effect.
+type State struct {
+	Name string `json:"name"`
+	Flag
+	// Overridden is set when the flag was changed at run time and no longer
+	// follows the config.
+	Overridden bool `json:"overridden"`
+}
+
+// Set holds the flags defined in config and the overrides made at run time.
+// Overrides are local to the gateway process and outlive config reloads.
+type Set struct {
+	mu        sync.RWMutex
+	defined   map[string]Flag
+	overrides map[string]Flag
+}
+
+func NewSet(defined map[string]Flag) *Set {
+	return &Set{defined: defined, overrides: make(map[string]Flag)}
+}
+
+// Define replaces the flags defined in config.
+func (s *Set) Define(defined map[string]Flag) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.defined = defined
+}
+
+// Get returns the flag in effect for name.
+func (s *Set) Get(name string) (State, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if flag, ok := s.overrides[name]; ok {
+		return State{Name: name, Flag: flag, Overridden: true}, true
+	}
+	flag, ok := s.defined[name]
+	return State{Name: name, Flag: flag}, ok
+}
+
+// List returns every flag in effect, by name.
+func (s *Set) List() []State {
+	s.mu.RLock()
+	names := make([]string, 0, len(s.defined)+len(s.overrides))
+	for name := range s.defined {
+		names = append(names, name)
+	}
+	for name := range s.overrides {
+		if _, ok := s.defined[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Strings(names)
+	res := make([]State, 0, len(names))
+	for _, name := range names {
+		if state, ok := s.Get(name); ok {
+			res = append(res, state)
+		}
+	}
+	return res
+}
+
+// Override replaces the flag name until ClearOverride is called.
+func (s *Set) Override(name string, flag Flag) error {
+	if err := flag.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overrides[name] = flag
+	return nil
+}
+
+// ClearOverride returns name to its definition in config. It reports whether
+// there was an override.
+func (s *Set) ClearOverride(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.overrides[name]
+	delete(s.overrides, name)
+	return ok
+}
+
+// Enabled reports whether the flag name is on for sub. Unknown flags are off.
+func (s *Set) Enabled(name string, sub Subject) (bool, error) {
+	state, ok := s.Get(name)
+	if !ok {
+		return false, nil
+	}
+	return state.on(name, sub)
+}
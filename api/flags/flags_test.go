@@ -0,0 +1,143 @@
+package flags_test
+
+import (
+	"api/api/flags"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func percent(p int) *int { return &p }
+
+func groups(ids ...string) func() ([]string, error) {
+	return func() ([]string, error) { return ids, nil }
+}
+
+func TestFlagRules(t *testing.T) {
+	student := flags.Subject{UserID: "user-1", Role: "student", Groups: groups("42")}
+	tests := []struct {
+		name string
+		flag flags.Flag
+		sub  flags.Subject
+		on   bool
+	}{
+		{"disabled", flags.Flag{}, student, false},
+		{"enabled", flags.Flag{Enabled: true}, student, true},
+		{"zero percent", flags.Flag{Enabled: true, Percentage: percent(0)}, student, false},
+		{"full percentage", flags.Flag{Enabled: true, Percentage: percent(100)}, student, true},
+		{"percentage without a user", flags.Flag{Enabled: true, Percentage: percent(50)}, flags.Subject{Role: "student"}, false},
+		{"role segment", flags.Flag{Enabled: true, Roles: []string{"student"}}, student, true},
+		{"other role", flags.Flag{Enabled: true, Roles: []string{"teacher"}}, student, false},
+		{"group segment", flags.Flag{Enabled: true, Groups: []string{"42"}}, student, true},
+		{"other group", flags.Flag{Enabled: true, Groups: []string{"7"}}, student, false},
+		{"user segment", flags.Flag{Enabled: true, Users: []string{"user-1"}}, student, true},
+		{"listed user skips the percentage", flags.Flag{Enabled: true, Users: []string{"user-1"}, Percentage: percent(0)}, student, true},
+		{"segment and percentage", flags.Flag{Enabled: true, Roles: []string{"student"}, Percentage: percent(0)}, student, false},
+		{"disabled listed user", flags.Flag{Users: []string{"user-1"}}, student, false},
+	}
+	for _, tt := range tests {
+		set := flags.NewSet(map[string]flags.Flag{"f": tt.flag})
+		on, err := set.Enabled("f", tt.sub)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if on != tt.on {
+			t.Errorf("%s: on = %v, want %v", tt.name, on, tt.on)
+		}
+	}
+}
+
+func TestGroupLookupError(t *testing.T) {
+	lookup := errors.New("group service down")
+	set := flags.NewSet(map[string]flags.Flag{"f": {Enabled: true, Groups: []string{"42"}}})
+	sub := flags.Subject{UserID: "user-1", Groups: func() ([]string, error) { return nil, lookup }}
+	if _, err := set.Enabled("f", sub); !errors.Is(err, lookup) {
+		t.Fatalf("err = %v, want %v", err, lookup)
+	}
+}
+
+func TestPercentageRollout(t *testing.T) {
+	set := flags.NewSet(map[string]flags.Flag{"f": {Enabled: true, Percentage: percent(30)}})
+	on := 0
+	for i := 0; i < 2000; i++ {
+		sub := flags.Subject{UserID: fmt.Sprintf("user-%d", i)}
+		first, err := set.Enabled("f", sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, _ := set.Enabled("f", sub)
+		if first != again {
+			t.Fatalf("%s: rollout is not stable", sub.UserID)
+		}
+		if first {
+			on++
+		}
+	}
+	if on < 500 || on > 700 {
+		t.Fatalf("flag on for %d of 2000 users, want about 600", on)
+	}
+}
+
+func TestOverridesAndReload(t *testing.T) {
+	sub := flags.Subject{UserID: "user-1", Role: "student"}
+	set := flags.NewSet(map[string]flags.Flag{"a": {Enabled: true}, "b": {}})
+	enabled := func(name string) bool {
+		t.Helper()
+		on, err := set.Enabled(name, sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return on
+	}
+
+	if err := set.Override("b", flags.Flag{Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !enabled("b") {
+		t.Fatal("override of b is not in effect")
+	}
+	if err := set.Override("b", flags.Flag{Enabled: true, Percentage: percent(101)}); err == nil {
+		t.Fatal("override with a percentage over 100 was accepted")
+	}
+
+	// A reload replaces the defined flags and keeps the overrides.
+	set.Define(map[string]flags.Flag{"c": {Enabled: true}})
+	if enabled("a") || !enabled("b") || !enabled("c") {
+		t.Fatalf("after reload: a = %v, b = %v, c = %v, want false, true, true", enabled("a"), enabled("b"), enabled("c"))
+	}
+
+	if !set.ClearOverride("b") {
+		t.Fatal("ClearOverride reported no override of b")
+	}
+	if enabled("b") {
+		t.Fatal("b is on after its override was removed")
+	}
+	if set.ClearOverride("b") {
+		t.Fatal("ClearOverride removed an override twice")
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		flags int
+		ok    bool
+	}{
+		{"empty", "", 0, true},
+		{"yaml", "checker:\n  enabled: true\n  percentage: 20\n  groups: [\"42\"]\n", 1, true},
+		{"json", `{"checker": {"enabled": true, "roles": ["student"]}}`, 1, true},
+		{"unknown field", "checker:\n  enabld: true\n", 0, false},
+		{"percentage over 100", "checker:\n  enabled: true\n  percentage: 120\n", 0, false},
+	}
+	for _, tt := range tests {
+		defined, err := flags.Parse(tt.text)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok = %v", tt.name, err, tt.ok)
+			continue
+		}
+		if len(defined) != tt.flags {
+			t.Errorf("%s: %d flags, want %d", tt.name, len(defined), tt.flags)
+		}
+	}
+}
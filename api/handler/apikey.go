@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"api/api/apikey"
+	"api/api/middleware"
+	"api/model"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CreateAPIKeyRequest struct {
+	ServiceAccount string   `json:"service_account" binding:"required"`
+	Subject        string   `json:"subject" binding:"required"`
+	Scopes         []string `json:"scopes"`
+	// ExpiresIn is a Go duration such as "720h". Empty means no expiry.
+	ExpiresIn string `json:"expires_in"`
+}
+
+type CreateAPIKeyResponse struct {
+	*apikey.Key
+	// APIKey is shown only once and must be sent in the X-API-Key header.
+	APIKey string `json:"api_key"`
+}
+
+// @Summary      Create API key
+// @Description  Creates an API key for a service account. Requests made with it are authorized as the given casbin subject, within its scopes, and may act on any record of the routes they can call: API keys skip the per-record ownership checks.
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        request body CreateAPIKeyRequest true "API key"
+// @Success      200 {object} CreateAPIKeyResponse
+// @Failure      400 {object} model.Error "Invalid request body"
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/api-keys [post]
+func (h *Handler) CreateAPIKey(c *gin.Context) {
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, model.Error{Message: "Invalid request body"})
+		return
+	}
+
+	key := &apikey.Key{
+		ServiceAccount: req.ServiceAccount,
+		Subject:        req.Subject,
+		Scopes:         req.Scopes,
+	}
+	if req.ExpiresIn != "" {
+		ttl, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || ttl <= 0 {
+			c.JSON(http.StatusBadRequest, model.Error{Message: "Invalid expires_in"})
+			return
+		}
+		key.ExpiresAt = time.Now().Add(ttl)
+	}
+	if principal, ok := middleware.GetPrincipal(c); ok {
+		key.CreatedBy = principal.UserID
+	}
+
+	key, plain, err := h.APIKeys.Create(c, key)
+	if err != nil {
+		h.Log.Error("Failed to create API key", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	h.Log.Info("API key created", "id", key.ID, "service_account", key.ServiceAccount, "subject", key.Subject)
+	c.JSON(http.StatusOK, CreateAPIKeyResponse{Key: key, APIKey: plain})
+}
+
+// @Summary      List API keys
+// @Description  Lists every API key with its last use. Secrets are never returned.
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Success      200 {object} []apikey.Key
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/api-keys [get]
+func (h *Handler) GetAPIKeys(c *gin.Context) {
+	keys, err := h.APIKeys.List(c)
+	if err != nil {
+		h.Log.Error("Failed to list API keys", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"api_keys": keys})
+}
+
+// @Summary      Revoke API key
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        id path string true "API key ID"
+// @Success      200 {object} string "API key revoked"
+// @Failure      404 {object} model.Error "API key not found"
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/api-keys/{id} [delete]
+func (h *Handler) RevokeAPIKey(c *gin.Context) {
+	id := c.Param("id")
+	err := h.APIKeys.Revoke(c, id)
+	if errors.Is(err, apikey.ErrNotFound) {
+		c.JSON(http.StatusNotFound, model.Error{Message: "API key not found"})
+		return
+	}
+	if err != nil {
+		h.Log.Error("Failed to revoke API key", "id", id, "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	h.Log.Info("API key revoked", "id", id)
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
@@ -0,0 +1,25 @@
+package handler
+
+import (
+	"api/api/upstream"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// @Summary      List circuit breakers
+// @Description  Shows the circuit breaker of each upstream service: its state, the calls counted in the current window and when an open breaker lets calls through again.
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Success      200 {object} []upstream.BreakerState
+// @Router       /api/admin/breakers [get]
+func (h *Handler) GetBreakers(c *gin.Context) {
+	states := make([]upstream.BreakerState, 0, len(h.Breakers))
+	for _, b := range h.Breakers {
+		states = append(states, b.State())
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	c.JSON(http.StatusOK, gin.H{"breakers": states})
+}
@@ -43,7 +43,15 @@ func (h *Handler) ProxyChecker(c *gin.Context) {
 	}
 
 	// Checker service bilan bog'lanish
-	resp, err := http.Post("http://3.121.214.21:50054/check", "application/json", bytes.NewBuffer(requestBody))
+	// The request context ends the stream when the client leaves or the
+	// shutdown grace period is over.
+	checkReq, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, h.Config.Current().CHECKER_URL, bytes.NewBuffer(requestBody))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Failed to connect to checker service"})
+		return
+	}
+	checkReq.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(checkReq)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, model.Error{Message: "Failed to connect to checker service"})
 		return
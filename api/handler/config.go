@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"api/config"
+	"api/model"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ActiveConfig struct {
+	// Config is the active configuration by setting name, with secrets
+	// redacted.
+	Config map[string]interface{} `json:"config"`
+	// Reloadable are the settings a reload can change.
+	Reloadable []string `json:"reloadable"`
+}
+
+// @Summary      Get active config
+// @Description  Returns the configuration the gateway is running with. Secrets are redacted.
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Success      200 {object} ActiveConfig
+// @Router       /api/admin/config [get]
+func (h *Handler) GetConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, ActiveConfig{Config: h.Config.Redacted(), Reloadable: config.Reloadable})
+}
+
+// @Summary      Reload config
+// @Description  Reads the config files, environment and flags again and applies the reloadable settings, like SIGHUP. An invalid configuration is rejected and the active one is kept.
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Success      200 {object} config.Reload
+// @Failure      422 {object} model.Error "Invalid configuration"
+// @Router       /api/admin/config/reload [post]
+func (h *Handler) ReloadConfig(c *gin.Context) {
+	res, err := h.Config.Reload()
+	if err != nil {
+		h.Log.Error("Rejected config reload", "error", err.Error())
+		c.JSON(http.StatusUnprocessableEntity, model.Error{Message: err.Error()})
+		return
+	}
+	h.Log.Info("Reloaded config", "changed", res.Changed, "ignored", res.Ignored)
+	c.JSON(http.StatusOK, res)
+}
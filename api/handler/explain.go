@@ -0,0 +1,263 @@
+package handler
+
+import (
+	"api/api/middleware"
+	"api/api/policycheck"
+	"api/api/token"
+	"api/casbin"
+	"api/model"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	casbinv2 "github.com/casbin/casbin/v2"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type ExplainRequest struct {
+	Role   string `json:"role" form:"role"`
+	UserID string `json:"user_id" form:"user_id"`
+	Path   string `json:"path" form:"path" binding:"required"`
+	Method string `json:"method" form:"method" binding:"required"`
+	// Domain is the subject id the request is made in, "*" when empty.
+	Domain string `json:"domain" form:"domain"`
+	// ID is the resource the ownership check of the route is run against.
+	ID string `json:"id" form:"id"`
+}
+
+type DryRunRequest struct {
+	ExplainRequest
+	// Add and Remove are policy edits to evaluate the request with. They are
+	// not applied.
+	Add    []PolicyRule `json:"add"`
+	Remove []PolicyRule `json:"remove"`
+}
+
+type OwnershipExplanation struct {
+	Rule       string `json:"rule"`
+	ResourceID string `json:"resource_id,omitempty"`
+	Checked    bool   `json:"checked"`
+	Allowed    bool   `json:"allowed"`
+	Reason     string `json:"reason"`
+}
+
+type AccessExplanation struct {
+	Role   string `json:"role"`
+	UserID string `json:"user_id,omitempty"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// Route is the route template the path matched, empty when none did.
+	Route  string   `json:"route"`
+	Domain string   `json:"domain"`
+	Roles  []string `json:"roles"`
+	// Rules are the rules of Roles for the route that were evaluated.
+	Rules     []string              `json:"rules"`
+	Deciding  string                `json:"deciding_rule,omitempty"`
+	Ownership *OwnershipExplanation `json:"ownership,omitempty"`
+	Allowed   bool                  `json:"allowed"`
+	Reason    string                `json:"reason"`
+}
+
+// explainOwnership runs the ownership check of a route for principal. The
+// resource is id, or without one the path parameter the route reads it from.
+func (h *Handler) explainOwnership(ctx context.Context, own Ownership, principal *token.Principal, route policycheck.Route, params map[string]string, id string) *OwnershipExplanation {
+	if id == "" && own.ID.From == FromPath {
+		id = params[own.ID.Name]
+	}
+	res := &OwnershipExplanation{Rule: own.Rule.Name, ResourceID: id}
+	if unrestricted(principal) {
+		res.Allowed = true
+		res.Reason = "Admins and service accounts are not restricted"
+		return res
+	}
+	if id == "" {
+		res.Reason = "No resource id given, ownership not checked"
+		return res
+	}
+
+	res.Checked = true
+	access := &Access{h: h, principal: principal, path: route.Path, method: route.Method}
+	allowed, err := own.Rule.Check(ctx, access, id)
+	switch {
+	case status.Code(err) == codes.NotFound:
+		res.Reason = "Resource not found"
+	case err != nil:
+		res.Reason = "Ownership check failed: " + err.Error()
+	case !allowed:
+		res.Reason = "The resource belongs to someone else"
+	default:
+		res.Allowed = true
+		res.Reason = "The resource belongs to the caller"
+	}
+	return res
+}
+
+// explain evaluates req for principal with enforcer, and runs the ownership
+// check of the route the path matches.
+func (h *Handler) explain(c *gin.Context, enforcer casbinv2.IEnforcer, principal *token.Principal, req ExplainRequest) (*AccessExplanation, error) {
+	res := &AccessExplanation{
+		Role:   principal.Role,
+		UserID: principal.UserID,
+		Method: strings.ToUpper(req.Method),
+		Path:   req.Path,
+		Domain: orAnyDomain(req.Domain),
+	}
+
+	route, params, ok := policycheck.Match(h.Engine, res.Method, req.Path)
+	if !ok {
+		res.Reason = "No route matches the path"
+		return res, nil
+	}
+	res.Route = route.Path
+	if !strings.HasPrefix(res.Route, policycheck.ProtectedPrefix) {
+		res.Allowed = true
+		res.Reason = "The route is public"
+		return res, nil
+	}
+
+	ex, err := casbin.Explain(enforcer, principal.Role, res.Domain, res.Route, res.Method)
+	if err != nil {
+		return nil, err
+	}
+	// Like the permission middleware, fall back to the roles granted to the
+	// user.
+	if !ex.Allowed && principal.UserID != "" && principal.APIKeyID == "" {
+		byUser, err := casbin.Explain(enforcer, principal.UserID, res.Domain, res.Route, res.Method)
+		if err != nil {
+			return nil, err
+		}
+		byUser.Roles = append(ex.Roles, byUser.Roles...)
+		byUser.Rules = append(ex.Rules, byUser.Rules...)
+		ex = byUser
+	}
+	res.Roles = ex.Roles
+	res.Rules = make([]string, 0, len(ex.Rules))
+	for _, rule := range ex.Rules {
+		res.Rules = append(res.Rules, rule.String())
+	}
+	if ex.Deciding != nil {
+		res.Deciding = ex.Deciding.String()
+	}
+
+	if own, ok := h.Ownership[route]; ok {
+		res.Ownership = h.explainOwnership(c, own, principal, route, params, req.ID)
+	}
+
+	switch {
+	case !ex.Allowed:
+		res.Reason = fmt.Sprintf("No rule allows %s %s", res.Method, res.Route)
+	case res.Ownership != nil && !res.Ownership.Allowed:
+		res.Reason = res.Ownership.Reason
+	default:
+		res.Allowed = true
+		res.Reason = "Allowed by " + res.Deciding
+	}
+	return res, nil
+}
+
+// @Summary      Explain authorization
+// @Description  Explains whether a role, and optionally a user, may call a route: the matched route template, the rules evaluated, the deciding rule and the ownership check of the route for the resource id.
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        role query string true "Role"
+// @Param        user_id query string false "User ID"
+// @Param        path query string true "Request path, such as /api/groups/getById/42"
+// @Param        method query string true "HTTP method"
+// @Param        domain query string false "Subject ID"
+// @Param        id query string false "Resource ID for the ownership check"
+// @Success      200 {object} AccessExplanation
+// @Failure      400 {object} model.Error "Invalid request"
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/authz/explain [get]
+func (h *Handler) ExplainAccess(c *gin.Context) {
+	var req ExplainRequest
+	if err := c.ShouldBindQuery(&req); err != nil || req.Role == "" {
+		c.JSON(http.StatusBadRequest, model.Error{Message: "role, path and method are required"})
+		return
+	}
+	h.respondExplanation(c, h.Enforcer, &token.Principal{UserID: req.UserID, Role: req.Role}, req)
+}
+
+// @Summary      Dry-run authorization
+// @Description  Like explain, but evaluates the request with policy edits that are not applied.
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        request body DryRunRequest true "Request and policy edits"
+// @Success      200 {object} AccessExplanation
+// @Failure      400 {object} model.Error "Invalid request"
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/authz/explain [post]
+func (h *Handler) DryRunAccess(c *gin.Context) {
+	var req DryRunRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Role == "" {
+		c.JSON(http.StatusBadRequest, model.Error{Message: "role, path and method are required"})
+		return
+	}
+	edits := make([][]casbin.Rule, 2)
+	for i, rules := range [][]PolicyRule{req.Add, req.Remove} {
+		for _, r := range rules {
+			rule := r.rule()
+			if err := rule.Validate(); err != nil {
+				c.JSON(http.StatusBadRequest, model.Error{Message: err.Error()})
+				return
+			}
+			edits[i] = append(edits[i], rule)
+		}
+	}
+
+	enforcer, err := casbin.Simulate(h.Enforcer, edits[0], edits[1])
+	if err != nil {
+		h.Log.Error("Failed to simulate policy", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	h.respondExplanation(c, enforcer, &token.Principal{UserID: req.UserID, Role: req.Role}, req.ExplainRequest)
+}
+
+// @Summary      Explain my authorization
+// @Description  Explains whether the caller may call a route.
+// @Tags         user
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        path query string true "Request path"
+// @Param        method query string true "HTTP method"
+// @Param        domain query string false "Subject ID"
+// @Param        id query string false "Resource ID for the ownership check"
+// @Success      200 {object} AccessExplanation
+// @Failure      400 {object} model.Error "Invalid request"
+// @Failure      401 {object} model.Error "Unauthorized"
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/user/authz/explain [get]
+func (h *Handler) ExplainMyAccess(c *gin.Context) {
+	principal, ok := middleware.GetPrincipal(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, model.Error{Message: "unauthorized"})
+		return
+	}
+	var req ExplainRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, model.Error{Message: "path and method are required"})
+		return
+	}
+	h.respondExplanation(c, h.Enforcer, principal, req)
+}
+
+func (h *Handler) respondExplanation(c *gin.Context, enforcer casbinv2.IEnforcer, principal *token.Principal, req ExplainRequest) {
+	if !strings.HasPrefix(req.Path, "/") {
+		c.JSON(http.StatusBadRequest, model.Error{Message: "path must start with /"})
+		return
+	}
+	res, err := h.explain(c, enforcer, principal, req)
+	if err != nil {
+		h.Log.Error("Failed to explain authorization", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"api/api/flags"
+	"api/api/middleware"
+	"api/model"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// flagSubject is the caller of c as feature flags see it. Groups are looked
+// up only if a flag has group segments.
+func (h *Handler) flagSubject(c *gin.Context) flags.Subject {
+	principal, ok := middleware.GetPrincipal(c)
+	if !ok {
+		return flags.Subject{}
+	}
+	access := &Access{h: h, principal: principal, path: c.FullPath(), method: c.Request.Method}
+	return flags.Subject{
+		UserID: principal.UserID,
+		Role:   principal.Role,
+		Groups: func() ([]string, error) {
+			groups, err := access.callerGroups(c)
+			if err != nil {
+				return nil, err
+			}
+			ids := make([]string, 0, len(groups))
+			for _, g := range groups {
+				ids = append(ids, g.Id)
+			}
+			return ids, nil
+		},
+	}
+}
+
+// FlagOn reports whether the feature flag name is on for the caller of c.
+// Flags that cannot be evaluated are off.
+func (h *Handler) FlagOn(c *gin.Context, name string) bool {
+	on, err := h.Flags.Enabled(name, h.flagSubject(c))
+	if err != nil {
+		h.Log.Error("Failed to evaluate feature flag", "flag", name, "error", err.Error())
+		return false
+	}
+	return on
+}
+
+// Flag hides a route behind the feature flag name: callers it is off for get
+// 404, as if the route did not exist. Until the flag is defined the route is
+// open to everyone, so a rollout starts by defining the flag for a first
+// segment. It goes after the permission middleware, which identifies the
+// caller.
+func (h *Handler) Flag(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, defined := h.Flags.Get(name); !defined {
+			c.Next()
+			return
+		}
+		if !h.FlagOn(c, name) {
+			c.AbortWithStatusJSON(http.StatusNotFound, model.Error{Message: "Not found"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// @Summary      List feature flags
+// @Description  Lists the feature flags in effect, from config or overridden at run time.
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Success      200 {object} []flags.State
+// @Router       /api/admin/flags [get]
+func (h *Handler) GetFlags(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"flags": h.Flags.List()})
+}
+
+// @Summary      Override a feature flag
+// @Description  Replaces a feature flag until the override is removed. Overrides apply to this gateway process and survive config reloads.
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        name path string true "Flag name"
+// @Param        flag body flags.Flag true "Flag"
+// @Success      200 {object} flags.State
+// @Failure      400 {object} model.Error "Invalid flag"
+// @Router       /api/admin/flags/{name} [put]
+func (h *Handler) OverrideFlag(c *gin.Context) {
+	var flag flags.Flag
+	if err := c.ShouldBindJSON(&flag); err != nil {
+		c.JSON(http.StatusBadRequest, model.Error{Message: "Invalid request body"})
+		return
+	}
+	name := c.Param("name")
+	if err := h.Flags.Override(name, flag); err != nil {
+		c.JSON(http.StatusBadRequest, model.Error{Message: err.Error()})
+		return
+	}
+	h.Log.Info("Feature flag overridden", "flag", name)
+	state, _ := h.Flags.Get(name)
+	c.JSON(http.StatusOK, state)
+}
+
+// @Summary      Remove a feature flag override
+// @Description  Returns a feature flag to its definition in config.
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        name path string true "Flag name"
+// @Success      200 {object} string "Override removed"
+// @Failure      404 {object} model.Error "Flag is not overridden"
+// @Router       /api/admin/flags/{name} [delete]
+func (h *Handler) ClearFlagOverride(c *gin.Context) {
+	name := c.Param("name")
+	if !h.Flags.ClearOverride(name) {
+		c.JSON(http.StatusNotFound, model.Error{Message: "Flag is not overridden"})
+		return
+	}
+	h.Log.Info("Feature flag override removed", "flag", name)
+	c.JSON(http.StatusOK, gin.H{"message": "Override removed"})
+}
+
+// @Summary      My feature flags
+// @Description  Lists the feature flags that are on for the caller.
+// @Tags         user
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Success      200 {object} []string
+// @Router       /api/user/flags [get]
+func (h *Handler) GetMyFlags(c *gin.Context) {
+	// One subject for every flag, so groups are looked up once.
+	sub := h.flagSubject(c)
+	on := []string{}
+	for _, state := range h.Flags.List() {
+		enabled, err := h.Flags.Enabled(state.Name, sub)
+		if err != nil {
+			h.Log.Error("Failed to evaluate feature flag", "flag", state.Name, "error", err.Error())
+			continue
+		}
+		if enabled {
+			on = append(on, state.Name)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"flags": on})
+}
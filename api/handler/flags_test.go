@@ -0,0 +1,39 @@
+package handler_test
+
+import (
+	"api/api/flags"
+	"api/api/handler"
+	"api/api/middleware"
+	"api/api/token"
+	"io"
+	"log/slog"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestFlagHidesRoute(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name    string
+		defined map[string]flags.Flag
+		code    int
+	}{
+		{"flag not defined", nil, http.StatusOK},
+		{"on for the caller", map[string]flags.Flag{"checker": {Enabled: true, Roles: []string{"student"}}}, http.StatusOK},
+		{"off for the caller", map[string]flags.Flag{"checker": {Enabled: true, Roles: []string{"teacher"}}}, http.StatusNotFound},
+		{"disabled", map[string]flags.Flag{"checker": {}}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		h := &handler.Handler{Flags: flags.NewSet(tt.defined), Log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+		r := gin.New()
+		r.Use(func(c *gin.Context) {
+			middleware.SetPrincipal(c, &token.Principal{UserID: "user-1", Role: "student"})
+		})
+		r.POST("/submit", h.Flag("checker"), func(c *gin.Context) { c.Status(http.StatusOK) })
+		if code := serve(r, http.MethodPost, "/submit", ""); code != tt.code {
+			t.Errorf("%s: code = %d, want %d", tt.name, code, tt.code)
+		}
+	}
+}
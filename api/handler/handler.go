@@ -1,6 +1,17 @@
 package handler
 
 import (
+	"api/api/apikey"
+	"api/api/flags"
+	"api/api/health"
+	"api/api/impersonation"
+	"api/api/lockout"
+	"api/api/policycheck"
+	"api/api/reset"
+	"api/api/token"
+	"api/api/totp"
+	"api/api/upstream"
+	"api/config"
 	"api/genproto/group"
 	"api/genproto/notification"
 	"api/genproto/question"
@@ -10,8 +21,10 @@ import (
 	"api/genproto/user"
 	"log"
 	"log/slog"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/casbin/casbin/v2"
 	"github.com/gin-gonic/gin"
@@ -19,6 +32,7 @@ import (
 )
 
 type Handler struct {
+	Config         *config.Store
 	User           user.UsersClient
 	Group          group.GroupServiceClient
 	Subject        subject.SubjectServiceClient
@@ -30,25 +44,58 @@ type Handler struct {
 	TestCase       question.TestCaseServiceClient
 	Task           task.TaskServiceClient
 	Log            *slog.Logger
-	Enforcer       *casbin.Enforcer
+	Enforcer       *casbin.SyncedEnforcer
+	RefreshStore   token.RefreshStore
+	Denylist       token.Denylist
+	Lockout        *lockout.Guard
+	Sessions       token.SessionStore
+	APIKeys        *apikey.Service
+	Impersonation  impersonation.Store
+	ImpersonateTTL time.Duration
+	Reset          *reset.Service
+	ResetSender    reset.Sender
+	TwoFactor      *totp.Service
+	Flags          *flags.Set
+	Breakers       map[string]*upstream.Breaker
+	Health         *health.Checker
+	Engine         *gin.Engine
+	Ownership      map[policycheck.Route]Ownership
 	Connections    map[string]*websocket.Conn
+	SessionConns   map[string]*websocket.Conn
 	ConnMutex      sync.Mutex
+	// sockets are every open WebSocket, authenticated or not, and draining
+	// is set once the gateway shuts down. Both are guarded by ConnMutex.
+	sockets  map[*websocket.Conn]bool
+	draining bool
 }
 
-func CORSMiddleware() gin.HandlerFunc {
+// CORSMiddleware lets browsers call the gateway from the origins returned by
+// origins, which is read on every request. "*" allows any origin.
+func CORSMiddleware(origins func() []string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		log.Println("CORS middleware triggered")
 
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+		allowed := origins()
+		origin := c.Request.Header.Get("Origin")
+		anyOrigin := slices.Contains(allowed, "*")
+		listed := origin != "" && slices.Contains(allowed, origin)
+		c.Writer.Header().Add("Vary", "Origin")
+		if anyOrigin {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+		} else if listed {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+		}
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-API-Key, accept, origin, Cache-Control, X-Requested-With")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE, UPDATE")
 		c.Writer.Header().Set("Access-Control-Max-Age", "86400") // 24 soat
 
 		// WebSocket ulanishlari uchun qo'shimcha headerlar
 		if strings.ToLower(c.Request.Header.Get("Connection")) == "upgrade" &&
 			strings.ToLower(c.Request.Header.Get("Upgrade")) == "websocket" {
-			c.Writer.Header().Set("Access-Control-Allow-Origin", c.Request.Header.Get("Origin"))
+			if anyOrigin || listed {
+				c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+			}
 			c.Writer.Header().Set("Sec-Websocket-Extensions", c.Request.Header.Get("Sec-Websocket-Extensions"))
 		}
 
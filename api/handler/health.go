@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"api/api/health"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// checkHealth runs the dependency checks with the current HEALTH_* settings.
+func (h *Handler) checkHealth(c *gin.Context) health.Report {
+	conf := h.Config.Current()
+	return h.Health.Run(c.Request.Context(), conf.Required(), conf.HEALTH_TIMEOUT)
+}
+
+// cachedHealth is checkHealth for the public endpoints, which anyone can
+// call: results are reused for HEALTH_CACHE_TTL.
+func (h *Handler) cachedHealth(c *gin.Context) health.Report {
+	conf := h.Config.Current()
+	return h.Health.Cached(c.Request.Context(), conf.Required(), conf.HEALTH_TIMEOUT, conf.HEALTH_CACHE_TTL)
+}
+
+func reportStatus(report health.Report) int {
+	if report.Ready() {
+		return http.StatusOK
+	}
+	return http.StatusServiceUnavailable
+}
+
+// @Summary      Liveness
+// @Description  Answers 200 while the gateway process serves requests, whatever the state of its dependencies.
+// @Tags         health
+// @Produce      json
+// @Success      200 {object} map[string]string
+// @Router       /health/live [get]
+func (h *Handler) HealthLive(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": health.Up})
+}
+
+// @Summary      Readiness
+// @Description  Answers 200 when every dependency in HEALTH_REQUIRED is up and 503 otherwise. Results are reused for HEALTH_CACHE_TTL.
+// @Tags         health
+// @Produce      json
+// @Success      200 {object} map[string]string
+// @Failure      503 {object} map[string]string
+// @Router       /health/ready [get]
+func (h *Handler) HealthReady(c *gin.Context) {
+	report := h.cachedHealth(c)
+	c.JSON(reportStatus(report), gin.H{"status": report.Status})
+}
+
+// @Summary      Health
+// @Description  Reports whether each dependency is up: the user and question services, the policy database, MinIO and the checker. Answers 503 when a dependency in HEALTH_REQUIRED is down. Results are reused for HEALTH_CACHE_TTL.
+// @Tags         health
+// @Produce      json
+// @Success      200 {object} health.Report
+// @Failure      503 {object} health.Report
+// @Router       /health [get]
+func (h *Handler) HealthStatus(c *gin.Context) {
+	report := h.cachedHealth(c)
+	c.JSON(reportStatus(report), report.Public())
+}
+
+// @Summary      Dependency health
+// @Description  Checks each dependency like /health, without its cache, and shows how long each check took and why a failed one failed.
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Success      200 {object} health.Report
+// @Router       /api/admin/health [get]
+func (h *Handler) GetDependencyHealth(c *gin.Context) {
+	c.JSON(http.StatusOK, h.checkHealth(c))
+}
@@ -0,0 +1,228 @@
+package handler
+
+import (
+	"api/api/impersonation"
+	"api/api/middleware"
+	"api/api/token"
+	pb "api/genproto/user"
+	"api/model"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type CreateImpersonationGrantRequest struct {
+	ActorID   string `json:"actor_id" binding:"required"`
+	SubjectID string `json:"subject_id" binding:"required"`
+	Reason    string `json:"reason" binding:"required"`
+	// Duration is a Go duration such as "2h"; it defaults to one hour.
+	Duration string `json:"duration"`
+}
+
+type ImpersonateRequest struct {
+	GrantID string `json:"grant_id" binding:"required"`
+}
+
+type ImpersonateResponse struct {
+	AccessToken string    `json:"access_token"`
+	SubjectID   string    `json:"subject_id"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// @Summary      Grant impersonation
+// @Description  Allows a support user to act as another user for a limited time.
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        request body CreateImpersonationGrantRequest true "Grant"
+// @Success      200 {object} impersonation.Grant
+// @Failure      400 {object} model.Error "Invalid request body"
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/impersonation/grants [post]
+func (h *Handler) CreateImpersonationGrant(c *gin.Context) {
+	var req CreateImpersonationGrantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, model.Error{Message: "Invalid request body"})
+		return
+	}
+	duration := time.Hour
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, model.Error{Message: "Invalid duration"})
+			return
+		}
+		duration = d
+	}
+
+	actor, err := h.User.GetProfile(c, &pb.GetProfileRequest{Id: req.ActorID})
+	if err != nil {
+		h.Log.Error("Failed to get actor profile", "error", err.Error())
+		c.JSON(http.StatusBadRequest, model.Error{Message: "Actor not found"})
+		return
+	}
+	if actor.Role != "support" {
+		c.JSON(http.StatusBadRequest, model.Error{Message: "Only support users can impersonate"})
+		return
+	}
+	subject, err := h.User.GetProfile(c, &pb.GetProfileRequest{Id: req.SubjectID})
+	if err != nil {
+		h.Log.Error("Failed to get subject profile", "error", err.Error())
+		c.JSON(http.StatusBadRequest, model.Error{Message: "Subject not found"})
+		return
+	}
+	if subject.Role == "admin" {
+		c.JSON(http.StatusBadRequest, model.Error{Message: "Admins cannot be impersonated"})
+		return
+	}
+
+	now := time.Now()
+	grant := &impersonation.Grant{
+		ID:          uuid.NewString(),
+		ActorID:     req.ActorID,
+		SubjectID:   req.SubjectID,
+		SubjectRole: subject.Role,
+		Reason:      req.Reason,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(duration),
+	}
+	if principal, ok := middleware.GetPrincipal(c); ok {
+		grant.CreatedBy = principal.UserID
+	}
+	if err := h.Impersonation.CreateGrant(c, grant); err != nil {
+		h.Log.Error("Failed to create impersonation grant", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	h.Log.Info("Impersonation granted", "grant_id", grant.ID, "actor_id", grant.ActorID,
+		"subject_id", grant.SubjectID, "created_by", grant.CreatedBy, "reason", grant.Reason)
+	c.JSON(http.StatusOK, grant)
+}
+
+// @Summary      List impersonation grants
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Success      200 {object} []impersonation.Grant
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/impersonation/grants [get]
+func (h *Handler) GetImpersonationGrants(c *gin.Context) {
+	grants, err := h.Impersonation.ListGrants(c)
+	if err != nil {
+		h.Log.Error("Failed to list impersonation grants", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"grants": grants})
+}
+
+// @Summary      Revoke impersonation grant
+// @Description  Revokes the grant and every token issued with it.
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        id path string true "Grant ID"
+// @Success      200 {object} string "Grant revoked"
+// @Failure      404 {object} model.Error "Grant not found"
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/impersonation/grants/{id} [delete]
+func (h *Handler) RevokeImpersonationGrant(c *gin.Context) {
+	id := c.Param("id")
+	grant, err := h.Impersonation.GetGrant(c, id)
+	if errors.Is(err, impersonation.ErrGrantNotFound) {
+		c.JSON(http.StatusNotFound, model.Error{Message: "Grant not found"})
+		return
+	}
+	if err == nil {
+		err = h.Impersonation.RevokeGrant(c, id, time.Now())
+	}
+	if err == nil {
+		err = h.Denylist.RevokeToken(c, id, grant.ExpiresAt)
+	}
+	if err != nil {
+		h.Log.Error("Failed to revoke impersonation grant", "grant_id", id, "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	h.Log.Info("Impersonation grant revoked", "grant_id", id)
+	c.JSON(http.StatusOK, gin.H{"message": "Grant revoked"})
+}
+
+// @Summary      Impersonation audit trail
+// @Description  Requests made while impersonating, newest first.
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        grant_id query string false "Only records of this grant"
+// @Param        limit    query int    false "Maximum number of records" default(100)
+// @Success      200 {object} []impersonation.Record
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/impersonation/audit [get]
+func (h *Handler) GetImpersonationAudit(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	records, err := h.Impersonation.Records(c, c.Query("grant_id"), limit)
+	if err != nil {
+		h.Log.Error("Failed to read impersonation audit", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"records": records})
+}
+
+// @Summary      Act as another user
+// @Description  Exchanges an impersonation grant for a short-lived access token of its subject. Responses to requests made with it carry the X-Impersonated-By header, and deletes and password changes are refused.
+// @Tags         support
+// @Accept       json
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        request body ImpersonateRequest true "Grant"
+// @Success      200 {object} ImpersonateResponse
+// @Failure      400 {object} model.Error "Invalid request body"
+// @Failure      403 {object} model.Error "Grant is not usable"
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/support/impersonate [post]
+func (h *Handler) Impersonate(c *gin.Context) {
+	var req ImpersonateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, model.Error{Message: "Invalid request body"})
+		return
+	}
+	principal, ok := middleware.GetPrincipal(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, model.Error{Message: "unauthorized"})
+		return
+	}
+
+	grant, err := h.Impersonation.GetGrant(c, req.GrantID)
+	if err != nil && !errors.Is(err, impersonation.ErrGrantNotFound) {
+		h.Log.Error("Failed to get impersonation grant", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	now := time.Now()
+	if grant == nil || grant.ActorID != principal.UserID || !grant.Active(now) {
+		c.JSON(http.StatusForbidden, model.Error{Message: "Grant is not usable"})
+		return
+	}
+
+	expiresAt := now.Add(h.ImpersonateTTL)
+	if grant.ExpiresAt.Before(expiresAt) {
+		expiresAt = grant.ExpiresAt
+	}
+	access, err := token.GeneratedImpersonationToken(grant.SubjectID, grant.SubjectRole, grant.ActorID, grant.ID, expiresAt.Sub(now))
+	if err != nil {
+		h.Log.Error("Failed to sign impersonation token", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	h.Log.Info("Impersonation started", "grant_id", grant.ID, "actor_id", grant.ActorID, "subject_id", grant.SubjectID)
+	c.JSON(http.StatusOK, ImpersonateResponse{AccessToken: access, SubjectID: grant.SubjectID, ExpiresAt: expiresAt})
+}
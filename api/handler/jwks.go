@@ -0,0 +1,19 @@
+package handler
+
+import (
+	"api/api/token"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// @Summary      JSON Web Key Set
+// @Description  Public keys that verify access tokens issued by the gateway. Empty while tokens are signed with HS256.
+// @Tags         all
+// @Produce      json
+// @Success      200 {object} token.JWKS
+// @Router       /.well-known/jwks.json [get]
+func (h *Handler) JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, token.AccessKeys().JWKS())
+}
@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"api/api/lockout"
+	"api/model"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// @Summary      List login lockouts
+// @Description  Lists users and client IPs with failed login attempts, locked ones first.
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Success      200 {object} []lockout.Entry
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/lockouts [get]
+func (h *Handler) GetLockouts(c *gin.Context) {
+	entries, err := h.Lockout.List(c)
+	if err != nil {
+		h.Log.Error("Failed to list lockouts", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"lockouts": entries})
+}
+
+// @Summary      Clear login lockouts
+// @Description  Clears the failed login attempts of a user and/or a client IP.
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        hh_id query string false "User hh_id"
+// @Param        ip    query string false "Client IP"
+// @Success      200 {object} string "Lockout cleared"
+// @Failure      400 {object} model.Error "hh_id or ip is required"
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/lockouts [delete]
+func (h *Handler) ClearLockout(c *gin.Context) {
+	var keys []string
+	if hhID := c.Query("hh_id"); hhID != "" {
+		keys = append(keys, lockout.UserKey(hhID))
+	}
+	if ip := c.Query("ip"); ip != "" {
+		keys = append(keys, lockout.IPKey(ip))
+	}
+	if len(keys) == 0 {
+		c.JSON(http.StatusBadRequest, model.Error{Message: "hh_id or ip is required"})
+		return
+	}
+
+	for _, key := range keys {
+		if err := h.Lockout.Clear(c, key); err != nil {
+			h.Log.Error("Failed to clear lockout", "key", key, "error", err.Error())
+			c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+			return
+		}
+	}
+	h.Log.Info("Lockout cleared", "keys", keys)
+	c.JSON(http.StatusOK, gin.H{"message": "Lockout cleared"})
+}
@@ -45,13 +45,18 @@ func (h *Handler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer conn.Close()
+	if !h.track(conn) {
+		closeGoingAway(conn)
+		return
+	}
+	defer h.untrack(conn)
 
 	conn.SetReadLimit(maxMessageSize)
 	conn.SetReadDeadline(time.Now().Add(pongWait))
 	conn.SetPongHandler(func(string) error { conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 
 	// Autentifikatsiya
-	var userID string
+	var userID, sessionID string
 	stopChan := make(chan struct{}) // Go-routine ni to'xtatish uchun channel
 	go func() {
 		for {
@@ -81,12 +86,14 @@ func (h *Handler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 		if msg.Action == "auth" {
 			log.Printf("Auth so'rovi keldi. Token: %s", msg.Token)
-			userID, _, err = token.GetUserInfoFromAccessToken(msg.Token)
+			principal, err := token.Authenticate(r.Context(), h.Denylist, msg.Token)
 			if err != nil {
 				log.Printf("Noto'g'ri access token: %v", err)
 				conn.WriteMessage(websocket.TextMessage, []byte("Invalid access token"))
 				return
 			}
+			userID = principal.UserID
+			sessionID = principal.SessionID
 			log.Printf("Foydalanuvchi autentifikatsiyadan o'tdi: %s", userID)
 			break
 		}
@@ -95,11 +102,19 @@ func (h *Handler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	// Ulanishni saqlash
 	h.ConnMutex.Lock()
 	h.Connections[userID] = conn
+	if sessionID != "" {
+		h.SessionConns[sessionID] = conn
+	}
 	h.ConnMutex.Unlock()
 
 	defer func() {
 		h.ConnMutex.Lock()
-		delete(h.Connections, userID)
+		if h.Connections[userID] == conn {
+			delete(h.Connections, userID)
+		}
+		if h.SessionConns[sessionID] == conn {
+			delete(h.SessionConns, sessionID)
+		}
 		h.ConnMutex.Unlock()
 		close(stopChan) // Channelni yopish
 	}()
@@ -151,6 +166,54 @@ func (h *Handler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// track registers an open WebSocket so that Drain can close it. It returns
+// false once the gateway is shutting down.
+func (h *Handler) track(conn *websocket.Conn) bool {
+	h.ConnMutex.Lock()
+	defer h.ConnMutex.Unlock()
+	if h.draining {
+		return false
+	}
+	if h.sockets == nil {
+		h.sockets = make(map[*websocket.Conn]bool)
+	}
+	h.sockets[conn] = true
+	return true
+}
+
+func (h *Handler) untrack(conn *websocket.Conn) {
+	h.ConnMutex.Lock()
+	delete(h.sockets, conn)
+	h.ConnMutex.Unlock()
+}
+
+// Drain refuses new WebSockets and sends every open one a Going Away close
+// frame, which tells clients to reconnect, to another replica or once the
+// gateway is back. It returns the number of WebSockets closed.
+func (h *Handler) Drain() int {
+	h.ConnMutex.Lock()
+	h.draining = true
+	conns := make([]*websocket.Conn, 0, len(h.sockets))
+	for conn := range h.sockets {
+		conns = append(conns, conn)
+	}
+	h.ConnMutex.Unlock()
+
+	for _, conn := range conns {
+		closeGoingAway(conn)
+	}
+	return len(conns)
+}
+
+// closeGoingAway sends the close frame and closes conn, which ends the read
+// loop of its handler.
+func closeGoingAway(conn *websocket.Conn) {
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is restarting, reconnect"),
+		time.Now().Add(writeWait))
+	conn.Close()
+}
+
 func (h *Handler) sendNotifications(conn *websocket.Conn, userID string) {
 	if userID == "" {
 		log.Println("UserID bo'sh, bildirishnomalarni yuborish mumkin emas.")
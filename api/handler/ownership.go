@@ -0,0 +1,391 @@
+package handler
+
+import (
+	"api/api/middleware"
+	"api/api/token"
+	"api/casbin"
+	pbg "api/genproto/group"
+	pbq "api/genproto/question"
+	pbt "api/genproto/topic"
+	pbu "api/genproto/user"
+	"api/model"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	errNoResourceID = errors.New("resource id missing from request")
+	errBodyTooLarge = errors.New("request body too large")
+)
+
+// maxOwnedBody is the largest JSON body a resource ID is read from. It is
+// large enough for the inputs of test cases.
+const maxOwnedBody = 4 << 20
+
+// Where a ResourceID is read from.
+const (
+	FromPath  = "path"
+	FromQuery = "query"
+	FromBody  = "body"
+)
+
+// ResourceID names where the ID of the resource a request acts on is read
+// from: a path parameter, a query parameter or a field of the JSON body.
+type ResourceID struct {
+	From string
+	Name string
+}
+
+// Param takes the resource ID from a path parameter.
+func Param(name string) ResourceID {
+	return ResourceID{From: FromPath, Name: name}
+}
+
+// Query takes the resource ID from a query parameter.
+func Query(name string) ResourceID {
+	return ResourceID{From: FromQuery, Name: name}
+}
+
+// BodyField takes the resource ID from a field of the JSON body. The body is
+// left in place for the handler, and may be at most maxOwnedBody long.
+func BodyField(name string) ResourceID {
+	return ResourceID{From: FromBody, Name: name}
+}
+
+// Read returns the resource ID of the request.
+func (r ResourceID) Read(c *gin.Context) (string, error) {
+	switch r.From {
+	case FromPath:
+		return c.Param(r.Name), nil
+	case FromQuery:
+		return c.Query(r.Name), nil
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxOwnedBody))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return "", errBodyTooLarge
+	}
+	if err != nil {
+		return "", err
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return "", errNoResourceID
+	}
+	id, _ := fields[r.Name].(string)
+	return id, nil
+}
+
+// OwnershipRule decides whether the caller may act on the resource id.
+type OwnershipRule struct {
+	Name  string
+	Check func(ctx context.Context, a *Access, id string) (bool, error)
+}
+
+// Ownership is the ownership check of a route.
+type Ownership struct {
+	Rule OwnershipRule
+	ID   ResourceID
+}
+
+// Owns checks rule against the resource named in the request before the
+// handler runs. Casbin decides which roles may call a route at all; this
+// decides which records they may touch. Admins and API keys are not
+// restricted: a key belongs to a service account rather than a user, so it
+// is limited by its casbin subject and scopes only.
+func (h *Handler) Owns(rule OwnershipRule, from ResourceID) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, ok := middleware.GetPrincipal(c)
+		if !ok {
+			middleware.Unauthorized(c, model.CodeMissingCredentials, "Authorization is required")
+			return
+		}
+		if unrestricted(principal) {
+			c.Next()
+			return
+		}
+
+		id, err := from.Read(c)
+		if err == nil && id == "" {
+			err = errNoResourceID
+		}
+		if errors.Is(err, errBodyTooLarge) {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, model.Error{Message: "Request body is too large"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, model.Error{Message: "Resource id is required"})
+			return
+		}
+
+		access := &Access{h: h, principal: principal, path: c.FullPath(), method: c.Request.Method}
+		allowed, err := rule.Check(c, access, id)
+		if status.Code(err) == codes.NotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, model.Error{Message: "Resource not found"})
+			return
+		}
+		if err != nil {
+			h.Log.Error("Failed to check resource ownership", "path", c.FullPath(), "id", id, "error", err.Error())
+			middleware.InternalError(c, err)
+			return
+		}
+		if !allowed {
+			h.Log.Warn("Resource access denied", "user_id", principal.UserID, "role", principal.Role, "path", c.FullPath(), "id", id)
+			middleware.Forbidden(c, model.CodeNotResourceOwner, "You do not have access to this resource")
+			return
+		}
+		c.Next()
+	}
+}
+
+// unrestricted reports whether principal may act on any resource.
+func unrestricted(principal *token.Principal) bool {
+	return principal.Role == "admin" || principal.APIKeyID != ""
+}
+
+// The ownership rules of the routes.
+var (
+	TeachesGroup        = OwnershipRule{Name: "TeachesGroup", Check: teachesGroup}
+	MemberOfGroup       = OwnershipRule{Name: "MemberOfGroup", Check: memberOfGroup}
+	SelfUser            = OwnershipRule{Name: "SelfUser", Check: selfUser}
+	SelfOrTaughtStudent = OwnershipRule{Name: "SelfOrTaughtStudent", Check: selfOrTaughtStudent}
+	InSubject           = OwnershipRule{Name: "InSubject", Check: inSubject}
+	InSubjectOfTopic    = OwnershipRule{Name: "InSubjectOfTopic", Check: inSubjectOfTopic}
+	InSubjectOfQuestion = OwnershipRule{Name: "InSubjectOfQuestion", Check: inSubjectOfQuestion}
+	// InSubjectOfQuestionInput and InSubjectOfTestCase check the question of
+	// a question input or test case.
+	InSubjectOfQuestionInput = OwnershipRule{Name: "InSubjectOfQuestionInput", Check: inSubjectOfQuestionInput}
+	InSubjectOfTestCase      = OwnershipRule{Name: "InSubjectOfTestCase", Check: inSubjectOfTestCase}
+)
+
+// Access looks up, once per request, what the caller is related to.
+type Access struct {
+	h         *Handler
+	principal *token.Principal
+	path      string
+	method    string
+
+	hhID   string
+	groups []*pbg.Group
+	loaded bool
+}
+
+// callerHhID returns the hh_id of the caller, which students are identified
+// by in groups and tasks.
+func (a *Access) callerHhID(ctx context.Context) (string, error) {
+	if a.hhID != "" {
+		return a.hhID, nil
+	}
+	profile, err := a.h.User.GetProfile(ctx, &pbu.GetProfileRequest{Id: a.principal.UserID})
+	if err != nil {
+		return "", err
+	}
+	a.hhID = profile.HhId
+	return a.hhID, nil
+}
+
+// callerGroups returns the groups the caller teaches or is enrolled in.
+func (a *Access) callerGroups(ctx context.Context) ([]*pbg.Group, error) {
+	if a.loaded {
+		return a.groups, nil
+	}
+	switch a.principal.Role {
+	case "teacher":
+		res, err := a.h.Group.GetTeacherGroups(ctx, &pbg.TeacherId{Id: a.principal.UserID})
+		if err != nil {
+			return nil, err
+		}
+		a.groups = res.Groups
+	case "student":
+		hhID, err := a.callerHhID(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res, err := a.h.Group.GetStudentGroups(ctx, &pbg.StudentId{HhId: hhID})
+		if err != nil {
+			return nil, err
+		}
+		a.groups = res.Groups
+	}
+	a.loaded = true
+	return a.groups, nil
+}
+
+// ledSubjects returns the subjects the caller was granted a role in, such as
+// subject_lead, with a grant limited to that subject.
+func (a *Access) ledSubjects() ([]string, error) {
+	grants, err := a.h.Enforcer.GetFilteredGroupingPolicy(0, a.principal.UserID)
+	if err != nil {
+		return nil, err
+	}
+	var subjects []string
+	for _, g := range grants {
+		if g[2] != casbin.AnyDomain {
+			subjects = append(subjects, g[2])
+		}
+	}
+	return subjects, nil
+}
+
+// leads reports whether a grant limited to subjectID allows the caller the
+// current route.
+func (a *Access) leads(subjectID string) (bool, error) {
+	subjects, err := a.ledSubjects()
+	if err != nil || !slices.Contains(subjects, subjectID) {
+		return false, err
+	}
+	return a.h.Enforcer.Enforce(a.principal.UserID, subjectID, a.path, a.method)
+}
+
+// teachesGroup allows teachers of the group id.
+func teachesGroup(ctx context.Context, a *Access, id string) (bool, error) {
+	if a.principal.Role != "teacher" {
+		return false, nil
+	}
+	group, err := a.h.Group.GetGroupById(ctx, &pbg.GroupId{Id: id})
+	if err != nil {
+		return false, err
+	}
+	if group.TeacherId == a.principal.UserID {
+		return true, nil
+	}
+	return memberOfGroup(ctx, a, id)
+}
+
+// memberOfGroup allows teachers and students of the group id.
+func memberOfGroup(ctx context.Context, a *Access, id string) (bool, error) {
+	groups, err := a.callerGroups(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, g := range groups {
+		if g.Id == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// selfUser allows callers acting on their own user id.
+func selfUser(ctx context.Context, a *Access, id string) (bool, error) {
+	return id == a.principal.UserID, nil
+}
+
+// selfOrTaughtStudent allows students acting on their own hh_id and
+// teachers acting on a student of one of their groups.
+func selfOrTaughtStudent(ctx context.Context, a *Access, hhID string) (bool, error) {
+	switch a.principal.Role {
+	case "student":
+		own, err := a.callerHhID(ctx)
+		return own == hhID, err
+	case "teacher":
+		groups, err := a.callerGroups(ctx)
+		if err != nil || len(groups) == 0 {
+			return false, err
+		}
+		// The groups of the student are one call, where the students of every
+		// group of the teacher would be one call per group.
+		res, err := a.h.Group.GetStudentGroups(ctx, &pbg.StudentId{HhId: hhID})
+		if err != nil {
+			return false, err
+		}
+		for _, g := range res.Groups {
+			if slices.ContainsFunc(groups, func(own *pbg.Group) bool { return own.Id == g.Id }) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// inSubject allows teachers and students of a group of the subject id, and
+// users granted the route in that subject.
+func inSubject(ctx context.Context, a *Access, id string) (bool, error) {
+	groups, err := a.callerGroups(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, g := range groups {
+		if g.SubjectId == id {
+			return true, nil
+		}
+	}
+	return a.leads(id)
+}
+
+// topicPage is the number of topics fetched per call while looking one up.
+const topicPage = 500
+
+// topicSubject returns the subject of the topic id. The topic service cannot
+// look a topic up by its ID, so topics are paged through until it is found.
+func (a *Access) topicSubject(ctx context.Context, id string) (string, error) {
+	for page := int32(1); ; page++ {
+		res, err := a.h.Topic.GetAllTopics(ctx, &pbt.GetAllTopicsReq{Limit: topicPage, Page: page})
+		if err != nil {
+			return "", err
+		}
+		for _, t := range res.Topics {
+			if t.Id == id {
+				return t.SubjectId, nil
+			}
+		}
+		if len(res.Topics) < topicPage || (res.Count > 0 && page*topicPage >= res.Count) {
+			return "", status.Errorf(codes.NotFound, "topic %s not found", id)
+		}
+	}
+}
+
+// inSubjectOfTopic allows teachers and students of a group whose subject
+// contains the topic id, and users granted the route in that subject.
+func inSubjectOfTopic(ctx context.Context, a *Access, id string) (bool, error) {
+	subjectID, err := a.topicSubject(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	return inSubject(ctx, a, subjectID)
+}
+
+// inSubjectOfQuestion allows teachers and students of a group whose subject
+// contains the question id, and users granted the route in that subject.
+func inSubjectOfQuestion(ctx context.Context, a *Access, id string) (bool, error) {
+	question, err := a.h.Question.GetQuestion(ctx, &pbq.QuestionId{Id: id})
+	if err != nil {
+		return false, err
+	}
+	if question.TopicId == "" {
+		return false, fmt.Errorf("question %s has no topic", id)
+	}
+	return inSubjectOfTopic(ctx, a, question.TopicId)
+}
+
+// inSubjectOfQuestionInput allows whoever inSubjectOfQuestion allows for the
+// question of the input id.
+func inSubjectOfQuestionInput(ctx context.Context, a *Access, id string) (bool, error) {
+	input, err := a.h.QuestionInput.GetQuestionInput(ctx, &pbq.QuestionInputId{Id: id})
+	if err != nil {
+		return false, err
+	}
+	return inSubjectOfQuestion(ctx, a, input.QuestionId)
+}
+
+// inSubjectOfTestCase allows whoever inSubjectOfQuestion allows for the
+// question of the test case id.
+func inSubjectOfTestCase(ctx context.Context, a *Access, id string) (bool, error) {
+	testCase, err := a.h.TestCase.GetTestCase(ctx, &pbq.TestCaseId{Id: id})
+	if err != nil {
+		return false, err
+	}
+	return inSubjectOfQuestion(ctx, a, testCase.QuestionId)
+}
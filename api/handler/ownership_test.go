@@ -0,0 +1,51 @@
+package handler_test
+
+import (
+	"api/api/handler"
+	"api/api/middleware"
+	"api/api/token"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestOwnsBody(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	// owned allows the caller to act on group "mine" only.
+	owned := handler.OwnershipRule{Name: "Owned", Check: func(_ context.Context, _ *handler.Access, id string) (bool, error) {
+		return id == "mine", nil
+	}}
+	tests := []struct {
+		name      string
+		principal *token.Principal
+		body      string
+		code      int
+	}{
+		{"own record", &token.Principal{UserID: "user-1", Role: "teacher"}, `{"id": "mine"}`, http.StatusOK},
+		{"other record", &token.Principal{UserID: "user-1", Role: "teacher"}, `{"id": "theirs"}`, http.StatusForbidden},
+		{"no id", &token.Principal{UserID: "user-1", Role: "teacher"}, `{}`, http.StatusBadRequest},
+		{"body too large", &token.Principal{UserID: "user-1", Role: "teacher"}, `{"id": "mine", "pad": "` + strings.Repeat("x", 5<<20) + `"}`, http.StatusRequestEntityTooLarge},
+		{"api key", &token.Principal{UserID: "import-script", Role: "teacher", APIKeyID: "key-1"}, `{"id": "theirs"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		h := &handler.Handler{Log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+		r := gin.New()
+		r.Use(func(c *gin.Context) { middleware.SetPrincipal(c, tt.principal) })
+		r.PUT("/update", h.Owns(owned, handler.BodyField("id")), func(c *gin.Context) {
+			// The handler still gets the whole body.
+			body, _ := io.ReadAll(c.Request.Body)
+			if !strings.Contains(string(body), `"id"`) {
+				t.Errorf("%s: handler got body %q", tt.name, body)
+			}
+			c.Status(http.StatusOK)
+		})
+		if code := serve(r, http.MethodPut, "/update", tt.body); code != tt.code {
+			t.Errorf("%s: code = %d, want %d", tt.name, code, tt.code)
+		}
+	}
+}
@@ -0,0 +1,481 @@
+package handler
+
+import (
+	"api/casbin"
+	"api/model"
+	"bytes"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type PolicyRule struct {
+	Sub string `json:"sub" form:"sub" binding:"required"`
+	// Dom is a subject id, or "*" for every subject when empty.
+	Dom string `json:"dom" form:"dom"`
+	Obj string `json:"obj" form:"obj" binding:"required"`
+	Act string `json:"act" form:"act" binding:"required"`
+}
+
+func (p PolicyRule) rule() casbin.Rule {
+	return casbin.Rule{PType: "p", Values: []string{p.Sub, orAnyDomain(p.Dom), p.Obj, strings.ToUpper(p.Act)}}
+}
+
+type ReplacePoliciesRequest struct {
+	// Sub limits the replacement to the rules of one subject. Empty replaces
+	// every p rule.
+	Sub   string       `json:"sub"`
+	Rules []PolicyRule `json:"rules"`
+}
+
+type RoleGrant struct {
+	UserID string `json:"user_id" form:"user_id" binding:"required"`
+	Role   string `json:"role" form:"role" binding:"required"`
+	// Domain limits the grant to one subject id, such as a subject_lead of
+	// one subject. Empty grants the role in every subject.
+	Domain string `json:"domain" form:"domain"`
+}
+
+func (g RoleGrant) rule() casbin.Rule {
+	return casbin.Rule{PType: "g", Values: []string{g.UserID, g.Role, orAnyDomain(g.Domain)}}
+}
+
+// policiesPath is the route that replaces policies. Edits that would leave
+// no subject able to call it are refused, since only the policy file could
+// then restore access.
+const policiesPath = "/api/admin/policies"
+
+var errNoPolicyAdmin = model.Error{Message: "No subject could manage policies after this change"}
+
+// keepsPolicyAdmin reports whether some role or user can still replace
+// policies once add and remove are applied.
+func (h *Handler) keepsPolicyAdmin(add, remove []casbin.Rule) (bool, error) {
+	sim, err := casbin.Simulate(h.Enforcer, add, remove)
+	if err != nil {
+		return false, err
+	}
+	subjects, err := sim.GetAllSubjects()
+	if err != nil {
+		return false, err
+	}
+	grants, err := sim.GetGroupingPolicy()
+	if err != nil {
+		return false, err
+	}
+	for _, g := range grants {
+		subjects = append(subjects, g[0])
+	}
+	for _, sub := range subjects {
+		ok, err := sim.Enforce(sub, casbin.AnyDomain, policiesPath, http.MethodPut)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// replacedRules are the rules in scope that Replace with rules removes.
+func (h *Handler) replacedRules(rules []casbin.Rule, scope func(casbin.Rule) bool) ([]casbin.Rule, error) {
+	stored, err := casbin.Rules(h.Enforcer)
+	if err != nil {
+		return nil, err
+	}
+	keep := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		keep[rule.String()] = true
+	}
+	var removed []casbin.Rule
+	for _, rule := range stored {
+		if scope(rule) && !keep[rule.String()] {
+			removed = append(removed, rule)
+		}
+	}
+	return removed, nil
+}
+
+func orAnyDomain(dom string) string {
+	if dom == "" {
+		return casbin.AnyDomain
+	}
+	return dom
+}
+
+// @Summary      List policies
+// @Description  Lists the p rules in effect, optionally for one subject.
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        sub query string false "Subject"
+// @Success      200 {object} []PolicyRule
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/policies [get]
+func (h *Handler) GetPolicies(c *gin.Context) {
+	sub := c.Query("sub")
+	var (
+		rules [][]string
+		err   error
+	)
+	if sub != "" {
+		rules, err = h.Enforcer.GetFilteredPolicy(0, sub)
+	} else {
+		rules, err = h.Enforcer.GetPolicy()
+	}
+	if err != nil {
+		h.Log.Error("Failed to list policies", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+
+	policies := make([]PolicyRule, 0, len(rules))
+	for _, r := range rules {
+		policies = append(policies, PolicyRule{Sub: r[0], Dom: r[1], Obj: r[2], Act: r[3]})
+	}
+	c.JSON(http.StatusOK, gin.H{"policies": policies})
+}
+
+// @Summary      Add policy
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        request body PolicyRule true "Rule"
+// @Success      200 {object} string "Policy added"
+// @Failure      400 {object} model.Error "Invalid rule"
+// @Failure      409 {object} model.Error "Policy already exists"
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/policies [post]
+func (h *Handler) AddPolicy(c *gin.Context) {
+	var req PolicyRule
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, model.Error{Message: "Invalid request body"})
+		return
+	}
+	rule := req.rule()
+	if err := rule.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, model.Error{Message: err.Error()})
+		return
+	}
+
+	added, err := h.Enforcer.AddPolicy(rule.Values)
+	if err != nil {
+		h.Log.Error("Failed to add policy", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	if !added {
+		c.JSON(http.StatusConflict, model.Error{Message: "Policy already exists"})
+		return
+	}
+	h.Log.Info("Policy added", "rule", rule.String())
+	c.JSON(http.StatusOK, gin.H{"message": "Policy added"})
+}
+
+// @Summary      Remove policy
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        sub query string true "Subject"
+// @Param        dom query string false "Domain" default(*)
+// @Param        obj query string true "Path"
+// @Param        act query string true "Method"
+// @Success      200 {object} string "Policy removed"
+// @Failure      400 {object} model.Error "Invalid rule"
+// @Failure      404 {object} model.Error "Policy not found"
+// @Failure      409 {object} model.Error "No subject could manage policies"
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/policies [delete]
+func (h *Handler) RemovePolicy(c *gin.Context) {
+	var req PolicyRule
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, model.Error{Message: "sub, obj and act are required"})
+		return
+	}
+	rule := req.rule()
+	if err := rule.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, model.Error{Message: err.Error()})
+		return
+	}
+	ok, err := h.keepsPolicyAdmin(nil, []casbin.Rule{rule})
+	if err != nil {
+		h.Log.Error("Failed to remove policy", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusConflict, errNoPolicyAdmin)
+		return
+	}
+
+	removed, err := h.Enforcer.RemovePolicy(rule.Values)
+	if err != nil {
+		h.Log.Error("Failed to remove policy", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, model.Error{Message: "Policy not found"})
+		return
+	}
+	h.Log.Info("Policy removed", "rule", rule.String())
+	c.JSON(http.StatusOK, gin.H{"message": "Policy removed"})
+}
+
+// @Summary      Replace policies
+// @Description  Replaces every p rule, or every p rule of one subject, with the given rules.
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        request body ReplacePoliciesRequest true "Rules"
+// @Success      200 {object} string "Policies replaced"
+// @Failure      400 {object} model.Error "Invalid rule"
+// @Failure      409 {object} model.Error "No subject could manage policies"
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/policies [put]
+func (h *Handler) ReplacePolicies(c *gin.Context) {
+	var req ReplacePoliciesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, model.Error{Message: "Invalid request body"})
+		return
+	}
+	rules := make([]casbin.Rule, 0, len(req.Rules))
+	for _, r := range req.Rules {
+		rule := r.rule()
+		if err := rule.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, model.Error{Message: err.Error()})
+			return
+		}
+		if req.Sub != "" && r.Sub != req.Sub {
+			c.JSON(http.StatusBadRequest, model.Error{Message: "Every rule must be for " + req.Sub})
+			return
+		}
+		rules = append(rules, rule)
+	}
+	scope := func(r casbin.Rule) bool {
+		return r.PType == "p" && (req.Sub == "" || r.Values[0] == req.Sub)
+	}
+	if !h.allowReplace(c, rules, scope, "Failed to replace policies") {
+		return
+	}
+
+	added, removed, err := casbin.Replace(h.Enforcer, rules, scope)
+	if err != nil {
+		h.Log.Error("Failed to replace policies", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	h.Log.Info("Policies replaced", "sub", req.Sub, "added", added, "removed", removed)
+	c.JSON(http.StatusOK, gin.H{"message": "Policies replaced", "added": added, "removed": removed})
+}
+
+// allowReplace responds and returns false unless replacing the rules in
+// scope with rules keeps someone able to manage policies.
+func (h *Handler) allowReplace(c *gin.Context, rules []casbin.Rule, scope func(casbin.Rule) bool, failure string) bool {
+	removed, err := h.replacedRules(rules, scope)
+	ok := false
+	if err == nil {
+		ok, err = h.keepsPolicyAdmin(rules, removed)
+	}
+	switch {
+	case err != nil:
+		h.Log.Error(failure, "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+	case !ok:
+		c.JSON(http.StatusConflict, errNoPolicyAdmin)
+	}
+	return err == nil && ok
+}
+
+// @Summary      List role grants
+// @Description  Lists the roles granted to users in addition to the role of their account.
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        user_id query string false "User ID"
+// @Param        role query string false "Role"
+// @Param        domain query string false "Subject ID"
+// @Success      200 {object} []RoleGrant
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/roles/users [get]
+func (h *Handler) GetRoleGrants(c *gin.Context) {
+	grants, err := h.Enforcer.GetFilteredGroupingPolicy(0, c.Query("user_id"), c.Query("role"), c.Query("domain"))
+	if err != nil {
+		h.Log.Error("Failed to list role grants", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+
+	res := make([]RoleGrant, 0, len(grants))
+	for _, g := range grants {
+		res = append(res, RoleGrant{UserID: g[0], Role: g[1], Domain: g[2]})
+	}
+	c.JSON(http.StatusOK, gin.H{"grants": res})
+}
+
+// @Summary      Grant role
+// @Description  Lets a user act with the permissions of a role in addition to their own.
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        request body RoleGrant true "Grant"
+// @Success      200 {object} string "Role granted"
+// @Failure      400 {object} model.Error "Invalid request body or unknown role"
+// @Failure      409 {object} model.Error "Role already granted"
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/roles/users [post]
+func (h *Handler) GrantRole(c *gin.Context) {
+	var req RoleGrant
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, model.Error{Message: "Invalid request body"})
+		return
+	}
+
+	req.Domain = orAnyDomain(req.Domain)
+	if err := req.rule().Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, model.Error{Message: err.Error()})
+		return
+	}
+	// A role is a subject of p rules; a grant of anything else allows
+	// nothing and is most likely a typo.
+	roles, err := h.Enforcer.GetAllSubjects()
+	if err != nil {
+		h.Log.Error("Failed to grant role", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	if !slices.Contains(roles, req.Role) {
+		c.JSON(http.StatusBadRequest, model.Error{Message: "Unknown role " + req.Role})
+		return
+	}
+
+	added, err := h.Enforcer.AddGroupingPolicy(req.UserID, req.Role, req.Domain)
+	if err != nil {
+		h.Log.Error("Failed to grant role", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	if !added {
+		c.JSON(http.StatusConflict, model.Error{Message: "Role already granted"})
+		return
+	}
+	h.Log.Info("Role granted", "user_id", req.UserID, "role", req.Role, "domain", req.Domain)
+	c.JSON(http.StatusOK, gin.H{"message": "Role granted"})
+}
+
+// @Summary      Revoke role
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        user_id query string true "User ID"
+// @Param        role query string true "Role"
+// @Param        domain query string false "Subject ID" default(*)
+// @Success      200 {object} string "Role revoked"
+// @Failure      400 {object} model.Error "Invalid request"
+// @Failure      404 {object} model.Error "Grant not found"
+// @Failure      409 {object} model.Error "No subject could manage policies"
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/roles/users [delete]
+func (h *Handler) RevokeRole(c *gin.Context) {
+	var req RoleGrant
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, model.Error{Message: "user_id and role are required"})
+		return
+	}
+
+	req.Domain = orAnyDomain(req.Domain)
+	ok, err := h.keepsPolicyAdmin(nil, []casbin.Rule{req.rule()})
+	if err != nil {
+		h.Log.Error("Failed to revoke role", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusConflict, errNoPolicyAdmin)
+		return
+	}
+
+	removed, err := h.Enforcer.RemoveGroupingPolicy(req.UserID, req.Role, req.Domain)
+	if err != nil {
+		h.Log.Error("Failed to revoke role", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, model.Error{Message: "Grant not found"})
+		return
+	}
+	h.Log.Info("Role revoked", "user_id", req.UserID, "role", req.Role, "domain", req.Domain)
+	c.JSON(http.StatusOK, gin.H{"message": "Role revoked"})
+}
+
+// @Summary      Export policy
+// @Description  Returns every rule and role grant in casbin CSV format, as accepted by the import endpoint and the policy file.
+// @Tags         admin
+// @Produce      text/csv
+// @Security     ApiKeyAuth
+// @Success      200 {string} string "Policy"
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/policies/export [get]
+func (h *Handler) ExportPolicies(c *gin.Context) {
+	rules, err := casbin.Rules(h.Enforcer)
+	if err != nil {
+		h.Log.Error("Failed to export policies", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	var buf bytes.Buffer
+	if err := casbin.FormatPolicy(&buf, rules); err != nil {
+		h.Log.Error("Failed to export policies", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="policy.csv"`)
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+}
+
+// @Summary      Import policy
+// @Description  Replaces every rule and role grant with the posted policy in casbin CSV format.
+// @Tags         admin
+// @Accept       text/csv
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        policy body string true "Policy"
+// @Success      200 {object} string "Policies imported"
+// @Failure      400 {object} model.Error "Invalid policy"
+// @Failure      409 {object} model.Error "No subject could manage policies"
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/policies/import [post]
+func (h *Handler) ImportPolicies(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, model.Error{Message: "Invalid request body"})
+		return
+	}
+	rules, _, err := casbin.ParsePolicy(bytes.NewReader(body))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, model.Error{Message: err.Error()})
+		return
+	}
+	if len(rules) == 0 {
+		c.JSON(http.StatusBadRequest, model.Error{Message: "Policy is empty"})
+		return
+	}
+
+	everything := func(casbin.Rule) bool { return true }
+	if !h.allowReplace(c, rules, everything, "Failed to import policies") {
+		return
+	}
+
+	added, removed, err := casbin.Replace(h.Enforcer, rules, everything)
+	if err != nil {
+		h.Log.Error("Failed to import policies", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	h.Log.Info("Policies imported", "rules", len(rules), "added", added, "removed", removed)
+	c.JSON(http.StatusOK, gin.H{"message": "Policies imported", "added": added, "removed": removed})
+}
@@ -0,0 +1,89 @@
+package handler_test
+
+import (
+	"api/api/handler"
+	"api/casbin"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func policyRouter(t *testing.T) (*gin.Engine, *handler.Handler) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	enforcer, err := casbin.LoadEnforcer("../../casbin/model.conf", "../../casbin/policy.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &handler.Handler{Enforcer: enforcer, Log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	r := gin.New()
+	r.DELETE("/policies", h.RemovePolicy)
+	r.POST("/policies/import", h.ImportPolicies)
+	r.POST("/roles/users", h.GrantRole)
+	return r, h
+}
+
+func serve(r *gin.Engine, method, target, body string) int {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestRemovePolicy(t *testing.T) {
+	r, h := policyRouter(t)
+	tests := []struct {
+		name   string
+		target string
+		code   int
+	}{
+		{"path without slash", "/policies?sub=admin&obj=api/user/all&act=GET", http.StatusBadRequest},
+		{"last rule to replace policies", "/policies?sub=admin&obj=/api/admin/policies&act=PUT", http.StatusConflict},
+		{"ordinary rule", "/policies?sub=admin&obj=/api/user/all&act=GET", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := serve(r, http.MethodDelete, tt.target, ""); code != tt.code {
+			t.Errorf("%s: code = %d, want %d", tt.name, code, tt.code)
+		}
+	}
+	if ok, _ := h.Enforcer.Enforce("admin", casbin.AnyDomain, "/api/admin/policies", http.MethodPut); !ok {
+		t.Fatal("admin can no longer replace policies")
+	}
+}
+
+func TestImportKeepsPolicyAdmin(t *testing.T) {
+	r, _ := policyRouter(t)
+	policy := "p, student, *, /api/user/getprofile, GET\n"
+	if code := serve(r, http.MethodPost, "/policies/import", policy); code != http.StatusConflict {
+		t.Fatalf("import without admin: code = %d, want %d", code, http.StatusConflict)
+	}
+	policy += "p, ops, *, /api/admin/policies, PUT\n"
+	if code := serve(r, http.MethodPost, "/policies/import", policy); code != http.StatusOK {
+		t.Fatalf("import with admin: code = %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestGrantRole(t *testing.T) {
+	r, _ := policyRouter(t)
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"unknown role", `{"user_id": "user-1", "role": "teachr"}`, http.StatusBadRequest},
+		{"known role", `{"user_id": "user-1", "role": "teacher"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := serve(r, http.MethodPost, "/roles/users", tt.body); code != tt.code {
+			t.Errorf("%s: code = %d, want %d", tt.name, code, tt.code)
+		}
+	}
+}
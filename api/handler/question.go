@@ -1,7 +1,6 @@
 package handler
 
 import (
-	"api/config"
 	"api/genproto/question"
 	"api/model"
 	"context"
@@ -13,7 +12,6 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
 // CreateQuestion godoc
@@ -343,10 +341,7 @@ func (h *Handler) UploadImageToQuestion(c *gin.Context) {
 	println("\n File Ext:", fileExt)
 
 	newFile := uuid.NewString() + fileExt
-	minioClient, err := minio.New(config.Load().MINIO_URL, &minio.Options{
-		Creds:  credentials.NewStaticV4("test", "minioadmin", ""),
-		Secure: false,
-	})
+	minioClient, err := h.minioClient()
 	if err != nil {
 		c.AbortWithError(500, err)
 		return
@@ -381,7 +376,7 @@ func (h *Handler) UploadImageToQuestion(c *gin.Context) {
 		return
 	}
 
-	madeUrl := fmt.Sprintf("http://%s/questions/%s", config.Load().MINIO_URL, newFile)
+	madeUrl := fmt.Sprintf("http://%s/questions/%s", h.Config.Current().MINIO_URL, newFile)
 
 	println("\n Info Bucket:", info.Bucket)
 
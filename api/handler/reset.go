@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"api/api/lockout"
+	"api/api/reset"
+	"api/genproto/notification"
+	pb "api/genproto/user"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ForgotPasswordRequest struct {
+	HhId string `json:"hh_id" binding:"required"`
+}
+
+type ResetPasswordRequest struct {
+	HhId        string `json:"hh_id" binding:"required"`
+	Code        string `json:"code" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,min=6"`
+}
+
+// @Summary      Request a password reset code
+// @Description  Sends a one-time code to the user as a notification and over the configured outbound channel. The response is the same whether or not the user exists.
+// @Tags         all
+// @Accept       json
+// @Produce      json
+// @Param        request body ForgotPasswordRequest true "User"
+// @Success      200 {object} string "Reset code sent"
+// @Failure      400 {object} string "Invalid request body"
+// @Failure      429 {object} string "Too many requests"
+// @Failure      500 {object} string "Server error"
+// @Router       /all/user/password/forgot [post]
+func (h *Handler) ForgotPassword(c *gin.Context) {
+	h.Log.Info("ForgotPassword starting")
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.Log.Error("Invalid request body", "error", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	var profile *pb.GetProfileResponse
+	users, err := h.User.GetAllUsers(c, &pb.GetAllUsersRequest{HhId: req.HhId, Limit: 1, Page: 1})
+	if err != nil {
+		h.Log.Error("Failed to look up user", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	for _, u := range users.Users {
+		if u.HhId == req.HhId {
+			profile = u
+		}
+	}
+
+	userID := ""
+	if profile != nil {
+		userID = profile.Id
+	}
+	code, expiresAt, err := h.Reset.Issue(c, req.HhId, userID)
+	if errors.Is(err, reset.ErrTooSoon) {
+		wait := h.Reset.RetryAfter(c, req.HhId)
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "A reset code was sent recently, try again later"})
+		return
+	}
+	if err != nil {
+		h.Log.Error("Failed to issue reset code", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	if profile != nil {
+		msg := reset.Message{
+			UserID:    profile.Id,
+			HhID:      profile.HhId,
+			Phone:     profile.Phone,
+			Code:      code,
+			ExpiresAt: expiresAt,
+		}
+		if _, err := h.CreateNotification(c, &notification.CreateNotificationsReq{UserId: profile.Id, Message: msg.Text()}); err != nil {
+			h.Log.Error("Failed to create reset notification", "error", err.Error())
+		}
+		if err := h.ResetSender.Send(c, msg); err != nil {
+			h.Log.Error("Failed to send reset code", "error", err.Error())
+		}
+	}
+
+	h.Log.Info("ForgotPassword ended")
+	c.JSON(http.StatusOK, gin.H{"message": "If the user exists, a reset code has been sent"})
+}
+
+// @Summary      Reset password
+// @Description  Sets a new password using a code from /all/user/password/forgot and signs the user out everywhere.
+// @Tags         all
+// @Accept       json
+// @Produce      json
+// @Param        request body ResetPasswordRequest true "Reset"
+// @Success      200 {object} string "Password updated"
+// @Failure      400 {object} string "Invalid or expired code"
+// @Failure      429 {object} string "Too many failed attempts"
+// @Failure      500 {object} string "Server error"
+// @Router       /all/user/password/reset [post]
+func (h *Handler) ResetPassword(c *gin.Context) {
+	h.Log.Info("ResetPassword starting")
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.Log.Error("Invalid request body", "error", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	// Wrong codes count against the same per-address budget as failed logins.
+	key := lockout.IPKey(c.ClientIP())
+	wait, err := h.Lockout.Check(c, key)
+	if err != nil {
+		h.Log.Error("Failed to check reset attempts", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed attempts, try again later"})
+		return
+	}
+
+	userID, err := h.Reset.Redeem(c, req.HhId, req.Code)
+	if errors.Is(err, reset.ErrInvalidCode) {
+		if err := h.Lockout.Failed(c, key); err != nil {
+			h.Log.Error("Failed to record reset attempt", "error", err.Error())
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired code"})
+		return
+	}
+	if err != nil {
+		h.Log.Error("Failed to check reset code", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	_, err = h.User.UpdateProfileAdmin(c, &pb.UpdateProfileAdminRequest{Id: userID, Password: req.NewPassword})
+	if err != nil {
+		h.Log.Error("Failed to update password", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if err := h.revokeUserSessions(c, userID); err != nil {
+		h.Log.Error("Failed to revoke sessions after password reset", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if err := h.Lockout.Succeeded(c, lockout.UserKey(req.HhId)); err != nil {
+		h.Log.Error("Failed to reset login attempts", "error", err.Error())
+	}
+
+	h.Log.Info("ResetPassword ended successfully", "user_id", userID)
+	c.JSON(http.StatusOK, gin.H{"message": "Password updated"})
+}
@@ -0,0 +1,210 @@
+package handler
+
+import (
+	"api/api/middleware"
+	"api/api/token"
+	"api/model"
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+type SessionResponse struct {
+	*token.Session
+	Current bool `json:"current"`
+}
+
+// @Summary      List my sessions
+// @Description  Lists the caller's active sessions with device, IP and activity times.
+// @Tags         user
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Success      200 {object} []SessionResponse
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/user/sessions [get]
+func (h *Handler) GetMySessions(c *gin.Context) {
+	principal, ok := middleware.GetPrincipal(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, model.Error{Message: "unauthorized"})
+		return
+	}
+	h.listSessions(c, principal.UserID, principal.SessionID)
+}
+
+// @Summary      Revoke one of my sessions
+// @Description  Signs the session out: its refresh tokens stop working and its WebSocket is closed.
+// @Tags         user
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        id path string true "Session ID"
+// @Success      200 {object} string "Session revoked"
+// @Failure      404 {object} model.Error "Session not found"
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/user/sessions/{id} [delete]
+func (h *Handler) DeleteMySession(c *gin.Context) {
+	principal, ok := middleware.GetPrincipal(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, model.Error{Message: "unauthorized"})
+		return
+	}
+	h.deleteSession(c, principal.UserID, c.Param("id"))
+}
+
+// @Summary      List a user's sessions
+// @Description  Lists the active sessions of any user.
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        id path string true "User ID"
+// @Success      200 {object} []SessionResponse
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/users/{id}/sessions [get]
+func (h *Handler) GetUserSessions(c *gin.Context) {
+	current := ""
+	if principal, ok := middleware.GetPrincipal(c); ok {
+		current = principal.SessionID
+	}
+	h.listSessions(c, c.Param("id"), current)
+}
+
+// @Summary      Revoke a user's session
+// @Description  Signs one session of any user out.
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        id         path string true "User ID"
+// @Param        session_id path string true "Session ID"
+// @Success      200 {object} string "Session revoked"
+// @Failure      404 {object} model.Error "Session not found"
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/users/{id}/sessions/{session_id} [delete]
+func (h *Handler) DeleteUserSession(c *gin.Context) {
+	h.deleteSession(c, c.Param("id"), c.Param("session_id"))
+}
+
+// @Summary      Revoke all sessions of a user
+// @Description  Signs every session of a user out.
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        id path string true "User ID"
+// @Success      200 {object} string "Sessions revoked"
+// @Failure      500 {object} model.Error "Server error"
+// @Router       /api/admin/users/{id}/sessions [delete]
+func (h *Handler) DeleteUserSessions(c *gin.Context) {
+	userID := c.Param("id")
+	if err := h.revokeUserSessions(c, userID); err != nil {
+		h.Log.Error("Failed to revoke sessions", "user_id", userID, "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	h.Log.Info("Sessions revoked", "user_id", userID)
+	c.JSON(http.StatusOK, gin.H{"message": "Sessions revoked"})
+}
+
+func (h *Handler) listSessions(c *gin.Context, userID, current string) {
+	sessions, err := h.Sessions.ListByUser(c, userID)
+	if err != nil {
+		h.Log.Error("Failed to list sessions", "user_id", userID, "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	res := make([]SessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		res = append(res, SessionResponse{Session: session, Current: session.ID == current})
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": res})
+}
+
+func (h *Handler) deleteSession(c *gin.Context, userID, sessionID string) {
+	session, err := h.Sessions.Get(c, sessionID)
+	if errors.Is(err, token.ErrSessionNotFound) || (err == nil && session.UserID != userID) {
+		c.JSON(http.StatusNotFound, model.Error{Message: "Session not found"})
+		return
+	}
+	if err != nil {
+		h.Log.Error("Failed to get session", "session_id", sessionID, "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+
+	if err := h.revokeSession(c, sessionID); err != nil {
+		h.Log.Error("Failed to revoke session", "session_id", sessionID, "error", err.Error())
+		c.JSON(http.StatusInternalServerError, model.Error{Message: "Server error"})
+		return
+	}
+	h.Log.Info("Session revoked", "user_id", userID, "session_id", sessionID)
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
+
+func (h *Handler) startSession(c *gin.Context, refresh *token.RefreshSession) error {
+	now := time.Now()
+	return h.Sessions.Save(c, &token.Session{
+		ID:         refresh.FamilyID,
+		UserID:     refresh.UserID,
+		Role:       refresh.Role,
+		UserAgent:  c.Request.UserAgent(),
+		IP:         c.ClientIP(),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  refresh.ExpiresAt,
+	})
+}
+
+func (h *Handler) revokeAccessToken(ctx context.Context, principal *token.Principal) error {
+	if principal.TokenID == "" {
+		return nil
+	}
+	return h.Denylist.RevokeToken(ctx, principal.TokenID, principal.ExpiresAt)
+}
+
+// revokeSession invalidates the refresh token family sid and every access
+// token issued with it, and closes the WebSocket opened with it.
+func (h *Handler) revokeSession(ctx context.Context, sid string) error {
+	if err := h.RefreshStore.RevokeFamily(ctx, sid); err != nil {
+		return err
+	}
+	if err := h.Denylist.RevokeToken(ctx, sid, time.Now().Add(token.RefreshTokenTTL)); err != nil {
+		return err
+	}
+	if err := h.Sessions.Delete(ctx, sid); err != nil {
+		return err
+	}
+	h.closeSessionConnection(sid)
+	return nil
+}
+
+// revokeUserSessions invalidates every token issued to userID so far.
+func (h *Handler) revokeUserSessions(ctx context.Context, userID string) error {
+	if err := h.Denylist.RevokeUser(ctx, userID, time.Now()); err != nil {
+		return err
+	}
+	sessions, err := h.Sessions.ListByUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if err := h.revokeSession(ctx, session.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handler) closeSessionConnection(sid string) {
+	h.ConnMutex.Lock()
+	conn, ok := h.SessionConns[sid]
+	delete(h.SessionConns, sid)
+	h.ConnMutex.Unlock()
+
+	if ok {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session revoked"),
+			time.Now().Add(writeWait))
+		conn.Close()
+	}
+}
@@ -0,0 +1,343 @@
+package handler
+
+import (
+	"api/api/lockout"
+	"api/api/middleware"
+	"api/api/token"
+	"api/api/totp"
+	pb "api/genproto/user"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type LoginChallengeResponse struct {
+	MFARequired bool `json:"mfa_required"`
+	// EnrollmentRequired means the role requires a second factor the user
+	// has not set up; it must be enrolled with the challenge first.
+	EnrollmentRequired bool      `json:"enrollment_required"`
+	Challenge          string    `json:"challenge"`
+	ExpiresAt          time.Time `json:"expires_at"`
+}
+
+type TwoFactorChallengeRequest struct {
+	Challenge string `json:"challenge" binding:"required"`
+}
+
+type VerifyTwoFactorRequest struct {
+	Challenge string `json:"challenge" binding:"required"`
+	// Code is a code from the authenticator app or a recovery code.
+	Code string `json:"code" binding:"required"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// loginChallenge answers a login whose password was correct but which still
+// needs a second factor.
+func (h *Handler) loginChallenge(c *gin.Context, res *pb.LoginResponse, hhID string, enroll bool) {
+	challenge := &token.Challenge{UserID: res.Id, Role: res.Role, HhID: hhID, Enroll: enroll}
+	raw, err := token.GeneratedChallengeToken(challenge)
+	if err != nil {
+		h.Log.Error("Failed to create login challenge", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	h.Log.Info("Login waiting for second factor", "user_id", res.Id)
+	c.JSON(http.StatusOK, LoginChallengeResponse{
+		MFARequired:        true,
+		EnrollmentRequired: enroll,
+		Challenge:          raw,
+		ExpiresAt:          challenge.ExpiresAt,
+	})
+}
+
+// @Summary      Enrol two-factor authentication during login
+// @Description  Starts enrolment for a user whose role requires a second factor, using the challenge returned by login.
+// @Tags         all
+// @Accept       json
+// @Produce      json
+// @Param        request body TwoFactorChallengeRequest true "Challenge"
+// @Success      200 {object} totp.Setup
+// @Failure      400 {object} string "Invalid request body"
+// @Failure      401 {object} string "Invalid challenge"
+// @Failure      500 {object} string "Server error"
+// @Router       /all/user/2fa/enroll [post]
+func (h *Handler) EnrollTwoFactorChallenge(c *gin.Context) {
+	var req TwoFactorChallengeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	challenge, err := token.ParseChallengeToken(c, h.Denylist, req.Challenge)
+	if err != nil || !challenge.Enroll {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid challenge"})
+		return
+	}
+
+	setup, err := h.TwoFactor.Enroll(c, challenge.UserID, challenge.HhID)
+	if err != nil {
+		h.Log.Error("Failed to enrol second factor", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	c.JSON(http.StatusOK, setup)
+}
+
+// @Summary      Complete login with a second factor
+// @Description  Exchanges the challenge returned by login and a TOTP or recovery code for tokens. For a challenge with enrollment_required, the code also confirms the enrolment.
+// @Tags         all
+// @Accept       json
+// @Produce      json
+// @Param        request body VerifyTwoFactorRequest true "Challenge and code"
+// @Success      200 {object} user.LoginResponse "Tokens"
+// @Failure      400 {object} string "Invalid request body"
+// @Failure      401 {object} string "Invalid challenge or code"
+// @Failure      429 {object} string "Too many failed attempts"
+// @Failure      500 {object} string "Server error"
+// @Router       /all/user/2fa/verify [post]
+func (h *Handler) VerifyTwoFactor(c *gin.Context) {
+	h.Log.Info("VerifyTwoFactor starting")
+	var req VerifyTwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	challenge, err := token.ParseChallengeToken(c, h.Denylist, req.Challenge)
+	if err != nil {
+		h.Log.Error("Invalid login challenge", "error", err.Error())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid challenge"})
+		return
+	}
+
+	keys := []string{lockout.UserKey(challenge.HhID), lockout.IPKey(c.ClientIP())}
+	wait, err := h.Lockout.Check(c, keys...)
+	if err != nil {
+		h.Log.Error("Failed to check login attempts", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed login attempts, try again later"})
+		return
+	}
+
+	if challenge.Enroll {
+		err = h.TwoFactor.Confirm(c, challenge.UserID, req.Code)
+	} else {
+		err = h.TwoFactor.Verify(c, challenge.UserID, req.Code)
+	}
+	switch {
+	case errors.Is(err, totp.ErrInvalidCode), errors.Is(err, totp.ErrNotEnrolled), errors.Is(err, totp.ErrAlreadyEnrolled):
+		h.Log.Warn("Second factor rejected", "user_id", challenge.UserID, "error", err.Error())
+		if err := h.Lockout.Failed(c, keys...); err != nil {
+			h.Log.Error("Failed to record login attempt", "error", err.Error())
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	case err != nil:
+		h.Log.Error("Failed to verify second factor", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	// A challenge is good for one login only.
+	if err := h.Denylist.RevokeToken(c, challenge.ID, challenge.ExpiresAt); err != nil {
+		h.Log.Error("Failed to use up login challenge", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if err := h.Lockout.Succeeded(c, lockout.UserKey(challenge.HhID)); err != nil {
+		h.Log.Error("Failed to reset login attempts", "error", err.Error())
+	}
+
+	res := &pb.LoginResponse{Id: challenge.UserID, Role: challenge.Role}
+	refresh, err := token.IssueTokens(c, h.RefreshStore, res)
+	if err != nil {
+		h.Log.Error(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if err := h.startSession(c, refresh); err != nil {
+		h.Log.Error("Failed to record session", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	h.Log.Info("VerifyTwoFactor ended successfully")
+	c.JSON(http.StatusOK, res)
+}
+
+// @Summary      Enrol two-factor authentication
+// @Description  Creates a TOTP secret, its provisioning URI for a QR code and recovery codes. The second factor is enabled once confirmed with a code.
+// @Tags         user
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Success      200 {object} totp.Setup
+// @Failure      401 {object} string "unauthorized"
+// @Failure      409 {object} string "Already enabled"
+// @Failure      500 {object} string "Server error"
+// @Router       /api/user/2fa/enroll [post]
+func (h *Handler) EnrollTwoFactor(c *gin.Context) {
+	principal, ok := middleware.GetPrincipal(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	profile, err := h.User.GetProfile(c, &pb.GetProfileRequest{Id: principal.UserID})
+	if err != nil {
+		h.Log.Error("Failed to get profile", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	setup, err := h.TwoFactor.Enroll(c, principal.UserID, profile.HhId)
+	if errors.Is(err, totp.ErrAlreadyEnrolled) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		h.Log.Error("Failed to enrol second factor", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	c.JSON(http.StatusOK, setup)
+}
+
+// @Summary      Confirm two-factor authentication
+// @Description  Enables the pending second factor once a code from the authenticator app matches.
+// @Tags         user
+// @Accept       json
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        request body TwoFactorCodeRequest true "Code"
+// @Success      200 {object} string "Two-factor authentication enabled"
+// @Failure      400 {object} string "Invalid code"
+// @Failure      401 {object} string "unauthorized"
+// @Failure      500 {object} string "Server error"
+// @Router       /api/user/2fa/confirm [post]
+func (h *Handler) ConfirmTwoFactor(c *gin.Context) {
+	principal, ok := middleware.GetPrincipal(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	err := h.TwoFactor.Confirm(c, principal.UserID, req.Code)
+	switch {
+	case errors.Is(err, totp.ErrInvalidCode), errors.Is(err, totp.ErrNotEnrolled), errors.Is(err, totp.ErrAlreadyEnrolled):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		h.Log.Error("Failed to confirm second factor", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication enabled"})
+}
+
+// @Summary      Disable two-factor authentication
+// @Description  Removes the caller's second factor after checking a current code. Not allowed for roles that require two-factor authentication.
+// @Tags         user
+// @Accept       json
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        request body TwoFactorCodeRequest true "Code"
+// @Success      200 {object} string "Two-factor authentication disabled"
+// @Failure      400 {object} string "Invalid code"
+// @Failure      401 {object} string "unauthorized"
+// @Failure      403 {object} string "Required for this role"
+// @Failure      429 {object} string "Too many failed attempts"
+// @Failure      500 {object} string "Server error"
+// @Router       /api/user/2fa [delete]
+func (h *Handler) DisableTwoFactor(c *gin.Context) {
+	principal, ok := middleware.GetPrincipal(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	if h.TwoFactor.Required(principal.Role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication is required for this role"})
+		return
+	}
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	// Codes guessed here count against the account like those at login.
+	profile, err := h.User.GetProfile(c, &pb.GetProfileRequest{Id: principal.UserID})
+	if err != nil {
+		h.Log.Error("Failed to get profile", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	keys := []string{lockout.UserKey(profile.HhId), lockout.IPKey(c.ClientIP())}
+	wait, err := h.Lockout.Check(c, keys...)
+	if err != nil {
+		h.Log.Error("Failed to check login attempts", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed attempts, try again later"})
+		return
+	}
+
+	err = h.TwoFactor.Verify(c, principal.UserID, req.Code)
+	switch {
+	case errors.Is(err, totp.ErrInvalidCode), errors.Is(err, totp.ErrNotEnrolled):
+		h.Log.Warn("Second factor rejected", "user_id", principal.UserID, "error", err.Error())
+		if err := h.Lockout.Failed(c, keys...); err != nil {
+			h.Log.Error("Failed to record login attempt", "error", err.Error())
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		h.Log.Error("Failed to verify second factor", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if err := h.Lockout.Succeeded(c, lockout.UserKey(profile.HhId)); err != nil {
+		h.Log.Error("Failed to reset login attempts", "error", err.Error())
+	}
+	if err := h.TwoFactor.Disable(c, principal.UserID); err != nil {
+		h.Log.Error("Failed to disable second factor", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// @Summary      Reset a user's two-factor authentication
+// @Description  Removes the second factor of a user who lost their device. Users whose role requires one must enrol again at their next login.
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        id path string true "User ID"
+// @Success      200 {object} string "Two-factor authentication reset"
+// @Failure      500 {object} string "Server error"
+// @Router       /api/admin/users/{id}/2fa [delete]
+func (h *Handler) ResetUserTwoFactor(c *gin.Context) {
+	id := c.Param("id")
+	if err := h.TwoFactor.Disable(c, id); err != nil {
+		h.Log.Error("Failed to reset second factor", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	h.Log.Info("Second factor reset", "user_id", id)
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication reset"})
+}
@@ -5,18 +5,23 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
 
+	"api/api/lockout"
+	"api/api/middleware"
 	"api/api/token"
-	"api/config"
 	pb "api/genproto/user"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // Register godoc
@@ -56,9 +61,10 @@ func (h *Handler) Register(c *gin.Context) {
 // @Accept       json
 // @Produce      json
 // @Param        credentials  body user.LoginRequest  true  "User Login Data"
-// @Success      200   {object}  user.LoginResponse "Tokens"
+// @Success      200   {object}  user.LoginResponse "Tokens, or a LoginChallengeResponse when a second factor is needed"
 // @Failure      400   {object}  string "Invalid request body"
 // @Failure      401   {object}  string "Unauthorized"
+// @Failure      429   {object}  string "Too many failed login attempts"
 // @Failure      500   {object}  string "Server error"
 // @Router       /all/user/login [post]
 func (h *Handler) Login(c *gin.Context) {
@@ -71,23 +77,57 @@ func (h *Handler) Login(c *gin.Context) {
 		return
 	}
 
+	keys := []string{lockout.UserKey(req.HhId), lockout.IPKey(c.ClientIP())}
+	wait, err := h.Lockout.Check(c, keys...)
+	if err != nil {
+		h.Log.Error("Failed to check login attempts", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if wait > 0 {
+		h.Log.Warn("Login throttled", "hh_id", req.HhId, "ip", c.ClientIP())
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed login attempts, try again later"})
+		return
+	}
+
 	res, err := h.User.Login(c, &req)
 	if err != nil {
 		h.Log.Error("Login failed", "error", err.Error())
+		if code := status.Code(err); code != codes.Unavailable && code != codes.DeadlineExceeded {
+			if err := h.Lockout.Failed(c, keys...); err != nil {
+				h.Log.Error("Failed to record login attempt", "error", err.Error())
+			}
+		}
 		c.JSON(400, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
-	err = token.GeneratedAccessJWTToken(res)
-
+	enabled, err := h.TwoFactor.Enabled(c, res.Id)
 	if err != nil {
-		h.Log.Error(err.Error())
-		c.JSON(500, gin.H{"error": err.Error()})
+		h.Log.Error("Failed to check second factor", "error", err.Error())
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+	if enabled || h.TwoFactor.Required(res.Role) {
+		// Failures are only forgotten once the second factor is verified too.
+		h.loginChallenge(c, res, req.HhId, !enabled)
+		return
 	}
-	err = token.GeneratedRefreshJWTToken(res)
+	if err := h.Lockout.Succeeded(c, lockout.UserKey(req.HhId)); err != nil {
+		h.Log.Error("Failed to reset login attempts", "error", err.Error())
+	}
+
+	refresh, err := token.IssueTokens(c, h.RefreshStore, res)
 	if err != nil {
 		h.Log.Error(err.Error())
 		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.startSession(c, refresh); err != nil {
+		h.Log.Error("Failed to record session", "error", err.Error())
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
 	}
 
 	h.Log.Info("Login ended successfully")
@@ -106,17 +146,14 @@ func (h *Handler) Login(c *gin.Context) {
 // @Router       /api/user/getprofile [get]
 func (h *Handler) GetProfile(c *gin.Context) {
 	h.Log.Info("GetProfile starting")
-	tokenn := c.GetHeader("Authorization")
-
-	id, _, err := token.GetUserInfoFromAccessToken(tokenn)
-	if err != nil {
-		h.Log.Error("Invalid token", "error", err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token"})
+	principal, ok := middleware.GetPrincipal(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
 	}
 
 	req := pb.GetProfileRequest{
-		Id: id,
+		Id: principal.UserID,
 	}
 
 	res, err := h.User.GetProfile(c, &req)
@@ -183,11 +220,9 @@ func (h *Handler) GetAllUsers(c *gin.Context) {
 // @Router /api/user/updateprofile [put]
 func (h *Handler) UpdateProfile(c *gin.Context) {
 	h.Log.Info("UpdateUser started")
-	tokenn := c.GetHeader("Authorization")
-	id, _, err := token.GetUserInfoFromAccessToken(tokenn)
-	if err != nil {
-		h.Log.Error(err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	principal, ok := middleware.GetPrincipal(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
 	}
 	var req pb.UpdateProfileRequest
@@ -196,8 +231,8 @@ func (h *Handler) UpdateProfile(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
 		return
 	}
-	req.Id = id
-	_, err = h.User.UpdateProfile(c, &req)
+	req.Id = principal.UserID
+	_, err := h.User.UpdateProfile(c, &req)
 	if err != nil {
 		h.Log.Error("Failed to update user", "error", err.Error())
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -218,12 +253,9 @@ func (h *Handler) UpdateProfile(c *gin.Context) {
 // @Router       /api/user/update [put]
 func (h *Handler) UpdateProfileAdmin(c *gin.Context) {
 	h.Log.Info("UpdateProfileAdmin started")
-	tokenn := c.GetHeader("Authorization")
-
-	id, _, err := token.GetUserInfoFromAccessToken(tokenn)
-	if err != nil {
-		h.Log.Error("Invalid token", "error", err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token"})
+	principal, ok := middleware.GetPrincipal(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
 	}
 
@@ -234,9 +266,9 @@ func (h *Handler) UpdateProfileAdmin(c *gin.Context) {
 		return
 	}
 
-	req.Id = id
+	req.Id = principal.UserID
 
-	_, err = h.User.UpdateProfileAdmin(c, &req)
+	_, err := h.User.UpdateProfileAdmin(c, &req)
 	if err != nil {
 		h.Log.Error("Failed to update user", "error", err.Error())
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
@@ -282,11 +314,12 @@ func (h *Handler) DeleteProfile(c *gin.Context) {
 
 // Refresh godoc
 // @Summary Refresh token
-// @Description it generates new access token
+// @Description it exchanges a refresh token for a new access and refresh token. A refresh token can be used only once; presenting it again revokes every token issued from the same login.
 // @Tags all
 // @Param token body user.Tokens true "enough"
 // @Success 200 {object} string "tokens"
 // @Failure 400 {object} string "Invalid date"
+// @Failure 401 {object} string "unauthorized"
 // @Failure 500 {object} string "error while reading from server"
 // @Router /all/user/refresh [post]
 func (h *Handler) Refresh(c *gin.Context) {
@@ -295,6 +328,7 @@ func (h *Handler) Refresh(c *gin.Context) {
 	if err := c.BindJSON(&tok); err != nil {
 		h.Log.Error(err.Error())
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
 	req := pb.LoginResponse{Refresh: tok.Refreshtoken}
@@ -303,17 +337,27 @@ func (h *Handler) Refresh(c *gin.Context) {
 	if err != nil {
 		h.Log.Error(err.Error())
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-	}
-	err = token.GetUserIdFromRefreshToken(&req)
-	if err != nil {
-		h.Log.Error(err.Error())
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
 	}
 
-	err = token.GeneratedAccessJWTToken(&req)
+	refresh, err := token.RotateRefreshToken(c, h.RefreshStore, h.Denylist, &req)
 	if err != nil {
-		h.Log.Error(err.Error())
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		switch {
+		case errors.Is(err, token.ErrRefreshReused):
+			h.Log.Warn("Refresh token reuse detected, token family revoked")
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		case errors.Is(err, token.ErrRefreshUnknown), errors.Is(err, token.ErrRefreshRevoked):
+			h.Log.Error(err.Error())
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		default:
+			h.Log.Error(err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "error while reading from server"})
+		}
+		return
+	}
+	err = h.Sessions.Touch(c, refresh.FamilyID, c.ClientIP(), c.Request.UserAgent(), refresh.ExpiresAt)
+	if err != nil && !errors.Is(err, token.ErrSessionNotFound) {
+		h.Log.Error("Failed to update session", "error", err.Error())
 	}
 	h.Log.Info("Refresh is succesfully ended")
 	c.JSON(http.StatusOK, gin.H{
@@ -322,6 +366,70 @@ func (h *Handler) Refresh(c *gin.Context) {
 	})
 }
 
+// @Summary      Logout
+// @Description  Ends the current session. The access token and every refresh token of its session stop working.
+// @Tags         user
+// @Security     ApiKeyAuth
+// @Success      200 {object} string "Logged out"
+// @Failure      401 {object} string "unauthorized"
+// @Failure      500 {object} string "Server error"
+// @Router       /api/user/logout [post]
+func (h *Handler) Logout(c *gin.Context) {
+	h.Log.Info("Logout starting")
+	principal, ok := middleware.GetPrincipal(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	if err := h.revokeAccessToken(c, principal); err != nil {
+		h.Log.Error("Failed to revoke access token", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if principal.SessionID != "" {
+		if err := h.revokeSession(c, principal.SessionID); err != nil {
+			h.Log.Error("Failed to revoke session", "error", err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
+		}
+	}
+
+	h.Log.Info("Logout ended successfully")
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// @Summary      Logout from all devices
+// @Description  Revokes every access and refresh token issued to the caller so far.
+// @Tags         user
+// @Security     ApiKeyAuth
+// @Success      200 {object} string "Logged out from all sessions"
+// @Failure      401 {object} string "unauthorized"
+// @Failure      500 {object} string "Server error"
+// @Router       /api/user/logout-all [post]
+func (h *Handler) LogoutAll(c *gin.Context) {
+	h.Log.Info("LogoutAll starting")
+	principal, ok := middleware.GetPrincipal(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	if err := h.revokeUserSessions(c, principal.UserID); err != nil {
+		h.Log.Error("Failed to revoke user tokens", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if err := h.revokeAccessToken(c, principal); err != nil {
+		h.Log.Error("Failed to revoke access token", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	h.Log.Info("LogoutAll ended successfully")
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out from all sessions"})
+}
+
 // @Summary UploadPhotoToUser
 // @Security ApiKeyAuth
 // @Description Upload User Photo
@@ -348,10 +456,7 @@ func (h *Handler) UploadPhotoToUser(c *gin.Context) {
 	println("\n File Ext:", fileExt)
 
 	newFile := uuid.NewString() + fileExt
-	minioClient, err := minio.New(config.Load().MINIO_URL, &minio.Options{
-		Creds:  credentials.NewStaticV4("test", "minioadmin", ""),
-		Secure: false,
-	})
+	minioClient, err := h.minioClient()
 	if err != nil {
 		c.AbortWithError(500, err)
 		return
@@ -386,18 +491,17 @@ func (h *Handler) UploadPhotoToUser(c *gin.Context) {
 		return
 	}
 
-	madeUrl := fmt.Sprintf("http://%s/photos/%s", config.Load().MINIO_URL, newFile)
+	madeUrl := fmt.Sprintf("http://%s/photos/%s", h.Config.Current().MINIO_URL, newFile)
 
 	println("\n Info Bucket:", info.Bucket)
 
 	// minio end
-	accestoken := c.GetHeader("Authorization")
-	UserId, _, err := token.GetUserInfoFromAccessToken(accestoken)
-	if err != nil {
-		h.Log.Error(err.Error())
+	principal, ok := middleware.GetPrincipal(c)
+	if !ok {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
 	}
+	UserId := principal.UserID
 	res, err := h.User.GetProfile(c, &pb.GetProfileRequest{Id: UserId})
 	if err != nil {
 		h.Log.Error(err.Error())
@@ -405,7 +509,7 @@ func (h *Handler) UploadPhotoToUser(c *gin.Context) {
 		return
 	}
 	if res.Photo != "" {
-		err = DeleteMinioPhoto(UserId, res.Photo)
+		err = h.DeleteMinioPhoto(UserId, res.Photo)
 		if err != nil {
 			h.Log.Error(err.Error())
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting photo"})
@@ -438,13 +542,12 @@ func (h *Handler) UploadPhotoToUser(c *gin.Context) {
 // @Failure 500 {object} string
 // @Router /api/user/photo [delete]
 func (h *Handler) DeleteUserPhoto(c *gin.Context) {
-	accestoken := c.GetHeader("Authorization")
-	UserId, _, err := token.GetUserInfoFromAccessToken(accestoken)
-	if err != nil {
-		h.Log.Error(err.Error())
+	principal, ok := middleware.GetPrincipal(c)
+	if !ok {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
 	}
+	UserId := principal.UserID
 
 	res, err := h.User.GetProfile(c, &pb.GetProfileRequest{Id: UserId})
 	if err != nil {
@@ -456,7 +559,7 @@ func (h *Handler) DeleteUserPhoto(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "User has no photo"})
 		return
 	}
-	err = DeleteMinioPhoto(UserId, res.Photo)
+	err = h.DeleteMinioPhoto(UserId, res.Photo)
 	if err != nil {
 		h.Log.Error(err.Error())
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting photo"})
@@ -468,16 +571,21 @@ func (h *Handler) DeleteUserPhoto(c *gin.Context) {
 	c.JSON(200, gin.H{"message": "Photo deleted successfully"})
 }
 
-func DeleteMinioPhoto(user_id, photo_url string) error {
+func (h *Handler) minioClient() (*minio.Client, error) {
+	conf := h.Config.Current()
+	return minio.New(conf.MINIO_URL, &minio.Options{
+		Creds:  credentials.NewStaticV4(conf.MINIO_ACCESS_KEY, conf.MINIO_SECRET_KEY, ""),
+		Secure: false, // Set to true if using HTTPS
+	})
+}
+
+func (h *Handler) DeleteMinioPhoto(user_id, photo_url string) error {
 
-	prefix := fmt.Sprintf("http://%s/photos/", config.Load().MINIO_URL)
+	prefix := fmt.Sprintf("http://%s/photos/", h.Config.Current().MINIO_URL)
 	bucketName := "photos"
 	objectName := strings.TrimPrefix(photo_url, prefix)
 
-	minioClient, err := minio.New(config.Load().MINIO_URL, &minio.Options{
-		Creds:  credentials.NewStaticV4("test", "minioadmin", ""),
-		Secure: false, // Set to true if using HTTPS
-	})
+	minioClient, err := h.minioClient()
 	if err != nil {
 		return err
 	}
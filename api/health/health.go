@@ -0,0 +1,213 @@
+package health
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Dependency statuses.
+const (
+	Up   = "up"
+	Down = "down"
+)
+
+// Check probes one dependency and returns nil when it can be used.
+type Check func(ctx context.Context) error
+
+// Result is the outcome of one check.
+type Result struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Required bool   `json:"required"`
+	// LatencyMS and Error are left out of public reports.
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Report is the outcome of every check. Its Status is Up when every required
+// dependency is up.
+type Report struct {
+	Status    string    `json:"status"`
+	CheckedAt time.Time `json:"checked_at"`
+	Checks    []Result  `json:"checks"`
+}
+
+// Ready reports whether every required dependency is up.
+func (r Report) Ready() bool { return r.Status == Up }
+
+// Public is the report without latencies and errors, which name internal
+// addresses.
+func (r Report) Public() Report {
+	checks := make([]Result, len(r.Checks))
+	for i, res := range r.Checks {
+		checks[i] = Result{Name: res.Name, Status: res.Status, Required: res.Required}
+	}
+	r.Checks = checks
+	return r
+}
+
+// Checker runs the checks of the dependencies of the gateway.
+type Checker struct {
+	names  []string
+	checks map[string]Check
+
+	// mu serializes cached runs and guards cached and cachedFor, the
+	// required dependencies cached was run with.
+	mu        sync.Mutex
+	cached    *Report
+	cachedFor string
+}
+
+func NewChecker() *Checker {
+	return &Checker{checks: make(map[string]Check)}
+}
+
+// Add registers the check of a dependency. Checks are reported in the order
+// they were added.
+func (c *Checker) Add(name string, check Check) {
+	if _, ok := c.checks[name]; !ok {
+		c.names = append(c.names, name)
+	}
+	c.checks[name] = check
+}
+
+// Run runs every check at once, each with timeout, and waits for all of
+// them. A dependency in required that has no check counts as down.
+func (c *Checker) Run(ctx context.Context, required []string, timeout time.Duration) Report {
+	results := make([]Result, len(c.names))
+	var wg sync.WaitGroup
+	for i, name := range c.names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			results[i] = c.run(ctx, name, timeout)
+		}(i, name)
+	}
+	wg.Wait()
+	for _, name := range required {
+		if _, ok := c.checks[name]; !ok {
+			results = append(results, Result{Name: name, Status: Down, Error: "no check is registered"})
+		}
+	}
+
+	report := Report{Status: Up, CheckedAt: time.Now(), Checks: results}
+	for i := range results {
+		results[i].Required = slices.Contains(required, results[i].Name)
+		if results[i].Required && results[i].Status != Up {
+			report.Status = Down
+		}
+	}
+	return report
+}
+
+// Cached returns the report of a run at most ttl old, and otherwise runs the
+// checks like Run. Concurrent callers wait for one run, so that callers of
+// public endpoints cannot multiply the load on the dependencies.
+func (c *Checker) Cached(ctx context.Context, required []string, timeout, ttl time.Duration) Report {
+	key := strings.Join(required, ",")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cached != nil && c.cachedFor == key && time.Since(c.cached.CheckedAt) < ttl {
+		return *c.cached
+	}
+	// The report is shared, so the run must not end with the request that
+	// started it.
+	report := c.Run(context.WithoutCancel(ctx), required, timeout)
+	c.cached, c.cachedFor = &report, key
+	return report
+}
+
+func (c *Checker) run(ctx context.Context, name string, timeout time.Duration) Result {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	err := c.checks[name](ctx)
+	res := Result{
+		Name:      name,
+		Status:    Up,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		res.Status = Down
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// GRPC checks a service with the standard gRPC health protocol.
+func GRPC(conn grpc.ClientConnInterface) Check {
+	client := healthpb.NewHealthClient(conn)
+	return func(ctx context.Context) error {
+		resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+		if err != nil {
+			return err
+		}
+		if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+			return fmt.Errorf("service is %s", resp.GetStatus())
+		}
+		return nil
+	}
+}
+
+// SQL checks that db accepts connections.
+func SQL(db *sql.DB) Check {
+	return func(ctx context.Context) error {
+		return db.PingContext(ctx)
+	}
+}
+
+// HTTP checks that a GET of the URL returned by url succeeds with a 2xx
+// status.
+func HTTP(url func() string) Check {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("%s returned %s", req.URL.Redacted(), resp.Status)
+		}
+		return nil
+	}
+}
+
+// Reachable checks that the host of the URL returned by rawURL accepts TCP
+// connections. It is for services that have no health endpoint.
+func Reachable(rawURL func() string) Check {
+	return func(ctx context.Context) error {
+		u, err := url.Parse(rawURL())
+		if err != nil {
+			return err
+		}
+		addr := u.Host
+		if u.Port() == "" {
+			port := "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+			addr = net.JoinHostPort(u.Hostname(), port)
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
@@ -0,0 +1,60 @@
+package health_test
+
+import (
+	"api/api/health"
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCachedSharesRuns(t *testing.T) {
+	var runs atomic.Int32
+	checker := health.NewChecker()
+	checker.Add("user", func(ctx context.Context) error {
+		runs.Add(1)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+			return nil
+		}
+	})
+	cached := func(ctx context.Context, required ...string) health.Report {
+		return checker.Cached(ctx, required, time.Second, 100*time.Millisecond)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if report := cached(context.Background(), "user"); !report.Ready() {
+				t.Errorf("report = %+v, want ready", report)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := runs.Load(); n != 1 {
+		t.Fatalf("checks ran %d times for concurrent callers, want once", n)
+	}
+
+	// Other required dependencies need a new run, which a cancelled request
+	// does not cut short, since its report is shared.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report := cached(ctx, "user", "question")
+	if runs.Load() != 2 || report.Ready() || report.Checks[0].Status != health.Up {
+		t.Fatalf("runs = %d, report = %+v, want a new run with only question down", runs.Load(), report)
+	}
+	if cached(context.Background(), "user", "question"); runs.Load() != 2 {
+		t.Fatalf("runs = %d, want the cached report", runs.Load())
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	cached(context.Background(), "user", "question")
+	if n := runs.Load(); n != 3 {
+		t.Fatalf("checks ran %d times after the TTL, want 3", n)
+	}
+}
@@ -0,0 +1,136 @@
+package impersonation
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrGrantNotFound = errors.New("impersonation grant not found")
+
+// Grant allows ActorID, a support user, to act as SubjectID until ExpiresAt.
+type Grant struct {
+	ID          string    `json:"id"`
+	ActorID     string    `json:"actor_id"`
+	SubjectID   string    `json:"subject_id"`
+	SubjectRole string    `json:"subject_role"`
+	Reason      string    `json:"reason"`
+	CreatedBy   string    `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	RevokedAt   time.Time `json:"revoked_at"`
+}
+
+func (g *Grant) Active(now time.Time) bool {
+	return g.RevokedAt.IsZero() && now.Before(g.ExpiresAt)
+}
+
+// Record is one request made while impersonating.
+type Record struct {
+	GrantID   string    `json:"grant_id"`
+	ActorID   string    `json:"actor_id"`
+	SubjectID string    `json:"subject_id"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	IP        string    `json:"ip"`
+	At        time.Time `json:"at"`
+}
+
+type Store interface {
+	CreateGrant(ctx context.Context, grant *Grant) error
+	GetGrant(ctx context.Context, id string) (*Grant, error)
+	ListGrants(ctx context.Context) ([]*Grant, error)
+	RevokeGrant(ctx context.Context, id string, at time.Time) error
+	Record(ctx context.Context, record *Record) error
+	// Records returns the newest records first, optionally for one grant.
+	Records(ctx context.Context, grantID string, limit int) ([]*Record, error)
+}
+
+// MemoryStore keeps grants and the most recent audit records in memory.
+type MemoryStore struct {
+	mu         sync.Mutex
+	grants     map[string]*Grant
+	records    []*Record
+	maxRecords int
+}
+
+func NewMemoryStore(maxRecords int) *MemoryStore {
+	return &MemoryStore{grants: make(map[string]*Grant), maxRecords: maxRecords}
+}
+
+func (s *MemoryStore) CreateGrant(ctx context.Context, grant *Grant) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	saved := *grant
+	s.grants[grant.ID] = &saved
+	return nil
+}
+
+func (s *MemoryStore) GetGrant(ctx context.Context, id string) (*Grant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	grant, ok := s.grants[id]
+	if !ok {
+		return nil, ErrGrantNotFound
+	}
+	res := *grant
+	return &res, nil
+}
+
+func (s *MemoryStore) ListGrants(ctx context.Context) ([]*Grant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	grants := make([]*Grant, 0, len(s.grants))
+	for _, grant := range s.grants {
+		res := *grant
+		grants = append(grants, &res)
+	}
+	sort.Slice(grants, func(i, j int) bool { return grants[i].CreatedAt.After(grants[j].CreatedAt) })
+	return grants, nil
+}
+
+func (s *MemoryStore) RevokeGrant(ctx context.Context, id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	grant, ok := s.grants[id]
+	if !ok {
+		return ErrGrantNotFound
+	}
+	if grant.RevokedAt.IsZero() {
+		grant.RevokedAt = at
+	}
+	return nil
+}
+
+func (s *MemoryStore) Record(ctx context.Context, record *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	saved := *record
+	s.records = append(s.records, &saved)
+	if s.maxRecords > 0 && len(s.records) > s.maxRecords {
+		s.records = s.records[len(s.records)-s.maxRecords:]
+	}
+	return nil
+}
+
+func (s *MemoryStore) Records(ctx context.Context, grantID string, limit int) ([]*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := []*Record{}
+	for i := len(s.records) - 1; i >= 0 && (limit <= 0 || len(records) < limit); i-- {
+		if grantID == "" || s.records[i].GrantID == grantID {
+			res := *s.records[i]
+			records = append(records, &res)
+		}
+	}
+	return records, nil
+}
@@ -0,0 +1,131 @@
+package impersonation
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) (*PostgresStore, error) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS impersonation_grants (
+			id           TEXT PRIMARY KEY,
+			actor_id     TEXT NOT NULL,
+			subject_id   TEXT NOT NULL,
+			subject_role TEXT NOT NULL,
+			reason       TEXT NOT NULL,
+			created_by   TEXT NOT NULL,
+			created_at   TIMESTAMPTZ NOT NULL,
+			expires_at   TIMESTAMPTZ NOT NULL,
+			revoked_at   TIMESTAMPTZ
+		);
+		CREATE TABLE IF NOT EXISTS impersonation_audit (
+			id         BIGSERIAL PRIMARY KEY,
+			grant_id   TEXT NOT NULL,
+			actor_id   TEXT NOT NULL,
+			subject_id TEXT NOT NULL,
+			method     TEXT NOT NULL,
+			path       TEXT NOT NULL,
+			status     INT NOT NULL,
+			ip         TEXT NOT NULL,
+			at         TIMESTAMPTZ NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS impersonation_audit_grant_idx ON impersonation_audit (grant_id);`)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresStore{db: db}, nil
+}
+
+func (s *PostgresStore) CreateGrant(ctx context.Context, grant *Grant) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO impersonation_grants (id, actor_id, subject_id, subject_role, reason, created_by, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		grant.ID, grant.ActorID, grant.SubjectID, grant.SubjectRole, grant.Reason, grant.CreatedBy, grant.CreatedAt, grant.ExpiresAt)
+	return err
+}
+
+func (s *PostgresStore) GetGrant(ctx context.Context, id string) (*Grant, error) {
+	grants, err := s.queryGrants(ctx, `WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(grants) == 0 {
+		return nil, ErrGrantNotFound
+	}
+	return grants[0], nil
+}
+
+func (s *PostgresStore) ListGrants(ctx context.Context) ([]*Grant, error) {
+	return s.queryGrants(ctx, `ORDER BY created_at DESC`)
+}
+
+func (s *PostgresStore) RevokeGrant(ctx context.Context, id string, at time.Time) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE impersonation_grants SET revoked_at = COALESCE(revoked_at, $2) WHERE id = $1`, id, at)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrGrantNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) Record(ctx context.Context, record *Record) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO impersonation_audit (grant_id, actor_id, subject_id, method, path, status, ip, at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		record.GrantID, record.ActorID, record.SubjectID, record.Method, record.Path, record.Status, record.IP, record.At)
+	return err
+}
+
+func (s *PostgresStore) Records(ctx context.Context, grantID string, limit int) ([]*Record, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT grant_id, actor_id, subject_id, method, path, status, ip, at
+		FROM impersonation_audit WHERE $1 = '' OR grant_id = $1
+		ORDER BY id DESC LIMIT $2`, grantID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []*Record{}
+	for rows.Next() {
+		var r Record
+		if err := rows.Scan(&r.GrantID, &r.ActorID, &r.SubjectID, &r.Method, &r.Path, &r.Status, &r.IP, &r.At); err != nil {
+			return nil, err
+		}
+		records = append(records, &r)
+	}
+	return records, rows.Err()
+}
+
+func (s *PostgresStore) queryGrants(ctx context.Context, where string, args ...interface{}) ([]*Grant, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, actor_id, subject_id, subject_role, reason, created_by, created_at, expires_at, revoked_at
+		FROM impersonation_grants `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grants := []*Grant{}
+	for rows.Next() {
+		var g Grant
+		var revokedAt sql.NullTime
+		err := rows.Scan(&g.ID, &g.ActorID, &g.SubjectID, &g.SubjectRole, &g.Reason, &g.CreatedBy, &g.CreatedAt, &g.ExpiresAt, &revokedAt)
+		if err != nil {
+			return nil, err
+		}
+		g.RevokedAt = revokedAt.Time
+		grants = append(grants, &g)
+	}
+	return grants, rows.Err()
+}
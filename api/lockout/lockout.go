@@ -0,0 +1,237 @@
+package lockout
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is the failed-attempt state of one key, such as a user or an IP.
+type Entry struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	// BlockedUntil is when the next attempt is allowed again.
+	BlockedUntil time.Time `json:"blocked_until"`
+	Locked       bool      `json:"locked"`
+}
+
+// Store keeps failed-attempt counters. Stores shared by several gateways
+// must implement Incr and Block atomically.
+type Store interface {
+	Get(ctx context.Context, key string) (*Entry, error)
+	// Incr records a failure of key at now and returns the entry with the new
+	// count. Failures older than window are forgotten first, and the key is
+	// unlocked with them. Concurrent calls each see a different count.
+	Incr(ctx context.Context, key string, now time.Time, window time.Duration) (*Entry, error)
+	// Block delays the next attempt for key until until, unless it already is
+	// delayed longer, and locks the key when locked is set.
+	Block(ctx context.Context, key string, until time.Time, locked bool) error
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context) ([]*Entry, error)
+}
+
+// Policy controls how failures of one kind of key are punished.
+type Policy struct {
+	// Threshold is the number of failures after which the key is locked.
+	Threshold int
+	// BaseDelay is the wait after the first failure; it doubles with every
+	// further failure up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Lockout is how long a key stays locked once Threshold is reached.
+	Lockout time.Duration
+	// Window forgets failures older than this.
+	Window time.Duration
+}
+
+func (p Policy) delay(failures int) time.Duration {
+	if failures >= p.Threshold {
+		return p.Lockout
+	}
+	d := float64(p.BaseDelay) * math.Pow(2, float64(failures-1))
+	if d > float64(p.MaxDelay) {
+		return p.MaxDelay
+	}
+	return time.Duration(d)
+}
+
+const (
+	userPrefix = "user:"
+	ipPrefix   = "ip:"
+)
+
+func UserKey(hhID string) string { return userPrefix + hhID }
+func IPKey(ip string) string     { return ipPrefix + ip }
+
+// Guard throttles login attempts per user and per client IP.
+type Guard struct {
+	store Store
+	user  Policy
+	ip    Policy
+}
+
+func NewGuard(store Store, user, ip Policy) *Guard {
+	return &Guard{store: store, user: user, ip: ip}
+}
+
+func (g *Guard) policy(key string) Policy {
+	if strings.HasPrefix(key, ipPrefix) {
+		return g.ip
+	}
+	return g.user
+}
+
+// Check returns how long the caller has to wait before another attempt for
+// any of keys is allowed. Zero means the attempt may proceed.
+func (g *Guard) Check(ctx context.Context, keys ...string) (time.Duration, error) {
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range keys {
+		entry, err := g.store.Get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if entry == nil {
+			continue
+		}
+		if d := entry.BlockedUntil.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// Failed records a failed attempt for every key.
+func (g *Guard) Failed(ctx context.Context, keys ...string) error {
+	now := time.Now()
+	for _, key := range keys {
+		policy := g.policy(key)
+		entry, err := g.store.Incr(ctx, key, now, policy.Window)
+		if err != nil {
+			return err
+		}
+		// The delay follows from the count Incr returned, so concurrent
+		// failures cannot both act on the same count.
+		until := now.Add(policy.delay(entry.Failures))
+		if err := g.store.Block(ctx, key, until, entry.Failures >= policy.Threshold); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Succeeded clears the counters of key after a successful login.
+func (g *Guard) Succeeded(ctx context.Context, key string) error {
+	return g.store.Delete(ctx, key)
+}
+
+// List returns every key with recorded failures, locked keys first.
+func (g *Guard) List(ctx context.Context) ([]*Entry, error) {
+	entries, err := g.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		entry.Locked = entry.Locked && now.Before(entry.BlockedUntil)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Locked != entries[j].Locked {
+			return entries[i].Locked
+		}
+		return entries[i].LastFailure.After(entries[j].LastFailure)
+	})
+	return entries, nil
+}
+
+// Clear removes the counters of key.
+func (g *Guard) Clear(ctx context.Context, key string) error {
+	return g.store.Delete(ctx, key)
+}
+
+// MemoryStore is a Store local to one gateway process.
+type MemoryStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*Entry
+}
+
+// NewMemoryStore keeps entries for ttl after their last failure.
+func NewMemoryStore(ttl time.Duration) *MemoryStore {
+	return &MemoryStore{ttl: ttl, entries: make(map[string]*Entry)}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	res := *entry
+	return &res, nil
+}
+
+func (s *MemoryStore) Incr(ctx context.Context, key string, now time.Time, window time.Duration) (*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, e := range s.entries {
+		if now.After(e.BlockedUntil) && now.Sub(e.LastFailure) > s.ttl {
+			delete(s.entries, k)
+		}
+	}
+	entry, ok := s.entries[key]
+	if !ok {
+		entry = &Entry{Key: key}
+		s.entries[key] = entry
+	}
+	if now.Sub(entry.LastFailure) > window {
+		entry.Failures = 0
+		entry.Locked = false
+	}
+	entry.Failures++
+	entry.LastFailure = now
+	res := *entry
+	return &res, nil
+}
+
+func (s *MemoryStore) Block(ctx context.Context, key string, until time.Time, locked bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	if until.After(entry.BlockedUntil) {
+		entry.BlockedUntil = until
+	}
+	entry.Locked = entry.Locked || locked
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *MemoryStore) List(ctx context.Context) ([]*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]*Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		res := *e
+		entries = append(entries, &res)
+	}
+	return entries, nil
+}
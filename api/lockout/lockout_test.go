@@ -0,0 +1,49 @@
+package lockout_test
+
+import (
+	"api/api/lockout"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentFailuresAreAllCounted(t *testing.T) {
+	ctx := context.Background()
+	policy := lockout.Policy{
+		Threshold: 5,
+		BaseDelay: time.Millisecond,
+		MaxDelay:  time.Second,
+		Lockout:   time.Hour,
+		Window:    time.Hour,
+	}
+	guard := lockout.NewGuard(lockout.NewMemoryStore(time.Hour), policy, policy)
+	key := lockout.UserKey("hh-1")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := guard.Failed(ctx, key); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	entries, err := guard.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Failures != 20 || !entries[0].Locked {
+		t.Fatalf("entries = %+v, want one locked entry with 20 failures", entries)
+	}
+	wait, err := guard.Check(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait < 59*time.Minute {
+		t.Fatalf("wait = %v, want the lockout of an hour", wait)
+	}
+}
@@ -0,0 +1,100 @@
+package lockout
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// PostgresStore shares failed-attempt counters between gateway replicas, so
+// that spreading attempts over replicas does not multiply the allowance.
+type PostgresStore struct {
+	db  *sql.DB
+	ttl time.Duration
+}
+
+// NewPostgresStore keeps entries for ttl after their last failure.
+func NewPostgresStore(db *sql.DB, ttl time.Duration) (*PostgresStore, error) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS login_failures (
+			key           TEXT PRIMARY KEY,
+			failures      INT NOT NULL,
+			last_failure  TIMESTAMPTZ NOT NULL,
+			blocked_until TIMESTAMPTZ NOT NULL,
+			locked        BOOLEAN NOT NULL
+		);`)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresStore{db: db, ttl: ttl}, nil
+}
+
+const entryColumns = `key, failures, last_failure, blocked_until, locked`
+
+func scanEntry(row interface{ Scan(...any) error }) (*Entry, error) {
+	var e Entry
+	if err := row.Scan(&e.Key, &e.Failures, &e.LastFailure, &e.BlockedUntil, &e.Locked); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (s *PostgresStore) Get(ctx context.Context, key string) (*Entry, error) {
+	entry, err := scanEntry(s.db.QueryRowContext(ctx, `SELECT `+entryColumns+` FROM login_failures WHERE key = $1`, key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return entry, err
+}
+
+// Incr counts the failure in a single upsert, so that concurrent failures on
+// any replica each get their own count.
+func (s *PostgresStore) Incr(ctx context.Context, key string, now time.Time, window time.Duration) (*Entry, error) {
+	if _, err := s.db.ExecContext(ctx, `
+		DELETE FROM login_failures WHERE blocked_until < $1 AND last_failure < $2`,
+		now, now.Add(-s.ttl)); err != nil {
+		return nil, err
+	}
+	return scanEntry(s.db.QueryRowContext(ctx, `
+		INSERT INTO login_failures (key, failures, last_failure, blocked_until, locked)
+		VALUES ($1, 1, $2, $2, FALSE)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_failures.last_failure < $3 THEN 1 ELSE login_failures.failures + 1 END,
+			locked = login_failures.locked AND login_failures.last_failure >= $3,
+			last_failure = $2
+		RETURNING `+entryColumns,
+		key, now, now.Add(-window)))
+}
+
+func (s *PostgresStore) Block(ctx context.Context, key string, until time.Time, locked bool) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE login_failures
+		SET blocked_until = GREATEST(blocked_until, $2), locked = locked OR $3
+		WHERE key = $1`,
+		key, until, locked)
+	return err
+}
+
+func (s *PostgresStore) Delete(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM login_failures WHERE key = $1`, key)
+	return err
+}
+
+func (s *PostgresStore) List(ctx context.Context) ([]*Entry, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+entryColumns+` FROM login_failures`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*Entry
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
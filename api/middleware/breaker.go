@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"api/api/upstream"
+	"api/model"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FailFast rejects requests with 503 while breaker is open, instead of
+// letting them wait on an upstream that is down. A nil breaker lets every
+// request through.
+func FailFast(breaker *upstream.Breaker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if breaker == nil {
+			c.Next()
+			return
+		}
+		ready, retryAt := breaker.Ready()
+		if !ready {
+			wait := math.Max(1, math.Ceil(time.Until(retryAt).Seconds()))
+			c.Header("Retry-After", strconv.Itoa(int(wait)))
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, model.Error{
+				Code:    model.CodeUpstreamUnavailable,
+				Message: fmt.Sprintf("The %s service is unavailable, try again later", breaker.Name()),
+			})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"api/model"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const realm = "api"
+
+// Unauthorized rejects a request whose credentials are missing or invalid,
+// with a WWW-Authenticate challenge for the scheme that was tried.
+func Unauthorized(c *gin.Context, code, message string) {
+	var challenge string
+	switch {
+	case code == model.CodeMissingCredentials:
+		challenge = fmt.Sprintf(`Bearer realm=%q`, realm)
+	case strings.Contains(code, "api_key"):
+		challenge = fmt.Sprintf(`APIKey realm=%q, header="X-API-Key"`, realm)
+	default:
+		challenge = fmt.Sprintf(`Bearer realm=%q, error="invalid_token", error_description=%q`, realm, message)
+	}
+	c.Header("WWW-Authenticate", challenge)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, model.Error{Code: code, Message: message})
+}
+
+// Forbidden rejects an authenticated caller that may not make the request.
+func Forbidden(c *gin.Context, code, message string) {
+	c.AbortWithStatusJSON(http.StatusForbidden, model.Error{Code: code, Message: message})
+}
+
+// InternalError rejects a request that could not be authorized because of
+// err. The error is attached to the context for logging and never sent.
+func InternalError(c *gin.Context, err error) {
+	_ = c.Error(err)
+	c.AbortWithStatusJSON(http.StatusInternalServerError, model.Error{Code: model.CodeInternal, Message: "Internal server error"})
+}
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"api/api/impersonation"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const ImpersonatedByHeader = "X-Impersonated-By"
+
+// destructiveRoutes are refused while impersonating on top of every DELETE.
+var destructiveRoutes = map[string]bool{
+	"PUT /api/user/updateprofile":   true,
+	"PUT /api/user/update":          true,
+	"POST /api/user/logout-all":     true,
+	"POST /api/support/impersonate": true,
+	"POST /api/user/2fa/enroll":     true,
+	"POST /api/user/2fa/confirm":    true,
+}
+
+func isDestructive(c *gin.Context) bool {
+	return c.Request.Method == http.MethodDelete || destructiveRoutes[c.Request.Method+" "+c.FullPath()]
+}
+
+// AuditImpersonation records every request made with an impersonation token
+// once it has been handled.
+func AuditImpersonation(store impersonation.Store, logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		principal, ok := GetPrincipal(c)
+		if !ok || principal.ActorID == "" {
+			return
+		}
+		record := &impersonation.Record{
+			GrantID:   principal.SessionID,
+			ActorID:   principal.ActorID,
+			SubjectID: principal.UserID,
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.Path,
+			Status:    c.Writer.Status(),
+			IP:        c.ClientIP(),
+			At:        time.Now(),
+		}
+		if err := store.Record(c, record); err != nil {
+			logger.Error("Error recording impersonated request", "error", err.Error())
+		}
+		logger.Info("Impersonated request", "actor_id", record.ActorID, "subject_id", record.SubjectID,
+			"method", record.Method, "path", record.Path, "status", record.Status)
+	}
+}
@@ -1,88 +1,158 @@
 package middleware
 
 import (
+	"api/api/apikey"
 	"api/api/token"
+	policy "api/casbin"
+	"api/model"
 	"errors"
-	"fmt"
-	"net/http"
 
 	"github.com/casbin/casbin/v2"
 	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/metadata"
 )
 
 type casbinPermission struct {
-	enforcer *casbin.Enforcer
+	enforcer *casbin.SyncedEnforcer
 }
 
-func Check(c *gin.Context) {
+const principalKey = "principal"
 
-	accessToken := c.GetHeader("Authorization")
-	if accessToken == "" {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-			"error": "Authorization is required",
-		})
-		return
-	}
+// Check authenticates the request once: it accepts either an access token in
+// Authorization, which must not be revoked through denylist, or a service
+// account key in X-API-Key. The resulting Principal is stored on the context
+// for the handlers, the casbin middleware and outgoing gRPC calls.
+func Check(denylist token.Denylist, keys *apikey.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if raw := c.GetHeader("X-API-Key"); raw != "" {
+			checkAPIKey(c, keys, raw)
+			return
+		}
 
-	_, err := token.ValidateAccesToken(accessToken)
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-			"error": "Invalid token provided",
-		})
-		return
+		accessToken := c.GetHeader("Authorization")
+		if accessToken == "" {
+			Unauthorized(c, model.CodeMissingCredentials, "Authorization is required")
+			return
+		}
+
+		principal, err := token.Authenticate(c, denylist, accessToken)
+		switch {
+		case errors.Is(err, token.ErrTokenRevoked):
+			Unauthorized(c, model.CodeTokenRevoked, "Token has been revoked")
+			return
+		case errors.Is(err, token.ErrTokenExpired):
+			Unauthorized(c, model.CodeTokenExpired, "Token has expired")
+			return
+		case errors.Is(err, token.ErrDenylist):
+			InternalError(c, err)
+			return
+		case err != nil:
+			Unauthorized(c, model.CodeInvalidToken, "Invalid token provided")
+			return
+		}
+
+		SetPrincipal(c, principal)
+		if principal.ActorID != "" {
+			c.Header(ImpersonatedByHeader, principal.ActorID)
+		}
+		c.Next()
 	}
-	c.Next()
 }
 
-func (casb *casbinPermission) GetRole(c *gin.Context) (string, int) {
-	tokenn := c.GetHeader("Authorization")
-	if tokenn == "" {
-		return "unauthorized", http.StatusUnauthorized
+func checkAPIKey(c *gin.Context, keys *apikey.Service, raw string) {
+	key, err := keys.Authenticate(c, raw)
+	switch {
+	case errors.Is(err, apikey.ErrExpired):
+		Unauthorized(c, model.CodeAPIKeyExpired, "API key has expired")
+		return
+	case errors.Is(err, apikey.ErrRevoked):
+		Unauthorized(c, model.CodeAPIKeyRevoked, "API key has been revoked")
+		return
+	case errors.Is(err, apikey.ErrInvalid):
+		Unauthorized(c, model.CodeInvalidAPIKey, "Invalid API key")
+		return
+	case err != nil:
+		InternalError(c, err)
+		return
 	}
-	_, role, err := token.GetUserInfoFromAccessToken(tokenn)
-	if err != nil {
-		return "error while reding role", 500
+	if !key.Allows(c.Request.Method, c.FullPath()) {
+		Forbidden(c, model.CodeAPIKeyScope, "API key is not scoped for this route")
+		return
 	}
 
-	return role, 0
+	SetPrincipal(c, &token.Principal{
+		UserID:    key.ServiceAccount,
+		Role:      key.Subject,
+		APIKeyID:  key.ID,
+		IssuedAt:  key.CreatedAt,
+		ExpiresAt: key.ExpiresAt,
+	})
+	c.Next()
+}
+
+// SetPrincipal stores p on the request and forwards the caller identity to
+// upstream services as gRPC metadata.
+func SetPrincipal(c *gin.Context, p *token.Principal) {
+	c.Set(principalKey, p)
+	ctx := metadata.AppendToOutgoingContext(c.Request.Context(),
+		"x-user-id", p.UserID,
+		"x-user-role", p.Role,
+	)
+	c.Request = c.Request.WithContext(ctx)
 }
 
-func (casb *casbinPermission) CheckPermission(c *gin.Context) (bool, error) {
+// GetPrincipal returns the caller authenticated by Check.
+func GetPrincipal(c *gin.Context) (*token.Principal, bool) {
+	v, ok := c.Get(principalKey)
+	if !ok {
+		return nil, false
+	}
+	p, ok := v.(*token.Principal)
+	return p, ok
+}
 
+// CheckPermission reports whether casbin allows the principal to call the
+// route, by the role of the account or by roles granted to the user.
+func (casb *casbinPermission) CheckPermission(c *gin.Context, principal *token.Principal) (bool, error) {
 	act := c.Request.Method
-	sub, status := casb.GetRole(c)
-	if status != 0 {
-		return false, errors.New("error in get role")
-	}
 	obj := c.FullPath()
 
-	ok, err := casb.enforcer.Enforce(sub, obj, act)
-	fmt.Print("\n\n", obj, "\n\n")
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"Error": "Internal server error",
-		})
-		c.Abort()
-		return false, err
+	// Route permissions are checked in every domain; rules limited to one
+	// subject are checked by the handlers that know the subject.
+	ok, err := casb.enforcer.Enforce(principal.Role, policy.AnyDomain, obj, act)
+	if err != nil || ok || principal.APIKeyID != "" {
+		return ok, err
 	}
-	return ok, nil
+	// Users can also be granted roles of their own with "g" rules.
+	return casb.enforcer.Enforce(principal.UserID, policy.AnyDomain, obj, act)
 }
 
-func CheckPermissionMiddleware(enf *casbin.Enforcer) gin.HandlerFunc {
+// CheckPermissionMiddleware lets the request through only when casbin
+// allows it. Every rejection aborts the chain, so the handler never runs.
+func CheckPermissionMiddleware(enf *casbin.SyncedEnforcer) gin.HandlerFunc {
 	casbHandler := &casbinPermission{
 		enforcer: enf,
 	}
 
 	return func(c *gin.Context) {
-		result, err := casbHandler.CheckPermission(c)
+		principal, ok := GetPrincipal(c)
+		if !ok {
+			Unauthorized(c, model.CodeMissingCredentials, "Authorization is required")
+			return
+		}
+		if principal.ActorID != "" && isDestructive(c) {
+			Forbidden(c, model.CodeImpersonationLimit, "Not allowed while impersonating")
+			return
+		}
 
+		allowed, err := casbHandler.CheckPermission(c, principal)
 		if err != nil {
-			c.AbortWithError(500, err)
+			InternalError(c, err)
+			return
 		}
-		if !result {
-			c.AbortWithStatusJSON(401, gin.H{
-				"message": "Forbidden",
-			})
+		if !allowed {
+			Forbidden(c, model.CodePermissionDenied, "You do not have permission to call this route")
+			return
 		}
 
 		c.Next()
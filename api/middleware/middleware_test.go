@@ -0,0 +1,214 @@
+package middleware_test
+
+import (
+	"api/api/middleware"
+	"api/api/token"
+	policy "api/casbin"
+	pb "api/genproto/user"
+	"api/model"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/casbin/casbin/v2"
+	casbinmodel "github.com/casbin/casbin/v2/model"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+const secret = "middleware-test-secret"
+
+// threeFieldModel has no domain, so the 4-field requests of the permission
+// middleware make Enforce fail.
+const threeFieldModel = `
+[request_definition]
+r = sub, obj, act
+
+[policy_definition]
+p = sub, obj, act
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = r.sub == p.sub && r.obj == p.obj && r.act == p.act
+`
+
+func init() {
+	gin.SetMode(gin.TestMode)
+	token.UseKeys(token.NewHMACKeySet(secret), token.NewHMACKeySet(secret))
+}
+
+func enforcer(t *testing.T) *casbin.SyncedEnforcer {
+	t.Helper()
+	e, err := casbin.NewSyncedEnforcer("../../casbin/model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.AddPolicy("student", policy.AnyDomain, "/api/allowed", http.MethodGet); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func brokenEnforcer(t *testing.T) *casbin.SyncedEnforcer {
+	t.Helper()
+	m, err := casbinmodel.NewModelFromString(threeFieldModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := casbin.NewSyncedEnforcer(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// accessToken signs an access token for a student in session sid.
+func accessToken(t *testing.T, sid string) string {
+	t.Helper()
+	res := &pb.LoginResponse{Id: "user-1", Role: "student"}
+	if err := token.GeneratedAccessJWTToken(res, sid); err != nil {
+		t.Fatal(err)
+	}
+	return res.Access
+}
+
+func expiredToken(t *testing.T) string {
+	t.Helper()
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"typ":     "access",
+		"jti":     "expired",
+		"user_id": "user-1",
+		"role":    "student",
+		"iat":     time.Now().Add(-2 * time.Hour).Unix(),
+		"exp":     time.Now().Add(-time.Hour).Unix(),
+	}).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestRejectedRequestsNeverReachTheHandler(t *testing.T) {
+	denylist := token.NewMemoryDenylist()
+	if err := denylist.RevokeToken(context.Background(), "revoked-session", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		enforcer  *casbin.SyncedEnforcer
+		path      string
+		auth      string
+		status    int
+		code      string
+		challenge string
+	}{
+		{
+			name:      "missing token",
+			enforcer:  enforcer(t),
+			path:      "/api/allowed",
+			status:    http.StatusUnauthorized,
+			code:      model.CodeMissingCredentials,
+			challenge: `Bearer realm="api"`,
+		},
+		{
+			name:      "expired token",
+			enforcer:  enforcer(t),
+			path:      "/api/allowed",
+			auth:      expiredToken(t),
+			status:    http.StatusUnauthorized,
+			code:      model.CodeTokenExpired,
+			challenge: `Bearer realm="api", error="invalid_token", error_description="Token has expired"`,
+		},
+		{
+			name:      "revoked token",
+			enforcer:  enforcer(t),
+			path:      "/api/allowed",
+			auth:      accessToken(t, "revoked-session"),
+			status:    http.StatusUnauthorized,
+			code:      model.CodeTokenRevoked,
+			challenge: `Bearer realm="api", error="invalid_token", error_description="Token has been revoked"`,
+		},
+		{
+			name:     "policy denies the route",
+			enforcer: enforcer(t),
+			path:     "/api/denied",
+			auth:     "Bearer " + accessToken(t, "session"),
+			status:   http.StatusForbidden,
+			code:     model.CodePermissionDenied,
+		},
+		{
+			name:     "enforcer error",
+			enforcer: brokenEnforcer(t),
+			path:     "/api/allowed",
+			auth:     "Bearer " + accessToken(t, "session"),
+			status:   http.StatusInternalServerError,
+			code:     model.CodeInternal,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			router := gin.New()
+			api := router.Group("/api")
+			api.Use(middleware.Check(denylist, nil))
+			api.Use(middleware.CheckPermissionMiddleware(tt.enforcer))
+			handle := func(c *gin.Context) {
+				called = true
+				c.Status(http.StatusOK)
+			}
+			api.GET("/allowed", handle)
+			api.GET("/denied", handle)
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			var body model.Error
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q: %v", rec.Body, err)
+			}
+			if body.Code != tt.code {
+				t.Errorf("code = %q, want %q", body.Code, tt.code)
+			}
+			if got := rec.Header().Get("WWW-Authenticate"); got != tt.challenge {
+				t.Errorf("WWW-Authenticate = %q, want %q", got, tt.challenge)
+			}
+			if called {
+				t.Error("handler ran")
+			}
+		})
+	}
+}
+
+func TestAllowedRequestReachesTheHandler(t *testing.T) {
+	called := false
+	router := gin.New()
+	router.Use(middleware.Check(token.NewMemoryDenylist(), nil))
+	router.Use(middleware.CheckPermissionMiddleware(enforcer(t)))
+	router.GET("/api/allowed", func(c *gin.Context) {
+		called = true
+		c.Status(http.StatusOK)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/allowed", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken(t, "session"))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK || !called {
+		t.Errorf("status = %d, handler ran = %v, want 200 and true", rec.Code, called)
+	}
+}
@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"api/model"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limits returns the current rate limit: requests per second and burst.
+// A rate of 0 lets every request through.
+type Limits func() (perSecond, burst int)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter is a token bucket per client IP.
+type limiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// take takes a token from the bucket of key, and otherwise returns how long
+// until one is available.
+func (l *limiter) take(key string, perSecond, burst int, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// A full bucket is the same as no bucket, so idle ones are dropped.
+	if now.Sub(l.lastSweep) > time.Minute {
+		for k, b := range l.buckets {
+			if now.Sub(b.last).Seconds()*float64(perSecond) >= float64(burst) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*float64(perSecond))
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / float64(perSecond) * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// RateLimit rejects clients that make more requests than limits allows with
+// 429. Limits are read on every request, so they can change at run time.
+func RateLimit(limits Limits) gin.HandlerFunc {
+	l := &limiter{buckets: make(map[string]*bucket)}
+	return func(c *gin.Context) {
+		perSecond, burst := limits()
+		if perSecond <= 0 {
+			c.Next()
+			return
+		}
+		ok, wait := l.take(c.ClientIP(), perSecond, burst, time.Now())
+		if !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, model.Error{Code: model.CodeRateLimited, Message: "Too many requests"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"api/api/upstream"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UpstreamHeaders reports every upstream call made for a request in an
+// X-Upstream-Call response header, with its attempts, deadline, outcome and
+// the endpoint that served it, while enabled returns true. It is meant for debugging.
+func UpstreamHeaders(enabled func() bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !enabled() {
+			c.Next()
+			return
+		}
+		ctx, trace := upstream.WithTrace(c.Request.Context())
+		c.Request = c.Request.WithContext(ctx)
+		c.Writer = &traceWriter{ResponseWriter: c.Writer, trace: trace}
+		c.Next()
+	}
+}
+
+// traceWriter adds the calls of trace to the headers just before they are
+// sent, after the handler made its calls.
+type traceWriter struct {
+	gin.ResponseWriter
+	trace   *upstream.Trace
+	stamped bool
+}
+
+func (w *traceWriter) stamp() {
+	if w.stamped || w.Written() {
+		return
+	}
+	w.stamped = true
+	for _, call := range w.trace.Calls() {
+		w.Header().Add("X-Upstream-Call", call.String())
+	}
+}
+
+func (w *traceWriter) WriteHeader(code int) {
+	w.stamp()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *traceWriter) WriteHeaderNow() {
+	w.stamp()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *traceWriter) Write(data []byte) (int, error) {
+	w.stamp()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *traceWriter) WriteString(s string) (int, error) {
+	w.stamp()
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,223 @@
+package policycheck
+
+import (
+	"api/casbin"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	casbinv2 "github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/util"
+	"github.com/gin-gonic/gin"
+)
+
+// ProtectedPrefix is the path prefix of the routes behind the casbin
+// middleware. Other routes, such as login and swagger, are public.
+const ProtectedPrefix = "/api/"
+
+// Route is a method and path template as registered with gin.
+type Route struct {
+	Method string
+	Path   string
+}
+
+func (r Route) String() string { return r.Method + " " + r.Path }
+
+// Report lists the differences between the routes and the policies.
+type Report struct {
+	// Unguarded are protected routes that no rule allows to anyone.
+	Unguarded []Route
+	// Orphaned are rules for paths and methods that no route serves.
+	Orphaned []casbin.Rule
+	// Unreachable are roles that cannot call any route.
+	Unreachable []string
+}
+
+// Drift reports whether routes and policies disagree.
+func (r *Report) Drift() bool {
+	return len(r.Unguarded) > 0 || len(r.Orphaned) > 0 || len(r.Unreachable) > 0
+}
+
+// Write prints the report, one finding per line.
+func (r *Report) Write(w io.Writer) {
+	for _, route := range r.Unguarded {
+		fmt.Fprintf(w, "route without policy: %s\n", route)
+	}
+	for _, rule := range r.Orphaned {
+		fmt.Fprintf(w, "policy without route: %s\n", rule)
+	}
+	for _, role := range r.Unreachable {
+		fmt.Fprintf(w, "role reaches no route: %s\n", role)
+	}
+}
+
+// Routes returns the protected routes of engine.
+func Routes(engine *gin.Engine) []Route {
+	var routes []Route
+	for _, info := range engine.Routes() {
+		if strings.HasPrefix(info.Path, ProtectedPrefix) {
+			routes = append(routes, Route{Method: info.Method, Path: info.Path})
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return routes[i].Method < routes[j].Method
+	})
+	return routes
+}
+
+// Match finds the route of engine that serves method and path, and the path
+// parameters it binds. Like gin, a static segment wins over a parameter and a
+// parameter over a catch-all.
+func Match(engine *gin.Engine, method, path string) (Route, map[string]string, bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	var (
+		best      Route
+		bestRank  []int
+		bestParam map[string]string
+	)
+	for _, info := range engine.Routes() {
+		if info.Method != method {
+			continue
+		}
+		rank, params, ok := match(strings.Split(strings.Trim(info.Path, "/"), "/"), segments)
+		if ok && (bestRank == nil || lessRank(rank, bestRank)) {
+			best, bestRank, bestParam = Route{Method: info.Method, Path: info.Path}, rank, params
+		}
+	}
+	return best, bestParam, bestRank != nil
+}
+
+// match matches the segments of a path with those of a route template. The
+// rank has, for each segment, 0 for a static one, 1 for a parameter and 2
+// for a catch-all.
+func match(template, segments []string) ([]int, map[string]string, bool) {
+	params := make(map[string]string)
+	rank := make([]int, 0, len(template))
+	for i, t := range template {
+		if strings.HasPrefix(t, "*") {
+			params[t[1:]] = "/" + strings.Join(segments[min(i, len(segments)):], "/")
+			return append(rank, 2), params, true
+		}
+		if i >= len(segments) {
+			return nil, nil, false
+		}
+		switch {
+		case strings.HasPrefix(t, ":") && segments[i] != "":
+			params[t[1:]] = segments[i]
+			rank = append(rank, 1)
+		case t == segments[i]:
+			rank = append(rank, 0)
+		default:
+			return nil, nil, false
+		}
+	}
+	return rank, params, len(template) == len(segments)
+}
+
+func lessRank(a, b []int) bool {
+	for i := range min(len(a), len(b)) {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// Check compares routes with the rules of enforcer.
+func Check(routes []Route, enforcer casbinv2.IEnforcer) (*Report, error) {
+	rules, err := casbin.Rules(enforcer)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{}
+	roles := make(map[string]bool)
+	for _, rule := range rules {
+		switch rule.PType {
+		case "p":
+			roles[rule.Values[0]] = true
+			if !served(routes, rule) {
+				report.Orphaned = append(report.Orphaned, rule)
+			}
+		case "g":
+			roles[rule.Values[1]] = true
+		}
+	}
+
+	for _, route := range routes {
+		if !guarded(rules, route) {
+			report.Unguarded = append(report.Unguarded, route)
+		}
+	}
+
+	for role := range roles {
+		reaches := false
+		for _, route := range routes {
+			ok, err := enforcer.Enforce(role, casbin.AnyDomain, route.Path, route.Method)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				reaches = true
+				break
+			}
+		}
+		if !reaches {
+			report.Unreachable = append(report.Unreachable, role)
+		}
+	}
+	sort.Strings(report.Unreachable)
+	return report, nil
+}
+
+func served(routes []Route, rule casbin.Rule) bool {
+	for _, route := range routes {
+		if matches(rule, route) {
+			return true
+		}
+	}
+	return false
+}
+
+func guarded(rules []casbin.Rule, route Route) bool {
+	for _, rule := range rules {
+		if rule.PType == "p" && matches(rule, route) {
+			return true
+		}
+	}
+	return false
+}
+
+func matches(rule casbin.Rule, route Route) bool {
+	return rule.Values[3] == route.Method && util.KeyMatch(route.Path, rule.Values[2])
+}
+
+// TB is the part of testing.TB used by Assert.
+type TB interface {
+	Helper()
+	Errorf(format string, args ...any)
+}
+
+// Assert fails t for every difference between the protected routes of
+// engine and the rules of enforcer, for use in tests:
+//
+//	policycheck.Assert(t, api.Router(&handler.Handler{}), enforcer)
+func Assert(t TB, engine *gin.Engine, enforcer casbinv2.IEnforcer) {
+	t.Helper()
+	report, err := Check(Routes(engine), enforcer)
+	if err != nil {
+		t.Errorf("policycheck: %v", err)
+		return
+	}
+	var b strings.Builder
+	report.Write(&b)
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		if line != "" {
+			t.Errorf("policycheck: %s", line)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+// The test is in its own package because handler imports policycheck.
+package policycheck_test
+
+import (
+	"api/api"
+	"api/api/handler"
+	"api/api/policycheck"
+	"api/casbin"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRoutesMatchPolicy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	enforcer, err := casbin.LoadEnforcer("../../casbin/model.conf", "../../casbin/policy.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policycheck.Assert(t, api.Router(&handler.Handler{}), enforcer)
+}
@@ -0,0 +1,137 @@
+package reset
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+var (
+	ErrTooSoon     = errors.New("a reset code was requested too recently")
+	ErrInvalidCode = errors.New("invalid or expired reset code")
+)
+
+// Code is a pending password reset of one hh_id. Codes are also kept for
+// unknown hh_ids, without a UserID, so that both cases look the same from
+// outside.
+type Code struct {
+	HhID        string
+	UserID      string
+	Hash        string
+	Attempts    int
+	RequestedAt time.Time
+	ExpiresAt   time.Time
+}
+
+type Store interface {
+	Get(ctx context.Context, hhID string) (*Code, error)
+	Put(ctx context.Context, code *Code) error
+	// SetAttempts sets the attempts of the stored code to attempts if it is
+	// still code, with the same hash and attempts. It reports whether it did.
+	SetAttempts(ctx context.Context, code *Code, attempts int) (bool, error)
+	Delete(ctx context.Context, hhID string) error
+}
+
+type Options struct {
+	// TTL is how long a code can be used.
+	TTL time.Duration
+	// ResendAfter is the minimum time between two codes for one hh_id.
+	ResendAfter time.Duration
+	// MaxAttempts invalidates a code after this many wrong guesses.
+	MaxAttempts int
+}
+
+type Service struct {
+	store Store
+	opts  Options
+}
+
+func NewService(store Store, opts Options) *Service {
+	return &Service{store: store, opts: opts}
+}
+
+// Issue creates a new code for hhID. userID is empty when no such user
+// exists, in which case the code can never be redeemed.
+func (s *Service) Issue(ctx context.Context, hhID, userID string) (string, time.Time, error) {
+	now := time.Now()
+	prev, err := s.store.Get(ctx, hhID)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if prev != nil && now.Sub(prev.RequestedAt) < s.opts.ResendAfter {
+		return "", time.Time{}, ErrTooSoon
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+	entry := &Code{
+		HhID:        hhID,
+		UserID:      userID,
+		Hash:        hash(hhID, code),
+		RequestedAt: now,
+		ExpiresAt:   now.Add(s.opts.TTL),
+	}
+	if err := s.store.Put(ctx, entry); err != nil {
+		return "", time.Time{}, err
+	}
+	return code, entry.ExpiresAt, nil
+}
+
+// RetryAfter returns how long hhID has to wait before a new code is issued.
+func (s *Service) RetryAfter(ctx context.Context, hhID string) time.Duration {
+	prev, err := s.store.Get(ctx, hhID)
+	if err != nil || prev == nil {
+		return 0
+	}
+	return s.opts.ResendAfter - time.Since(prev.RequestedAt)
+}
+
+// Redeem checks code for hhID and, on success, consumes it and returns the
+// user it was issued for. Every attempt is counted with a compare-and-set, so
+// concurrent attempts can neither redeem one code twice nor guess past
+// MaxAttempts.
+func (s *Service) Redeem(ctx context.Context, hhID, code string) (string, error) {
+	for {
+		entry, err := s.store.Get(ctx, hhID)
+		if err != nil {
+			return "", err
+		}
+		if entry == nil || entry.UserID == "" || time.Now().After(entry.ExpiresAt) || entry.Attempts >= s.opts.MaxAttempts {
+			return "", ErrInvalidCode
+		}
+
+		valid := subtle.ConstantTimeCompare([]byte(entry.Hash), []byte(hash(hhID, code))) == 1
+		// A redeemed code is kept, spent, so that the resend interval still
+		// applies.
+		attempts := entry.Attempts + 1
+		if valid {
+			attempts = s.opts.MaxAttempts
+		}
+		set, err := s.store.SetAttempts(ctx, entry, attempts)
+		if err != nil {
+			return "", err
+		}
+		if !set {
+			// Another attempt or a new code came first.
+			continue
+		}
+		if !valid {
+			return "", ErrInvalidCode
+		}
+		return entry.UserID, nil
+	}
+}
+
+func hash(hhID, code string) string {
+	sum := sha256.Sum256([]byte(hhID + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,74 @@
+package reset_test
+
+import (
+	"api/api/reset"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func service() *reset.Service {
+	return reset.NewService(reset.NewMemoryStore(), reset.Options{
+		TTL:         time.Minute,
+		ResendAfter: time.Minute,
+		MaxAttempts: 3,
+	})
+}
+
+func TestCodeIsRedeemedOnce(t *testing.T) {
+	ctx := context.Background()
+	s := service()
+	code, _, err := s.Issue(ctx, "hh-1", "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var redeemed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			userID, err := s.Redeem(ctx, "hh-1", code)
+			switch {
+			case err == nil && userID == "user-1":
+				redeemed.Add(1)
+			case !errors.Is(err, reset.ErrInvalidCode):
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := redeemed.Load(); n != 1 {
+		t.Fatalf("code redeemed %d times, want once", n)
+	}
+}
+
+func TestConcurrentGuessesStopAtMaxAttempts(t *testing.T) {
+	ctx := context.Background()
+	s := service()
+	code, _, err := s.Issue(ctx, "hh-1", "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := "000000"
+	if code == wrong {
+		wrong = "000001"
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Redeem(ctx, "hh-1", wrong)
+		}()
+	}
+	wg.Wait()
+	if _, err := s.Redeem(ctx, "hh-1", code); !errors.Is(err, reset.ErrInvalidCode) {
+		t.Fatalf("right code after too many guesses: err = %v, want %v", err, reset.ErrInvalidCode)
+	}
+}
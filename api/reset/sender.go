@@ -0,0 +1,64 @@
+package reset
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Message is a reset code on its way to a user.
+type Message struct {
+	UserID    string
+	HhID      string
+	Phone     string
+	Code      string
+	ExpiresAt time.Time
+}
+
+func (m Message) Text() string {
+	return fmt.Sprintf("Parolni tiklash kodi: %s. Kod %s gacha amal qiladi.", m.Code, m.ExpiresAt.Format("15:04"))
+}
+
+// Sender delivers reset codes over an outbound channel in addition to the
+// in-app notification.
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// LogSender writes codes to the log. It stands in for a real channel in
+// local setups and must not be used in production.
+type LogSender struct {
+	Log *slog.Logger
+}
+
+func (s LogSender) Send(ctx context.Context, msg Message) error {
+	s.Log.Info("Password reset code", "hh_id", msg.HhID, "code", msg.Code, "expires_at", msg.ExpiresAt)
+	return nil
+}
+
+// SMTPSender mails codes. To is the recipient address, where "{hh_id}" is
+// replaced with the user's hh_id.
+type SMTPSender struct {
+	Addr     string
+	From     string
+	To       string
+	Username string
+	Password string
+}
+
+func (s SMTPSender) Send(ctx context.Context, msg Message) error {
+	to := strings.ReplaceAll(s.To, "{hh_id}", msg.HhID)
+	host, _, _ := strings.Cut(s.Addr, ":")
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	body := "From: " + s.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: Parolni tiklash\r\n" +
+		"\r\n" + msg.Text() + "\r\n"
+	return smtp.SendMail(s.Addr, auth, s.From, []string{to}, []byte(body))
+}
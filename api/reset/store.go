@@ -0,0 +1,131 @@
+package reset
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+type MemoryStore struct {
+	mu    sync.Mutex
+	codes map[string]*Code
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{codes: make(map[string]*Code)}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, hhID string) (*Code, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	code, ok := s.codes[hhID]
+	if !ok {
+		return nil, nil
+	}
+	res := *code
+	return &res, nil
+}
+
+func (s *MemoryStore) Put(ctx context.Context, code *Code) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, c := range s.codes {
+		if now.Sub(c.ExpiresAt) > time.Hour {
+			delete(s.codes, id)
+		}
+	}
+	saved := *code
+	s.codes[code.HhID] = &saved
+	return nil
+}
+
+func (s *MemoryStore) SetAttempts(ctx context.Context, code *Code, attempts int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.codes[code.HhID]
+	if !ok || stored.Hash != code.Hash || stored.Attempts != code.Attempts {
+		return false, nil
+	}
+	stored.Attempts = attempts
+	return true, nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, hhID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.codes, hhID)
+	return nil
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) (*PostgresStore, error) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS password_reset_codes (
+			hh_id        TEXT PRIMARY KEY,
+			user_id      TEXT NOT NULL,
+			hash         TEXT NOT NULL,
+			attempts     INT NOT NULL,
+			requested_at TIMESTAMPTZ NOT NULL,
+			expires_at   TIMESTAMPTZ NOT NULL
+		)`)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresStore{db: db}, nil
+}
+
+func (s *PostgresStore) Get(ctx context.Context, hhID string) (*Code, error) {
+	code := Code{HhID: hhID}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT user_id, hash, attempts, requested_at, expires_at
+		FROM password_reset_codes WHERE hh_id = $1`, hhID).
+		Scan(&code.UserID, &code.Hash, &code.Attempts, &code.RequestedAt, &code.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &code, nil
+}
+
+func (s *PostgresStore) Put(ctx context.Context, code *Code) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO password_reset_codes (hh_id, user_id, hash, attempts, requested_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (hh_id) DO UPDATE SET user_id = EXCLUDED.user_id, hash = EXCLUDED.hash,
+			attempts = EXCLUDED.attempts, requested_at = EXCLUDED.requested_at, expires_at = EXCLUDED.expires_at`,
+		code.HhID, code.UserID, code.Hash, code.Attempts, code.RequestedAt, code.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `DELETE FROM password_reset_codes WHERE expires_at < now() - interval '1 hour'`)
+	return err
+}
+
+func (s *PostgresStore) SetAttempts(ctx context.Context, code *Code, attempts int) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE password_reset_codes SET attempts = $4
+		WHERE hh_id = $1 AND hash = $2 AND attempts = $3`,
+		code.HhID, code.Hash, code.Attempts, attempts)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *PostgresStore) Delete(ctx context.Context, hhID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM password_reset_codes WHERE hh_id = $1`, hhID)
+	return err
+}
@@ -3,6 +3,8 @@ package api
 import (
 	"api/api/handler"
 	"api/api/middleware"
+	"api/api/policycheck"
+	"net/http"
 
 	_ "api/api/docs"
 
@@ -14,18 +16,45 @@ import (
 // @securityDefinitions.apikey ApiKeyAuth
 // @in header
 // @name Authorization
+// @securityDefinitions.apikey ServiceKeyAuth
+// @in header
+// @name X-API-Key
 // @title ALL
 // @version 1.0
 // @description API Gateway
 // BasePath: /
 func Router(hand *handler.Handler) *gin.Engine {
 	router := gin.Default()
+	hand.Engine = router
+	hand.Ownership = make(map[policycheck.Route]handler.Ownership)
+	// own registers a route whose handler acts on one resource, behind the
+	// ownership check rule, and records the check for explain.
+	own := func(group *gin.RouterGroup, method, path string, rule handler.OwnershipRule, id handler.ResourceID, handle gin.HandlerFunc) {
+		route := policycheck.Route{Method: method, Path: group.BasePath() + path}
+		hand.Ownership[route] = handler.Ownership{Rule: rule, ID: id}
+		group.Handle(method, path, hand.Owns(rule, id), handle)
+	}
+	// Lets handlers pass *gin.Context to gRPC clients while keeping the
+	// request context, and with it the caller metadata, deadlines and cancellation.
+	router.ContextWithFallback = true
 	router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
-	router.Use(handler.CORSMiddleware())
+	// Probes come from the orchestrator and are not rate limited.
+	router.GET("/health", hand.HealthStatus)
+	router.GET("/health/live", hand.HealthLive)
+	router.GET("/health/ready", hand.HealthReady)
+	router.Use(handler.CORSMiddleware(func() []string { return hand.Config.Current().Origins() }))
+	router.Use(middleware.RateLimit(func() (int, int) {
+		conf := hand.Config.Current()
+		return conf.RATE_LIMIT, conf.RATE_BURST
+	}))
+	router.Use(middleware.UpstreamHeaders(func() bool { return hand.Config.Current().DEBUG }))
+	router.Use(middleware.AuditImpersonation(hand.Impersonation, hand.Log))
+	router.GET("/.well-known/jwks.json", hand.JWKS)
 	// user
 	user := router.Group("/api/user")
-	user.Use(middleware.Check)
+	user.Use(middleware.Check(hand.Denylist, hand.APIKeys))
 	user.Use(middleware.CheckPermissionMiddleware(hand.Enforcer))
+	user.Use(middleware.FailFast(hand.Breakers["user"]))
 	{
 		user.POST("/register", hand.Register)
 		user.GET("/getprofile", hand.GetProfile)
@@ -35,50 +64,112 @@ func Router(hand *handler.Handler) *gin.Engine {
 		user.DELETE("/delete/:id", hand.DeleteProfile)
 		user.DELETE("/photo", hand.DeleteUserPhoto)
 		user.POST("/photo", hand.UploadPhotoToUser)
+		user.POST("/logout", hand.Logout)
+		user.POST("/logout-all", hand.LogoutAll)
+		user.GET("/sessions", hand.GetMySessions)
+		user.DELETE("/sessions/:id", hand.DeleteMySession)
+		user.POST("/2fa/enroll", hand.EnrollTwoFactor)
+		user.POST("/2fa/confirm", hand.ConfirmTwoFactor)
+		user.DELETE("/2fa", hand.DisableTwoFactor)
+		user.GET("/authz/explain", hand.ExplainMyAccess)
+		user.GET("/flags", hand.GetMyFlags)
 	}
 
 	all := router.Group("/all/user")
+	all.Use(middleware.FailFast(hand.Breakers["user"]))
 	{
 		all.POST("/login", hand.Login)
 		all.POST("/refresh", hand.Refresh)
+		all.POST("/password/forgot", hand.ForgotPassword)
+		all.POST("/password/reset", hand.ResetPassword)
+		all.POST("/2fa/enroll", hand.EnrollTwoFactorChallenge)
+		all.POST("/2fa/verify", hand.VerifyTwoFactor)
+	}
+
+	admin := router.Group("/api/admin")
+	admin.Use(middleware.Check(hand.Denylist, hand.APIKeys))
+	admin.Use(middleware.CheckPermissionMiddleware(hand.Enforcer))
+	{
+		admin.GET("/lockouts", hand.GetLockouts)
+		admin.DELETE("/lockouts", hand.ClearLockout)
+		admin.GET("/users/:id/sessions", hand.GetUserSessions)
+		admin.DELETE("/users/:id/sessions", hand.DeleteUserSessions)
+		admin.DELETE("/users/:id/sessions/:session_id", hand.DeleteUserSession)
+		admin.DELETE("/users/:id/2fa", hand.ResetUserTwoFactor)
+		admin.POST("/api-keys", hand.CreateAPIKey)
+		admin.GET("/api-keys", hand.GetAPIKeys)
+		admin.DELETE("/api-keys/:id", hand.RevokeAPIKey)
+		admin.POST("/impersonation/grants", hand.CreateImpersonationGrant)
+		admin.GET("/impersonation/grants", hand.GetImpersonationGrants)
+		admin.DELETE("/impersonation/grants/:id", hand.RevokeImpersonationGrant)
+		admin.GET("/impersonation/audit", hand.GetImpersonationAudit)
+		admin.GET("/policies", hand.GetPolicies)
+		admin.POST("/policies", hand.AddPolicy)
+		admin.PUT("/policies", hand.ReplacePolicies)
+		admin.DELETE("/policies", hand.RemovePolicy)
+		admin.GET("/policies/export", hand.ExportPolicies)
+		admin.POST("/policies/import", hand.ImportPolicies)
+		admin.GET("/roles/users", hand.GetRoleGrants)
+		admin.POST("/roles/users", hand.GrantRole)
+		admin.DELETE("/roles/users", hand.RevokeRole)
+		admin.GET("/authz/explain", hand.ExplainAccess)
+		admin.POST("/authz/explain", hand.DryRunAccess)
+		admin.GET("/config", hand.GetConfig)
+		admin.POST("/config/reload", hand.ReloadConfig)
+		admin.GET("/flags", hand.GetFlags)
+		admin.PUT("/flags/:name", hand.OverrideFlag)
+		admin.DELETE("/flags/:name", hand.ClearFlagOverride)
+		admin.GET("/breakers", hand.GetBreakers)
+		admin.GET("/health", hand.GetDependencyHealth)
+	}
+
+	support := router.Group("/api/support")
+	support.Use(middleware.Check(hand.Denylist, hand.APIKeys))
+	support.Use(middleware.CheckPermissionMiddleware(hand.Enforcer))
+	support.Use(middleware.FailFast(hand.Breakers["user"]))
+	{
+		support.POST("/impersonate", hand.Impersonate)
 	}
 
 	// websocket
-	router.GET("/ws", func(c *gin.Context) {
+	router.GET("/ws", middleware.FailFast(hand.Breakers["user"]), func(c *gin.Context) {
 		hand.HandleWebSocket(c.Writer, c.Request)
 	})
 
 	group := router.Group("/api/groups")
-	group.Use(middleware.Check)
+	group.Use(middleware.Check(hand.Denylist, hand.APIKeys))
 	group.Use(middleware.CheckPermissionMiddleware(hand.Enforcer))
+	group.Use(middleware.FailFast(hand.Breakers["user"]))
 	{
 		group.POST("/create", hand.CreateGroup)
-		group.PUT("/update", hand.UpdateGroup)
-		group.DELETE("/delete", hand.DeleteGroup)
-		group.GET("/getById/:group_id", hand.GetGroupById)
+		own(group, http.MethodPut, "/update", handler.TeachesGroup, handler.BodyField("id"), hand.UpdateGroup)
+		own(group, http.MethodDelete, "/delete", handler.TeachesGroup, handler.BodyField("id"), hand.DeleteGroup)
+		own(group, http.MethodGet, "/getById/:group_id", handler.MemberOfGroup, handler.Param("group_id"), hand.GetGroupById)
 		group.GET("/getAll", hand.GetAllGroups)
-		group.POST("/add-student", hand.AddStudentToGroup)
-		group.DELETE("delete-student", hand.DeleteStudentFromGroup)
-		group.POST("add-teacher", hand.AddTeacherToGroup)
-		group.DELETE("delete-teacher", hand.DeleteTeacherFromGroup)
-		group.GET("student-groups/:hh_id", hand.GetStudentGroups)
-		group.GET("teacher-groups/:id", hand.GetTeacherGroups)
-		group.GET("students/:group_id", hand.GetGroupStudents)
+		own(group, http.MethodPost, "/add-student", handler.TeachesGroup, handler.BodyField("group_id"), hand.AddStudentToGroup)
+		own(group, http.MethodDelete, "/delete-student", handler.TeachesGroup, handler.BodyField("group_id"), hand.DeleteStudentFromGroup)
+		group.POST("/add-teacher", hand.AddTeacherToGroup)
+		group.DELETE("/delete-teacher", hand.DeleteTeacherFromGroup)
+		own(group, http.MethodGet, "/student-groups/:hh_id", handler.SelfOrTaughtStudent, handler.Param("hh_id"), hand.GetStudentGroups)
+		own(group, http.MethodGet, "/teacher-groups/:id", handler.SelfUser, handler.Param("id"), hand.GetTeacherGroups)
+		own(group, http.MethodGet, "/students/:group_id", handler.MemberOfGroup, handler.Param("group_id"), hand.GetGroupStudents)
 	}
 
 	topic := router.Group("/api/topics")
-	topic.Use(middleware.Check)
+	topic.Use(middleware.Check(hand.Denylist, hand.APIKeys))
 	topic.Use(middleware.CheckPermissionMiddleware(hand.Enforcer))
+	topic.Use(middleware.FailFast(hand.Breakers["question"]))
 	{
-		topic.POST("/create", hand.CreateTopic)
-		topic.PUT("/update", hand.UpdateTopic)
-		topic.DELETE("/delete/:topic_id", hand.DeleteTopic)
+		own(topic, http.MethodPost, "/create", handler.InSubject, handler.BodyField("subject_id"), hand.CreateTopic)
+		own(topic, http.MethodPut, "/update", handler.InSubjectOfTopic, handler.BodyField("id"), hand.UpdateTopic)
+		own(topic, http.MethodDelete, "/delete/:topic_id", handler.InSubjectOfTopic, handler.Param("topic_id"), hand.DeleteTopic)
 		topic.GET("/getAll", hand.GetAllTopics)
 	}
 
 	subject := router.Group("/api/subjects")
-	subject.Use(middleware.Check)
+	subject.Use(middleware.Check(hand.Denylist, hand.APIKeys))
 	subject.Use(middleware.CheckPermissionMiddleware(hand.Enforcer))
+	subject.Use(middleware.FailFast(hand.Breakers["question"]))
 	{
 		subject.POST("/create", hand.CreateSubject)
 		subject.GET("/get/:id", hand.GetSubject)
@@ -88,52 +179,62 @@ func Router(hand *handler.Handler) *gin.Engine {
 	}
 
 	question := router.Group("/api/questions")
-	question.Use(middleware.Check)
+	question.Use(middleware.Check(hand.Denylist, hand.APIKeys))
 	question.Use(middleware.CheckPermissionMiddleware(hand.Enforcer))
+	question.Use(middleware.FailFast(hand.Breakers["question"]))
 	{
-		question.POST("/create", hand.CreateQuestion)
-		question.GET("/:id", hand.GetQuestionById)
-		question.PUT("/update/:id", hand.UpdateQuestion)
-		question.DELETE("/delete/:id", hand.DeleteQuestion)
+		own(question, http.MethodPost, "/create", handler.InSubjectOfTopic, handler.BodyField("topic_id"), hand.CreateQuestion)
+		own(question, http.MethodGet, "/:id", handler.InSubjectOfQuestion, handler.Param("id"), hand.GetQuestionById)
+		own(question, http.MethodPut, "/update/:id", handler.InSubjectOfQuestion, handler.Param("id"), hand.UpdateQuestion)
+		own(question, http.MethodDelete, "/delete/:id", handler.InSubjectOfQuestion, handler.Param("id"), hand.DeleteQuestion)
 		question.GET("/getAll", hand.GetAllQuestions)
-		question.POST("/upload-image/:id", hand.UploadImageToQuestion)
-		question.DELETE("/delete-image/:id", hand.DeleteImageFromQuestion)
+		own(question, http.MethodPost, "/upload-image/:id", handler.InSubjectOfQuestion, handler.Param("id"), hand.UploadImageToQuestion)
+		own(question, http.MethodDelete, "/delete-image/:id", handler.InSubjectOfQuestion, handler.Param("id"), hand.DeleteImageFromQuestion)
 	}
 
 	questionInput := router.Group("/api/question-inputs")
-	questionInput.Use(middleware.Check)
+	questionInput.Use(middleware.Check(hand.Denylist, hand.APIKeys))
 	questionInput.Use(middleware.CheckPermissionMiddleware(hand.Enforcer))
+	questionInput.Use(middleware.FailFast(hand.Breakers["question"]))
 	{
-		questionInput.GET("/:id", hand.GetQuestionInputById)
-		questionInput.DELETE("/delete/:id", hand.DeleteQuestionInput)
-		questionInput.GET("/question/:question_id", hand.GetQuestionInputsByQuestionId)
-		questionInput.POST("/create", hand.CreateQuestionInput)
+		own(questionInput, http.MethodGet, "/:id", handler.InSubjectOfQuestionInput, handler.Param("id"), hand.GetQuestionInputById)
+		own(questionInput, http.MethodDelete, "/delete/:id", handler.InSubjectOfQuestionInput, handler.Param("id"), hand.DeleteQuestionInput)
+		own(questionInput, http.MethodGet, "/question/:question_id", handler.InSubjectOfQuestion, handler.Param("question_id"), hand.GetQuestionInputsByQuestionId)
+		own(questionInput, http.MethodPost, "/create", handler.InSubjectOfQuestion, handler.BodyField("question_id"), hand.CreateQuestionInput)
 	}
 
 	testCase := router.Group("/api/test-cases")
-	testCase.Use(middleware.Check)
+	testCase.Use(middleware.Check(hand.Denylist, hand.APIKeys))
 	testCase.Use(middleware.CheckPermissionMiddleware(hand.Enforcer))
+	testCase.Use(middleware.FailFast(hand.Breakers["question"]))
 	{
-		testCase.POST("/create", hand.CreateTestCase)
-		testCase.GET("/:id", hand.GetTestCaseById)
-		testCase.DELETE("/delete/:id", hand.DeleteTestCase)
-		testCase.GET("/question/:question_id", hand.GetTestCasesByQuestionId)
+		own(testCase, http.MethodPost, "/create", handler.InSubjectOfQuestion, handler.BodyField("question_id"), hand.CreateTestCase)
+		own(testCase, http.MethodGet, "/:id", handler.InSubjectOfTestCase, handler.Param("id"), hand.GetTestCaseById)
+		own(testCase, http.MethodDelete, "/delete/:id", handler.InSubjectOfTestCase, handler.Param("id"), hand.DeleteTestCase)
+		own(testCase, http.MethodGet, "/question/:question_id", handler.InSubjectOfQuestion, handler.Param("question_id"), hand.GetTestCasesByQuestionId)
 	}
 
 	task := router.Group("/api/task")
-	task.Use(middleware.Check)
+	task.Use(middleware.Check(hand.Denylist, hand.APIKeys))
 	task.Use(middleware.CheckPermissionMiddleware(hand.Enforcer))
+	task.Use(middleware.FailFast(hand.Breakers["question"]))
 	{
-		task.POST("/create", hand.CreateTask)
+		own(task, http.MethodPost, "/create", handler.TeachesGroup, handler.BodyField("group_id"), hand.CreateTask)
+		// The task service cannot look a task up by its ID, so deleting one is
+		// only checked by role until it can. Until then the delete route is
+		// granted to admins and teachers only, and teachers can delete tasks
+		// of groups they do not teach.
 		task.DELETE("/delete", hand.DeleteTask)
-		task.GET("get", hand.GetTask)
+		own(task, http.MethodGet, "/get", handler.SelfOrTaughtStudent, handler.Query("hh_id"), hand.GetTask)
 	}
 
 	check := router.Group("/api/check")
-	check.Use(middleware.Check)
+	check.Use(middleware.Check(hand.Denylist, hand.APIKeys))
 	check.Use(middleware.CheckPermissionMiddleware(hand.Enforcer))
 	{
-		check.POST("/submit", hand.ProxyChecker)
+		// Checker integrations are rolled out to students group by group
+		// with the "checker" flag.
+		check.POST("/submit", hand.Flag("checker"), hand.ProxyChecker)
 	}
 
 	return router
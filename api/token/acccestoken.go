@@ -1,26 +1,31 @@
 package token
 
 import (
-	"api/config"
 	pb "api/genproto/user"
 	"log"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
 )
 
-func GeneratedAccessJWTToken(req *pb.LoginResponse) error {
-	conf := config.Load()
-	token := *jwt.New(jwt.SigningMethodHS256)
+const AccessTokenTTL = 1 * time.Hour
 
+// GeneratedAccessJWTToken signs an access token for req. sessionID ties the
+// token to the refresh token family it was issued with.
+func GeneratedAccessJWTToken(req *pb.LoginResponse, sessionID string) error {
 	//payload
-	claims := token.Claims.(jwt.MapClaims)
+	claims := jwt.MapClaims{}
+	claims["typ"] = typeAccess
+	claims["jti"] = uuid.NewString()
+	claims["sid"] = sessionID
 	claims["user_id"] = req.Id
 	claims["role"] = req.Role
-	claims["iat"] = time.Now().Unix()
-	claims["exp"] = time.Now().Add(1 * time.Hour).Unix()
+	now := issueTime()
+	claims["iat"] = numericDate(now)
+	claims["exp"] = now.Add(AccessTokenTTL).Unix()
 
-	newToken, err := token.SignedString([]byte(conf.ACCES_KEY))
+	newToken, err := signToken(AccessKeys(), claims)
 	if err != nil {
 		log.Println(err)
 		return err
@@ -30,6 +35,24 @@ func GeneratedAccessJWTToken(req *pb.LoginResponse) error {
 	return nil
 }
 
+// GeneratedImpersonationToken signs a short-lived access token that lets
+// actorID act as subjectID. The grant ID is used as its session, so revoking
+// the grant through the denylist ends the impersonation.
+func GeneratedImpersonationToken(subjectID, subjectRole, actorID, grantID string, ttl time.Duration) (string, error) {
+	claims := jwt.MapClaims{}
+	claims["typ"] = typeAccess
+	claims["jti"] = uuid.NewString()
+	claims["sid"] = grantID
+	claims["user_id"] = subjectID
+	claims["role"] = subjectRole
+	claims["act"] = actorID
+	now := issueTime()
+	claims["iat"] = numericDate(now)
+	claims["exp"] = now.Add(ttl).Unix()
+
+	return signToken(AccessKeys(), claims)
+}
+
 func ValidateAccesToken(tokenStr string) (bool, error) {
 	_, err := ExtractAccesClaim(tokenStr)
 	if err != nil {
@@ -39,35 +62,13 @@ func ValidateAccesToken(tokenStr string) (bool, error) {
 }
 
 func ExtractAccesClaim(tokenStr string) (*jwt.MapClaims, error) {
-	conf := config.Load()
-	token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-		return []byte(conf.ACCES_KEY), nil
-	})
-
-	if err != nil {
-		return nil, err
-	}
-
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !(ok && token.Valid) {
-		return nil, err
-	}
-
-	return &claims, nil
+	return parseToken(tokenStr, AccessKeys(), typeAccess)
 }
 
 func GetUserInfoFromAccessToken(accessTokenString string) (string, string, error) {
-	conf := config.Load()
-	refreshToken, err := jwt.Parse(accessTokenString, func(token *jwt.Token) (interface{}, error) { return []byte(conf.ACCES_KEY), nil })
-	if err != nil || !refreshToken.Valid {
-		return "", "", err
-	}
-	claims, ok := refreshToken.Claims.(jwt.MapClaims)
-	if !ok {
+	p, err := ParseAccessToken(accessTokenString)
+	if err != nil {
 		return "", "", err
 	}
-	userID := claims["user_id"].(string)
-	Role := claims["role"].(string)
-
-	return userID, Role, nil
+	return p.UserID, p.Role, nil
 }
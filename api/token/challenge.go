@@ -0,0 +1,81 @@
+package token
+
+import (
+	"context"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+)
+
+const (
+	typeChallenge = "challenge"
+
+	ChallengeTokenTTL = 5 * time.Minute
+)
+
+// Challenge is a login that passed the password check and still has to
+// present a second factor.
+type Challenge struct {
+	ID     string
+	UserID string
+	Role   string
+	HhID   string
+	// Enroll is set when the role requires a second factor the user has not
+	// set up yet.
+	Enroll    bool
+	ExpiresAt time.Time
+}
+
+// GeneratedChallengeToken signs c. The token cannot be used as an access
+// token.
+func GeneratedChallengeToken(c *Challenge) (string, error) {
+	c.ID = uuid.NewString()
+	c.ExpiresAt = time.Now().Add(ChallengeTokenTTL)
+
+	claims := jwt.MapClaims{}
+	claims["typ"] = typeChallenge
+	claims["jti"] = c.ID
+	claims["user_id"] = c.UserID
+	claims["role"] = c.Role
+	claims["hh_id"] = c.HhID
+	claims["enroll"] = c.Enroll
+	claims["iat"] = numericDate(issueTime())
+	claims["exp"] = c.ExpiresAt.Unix()
+
+	return signToken(AccessKeys(), claims)
+}
+
+// ParseChallengeToken verifies raw and rejects challenges already used up,
+// which are put on the denylist.
+func ParseChallengeToken(ctx context.Context, denylist Denylist, raw string) (*Challenge, error) {
+	claims, err := parseToken(raw, AccessKeys(), typeChallenge)
+	if err != nil {
+		return nil, err
+	}
+	if t, _ := (*claims)["typ"].(string); t != typeChallenge {
+		return nil, ErrMissingClaims
+	}
+
+	c := &Challenge{}
+	c.ID, _ = (*claims)["jti"].(string)
+	c.UserID, _ = (*claims)["user_id"].(string)
+	c.Role, _ = (*claims)["role"].(string)
+	c.HhID, _ = (*claims)["hh_id"].(string)
+	c.Enroll, _ = (*claims)["enroll"].(bool)
+	exp, _ := (*claims)["exp"].(float64)
+	iat, _ := (*claims)["iat"].(float64)
+	if c.ID == "" || c.UserID == "" || c.Role == "" {
+		return nil, ErrMissingClaims
+	}
+	c.ExpiresAt = time.Unix(int64(exp), 0)
+
+	revoked, err := denylist.IsRevoked(ctx, c.UserID, fromNumericDate(iat), c.ID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+	return c, nil
+}
@@ -0,0 +1,109 @@
+package token
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// issueResolution is the precision of the issue times of tokens and
+// sessions, and of RevokeUser. Postgres stores times to the microsecond.
+const issueResolution = time.Microsecond
+
+// issueTime is the issue time of a token issued now.
+func issueTime() time.Time {
+	return time.Now().Truncate(issueResolution)
+}
+
+// numericDate encodes t as a JWT NumericDate with a fraction of a second,
+// which RFC 7519 allows, so that "iat" keeps microseconds.
+func numericDate(t time.Time) float64 {
+	return float64(t.UnixMicro()) / 1e6
+}
+
+// fromNumericDate decodes a NumericDate written by numericDate or in whole
+// seconds.
+func fromNumericDate(v float64) time.Time {
+	return time.UnixMicro(int64(math.Round(v * 1e6)))
+}
+
+// Denylist records access tokens, sessions and users whose tokens must no
+// longer be accepted even though they are validly signed and not expired.
+type Denylist interface {
+	// RevokeToken rejects every token carrying id as its jti or session id.
+	RevokeToken(ctx context.Context, id string, expiresAt time.Time) error
+	// RevokeUser rejects every token of userID issued at or before at.
+	// Tokens carry their issue time in microseconds, so at is truncated to
+	// the microsecond: tokens issued earlier in the same second are
+	// rejected, and tokens issued after at are kept. Logging out revokes the
+	// sessions themselves as well.
+	RevokeUser(ctx context.Context, userID string, at time.Time) error
+	IsRevoked(ctx context.Context, userID string, issuedAt time.Time, ids ...string) (bool, error)
+}
+
+type MemoryDenylist struct {
+	mu     sync.Mutex
+	tokens map[string]time.Time
+	users  map[string]time.Time
+}
+
+func NewMemoryDenylist() *MemoryDenylist {
+	return &MemoryDenylist{
+		tokens: make(map[string]time.Time),
+		users:  make(map[string]time.Time),
+	}
+}
+
+func (d *MemoryDenylist) RevokeToken(ctx context.Context, id string, expiresAt time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.purge(time.Now())
+	if expiresAt.After(d.tokens[id]) {
+		d.tokens[id] = expiresAt
+	}
+	return nil
+}
+
+func (d *MemoryDenylist) RevokeUser(ctx context.Context, userID string, at time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.purge(time.Now())
+	at = at.Truncate(issueResolution)
+	if at.After(d.users[userID]) {
+		d.users[userID] = at
+	}
+	return nil
+}
+
+func (d *MemoryDenylist) IsRevoked(ctx context.Context, userID string, issuedAt time.Time, ids ...string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, id := range ids {
+		if _, ok := d.tokens[id]; ok {
+			return true, nil
+		}
+	}
+	if cutoff, ok := d.users[userID]; ok && !issuedAt.After(cutoff) {
+		return true, nil
+	}
+	return false, nil
+}
+
+// purge drops entries that can no longer match a live token. It must be
+// called with mu held.
+func (d *MemoryDenylist) purge(now time.Time) {
+	for id, expires := range d.tokens {
+		if now.After(expires) {
+			delete(d.tokens, id)
+		}
+	}
+	for id, at := range d.users {
+		if now.After(at.Add(RefreshTokenTTL)) {
+			delete(d.users, id)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package token_test
+
+import (
+	"api/api/token"
+	pb "api/genproto/user"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRevokeUserCutoff(t *testing.T) {
+	ctx := context.Background()
+	denylist := token.NewMemoryDenylist()
+	second := time.Now().Truncate(time.Second)
+	if err := denylist.RevokeUser(ctx, "user-1", second.Add(700*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		issuedAt time.Time
+		revoked  bool
+	}{
+		{"issued a second earlier", second.Add(-time.Second), true},
+		{"issued earlier in the same second", second.Add(300 * time.Millisecond), true},
+		{"issued at the cutoff", second.Add(700 * time.Millisecond), true},
+		{"issued later in the same second", second.Add(700*time.Millisecond + time.Microsecond), false},
+		{"issued a second later", second.Add(time.Second), false},
+	}
+	for _, tt := range tests {
+		revoked, err := denylist.IsRevoked(ctx, "user-1", tt.issuedAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if revoked != tt.revoked {
+			t.Errorf("%s: revoked = %v, want %v", tt.name, revoked, tt.revoked)
+		}
+	}
+}
+
+func TestRevokeUserInTheSecondATokenWasIssued(t *testing.T) {
+	ctx := context.Background()
+	denylist := token.NewMemoryDenylist()
+	before := &pb.LoginResponse{Id: "user-1", Role: "student"}
+	if err := token.GeneratedAccessJWTToken(before, "session-1"); err != nil {
+		t.Fatal(err)
+	}
+	p, err := token.ParseAccessToken(before.Access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Log out in the second the token was issued, whatever the clock says.
+	if err := denylist.RevokeUser(ctx, "user-1", p.IssuedAt.Add(time.Microsecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := token.Authenticate(ctx, denylist, before.Access); !errors.Is(err, token.ErrTokenRevoked) {
+		t.Fatalf("token issued before logging out: err = %v, want %v", err, token.ErrTokenRevoked)
+	}
+
+	time.Sleep(time.Millisecond)
+	after := &pb.LoginResponse{Id: "user-1", Role: "student"}
+	if err := token.GeneratedAccessJWTToken(after, "session-2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := token.Authenticate(ctx, denylist, after.Access); err != nil {
+		t.Fatalf("token issued after logging out: %v", err)
+	}
+}
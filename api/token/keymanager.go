@@ -0,0 +1,292 @@
+package token
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// KeyManagerConfig describes where asymmetric signing keys live and how
+// they are rotated.
+type KeyManagerConfig struct {
+	// Alg is RS256 or EdDSA.
+	Alg string
+	// Dir holds one PEM encoded private key per file, named <kid>.pem. The
+	// file modification time is the moment the key becomes the signing key,
+	// so a key can be published ahead of time by dating it in the future.
+	Dir string
+	// RotateEvery makes the manager write a fresh key once the newest one is
+	// older than this. Zero disables automatic rotation.
+	RotateEvery time.Duration
+	// Grace is how long a superseded key keeps verifying tokens. It should
+	// exceed the refresh token lifetime.
+	Grace time.Duration
+	// Reload is how often Dir is rescanned for keys added by operators or by
+	// other replicas.
+	Reload time.Duration
+}
+
+type managedKey struct {
+	kid         string
+	private     crypto.Signer
+	public      crypto.PublicKey
+	activatedAt time.Time
+}
+
+// KeyManager is a KeySet backed by a directory of RSA or Ed25519 keys.
+type KeyManager struct {
+	conf   KeyManagerConfig
+	method jwt.SigningMethod
+	log    *slog.Logger
+
+	mu   sync.RWMutex
+	keys []*managedKey // sorted by activatedAt, newest last
+}
+
+func NewKeyManager(conf KeyManagerConfig, logger *slog.Logger) (*KeyManager, error) {
+	m := &KeyManager{conf: conf, log: logger}
+	switch conf.Alg {
+	case jwt.SigningMethodRS256.Alg():
+		m.method = jwt.SigningMethodRS256
+	case SigningMethodEd25519.Alg():
+		m.method = SigningMethodEd25519
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", conf.Alg)
+	}
+	if err := os.MkdirAll(conf.Dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	if err := m.rotateIfDue(time.Now()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Run rescans the key directory and rotates keys until ctx is done.
+func (m *KeyManager) Run(ctx context.Context) {
+	if m.conf.Reload <= 0 {
+		return
+	}
+	ticker := time.NewTicker(m.conf.Reload)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.Reload(); err != nil {
+				m.log.Error("Error reloading signing keys", "error", err.Error())
+				continue
+			}
+			if err := m.rotateIfDue(time.Now()); err != nil {
+				m.log.Error("Error rotating signing key", "error", err.Error())
+			}
+		}
+	}
+}
+
+// Reload reads every key in the directory, dropping keys whose grace period
+// is over.
+func (m *KeyManager) Reload() error {
+	entries, err := os.ReadDir(m.conf.Dir)
+	if err != nil {
+		return err
+	}
+
+	var keys []*managedKey
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".pem" {
+			continue
+		}
+		path := filepath.Join(m.conf.Dir, entry.Name())
+		key, err := m.loadKey(path)
+		if err != nil {
+			m.log.Warn("Skipping signing key", "file", path, "error", err.Error())
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].activatedAt.Before(keys[j].activatedAt) })
+
+	now := time.Now()
+	live := keys[:0]
+	for i, key := range keys {
+		if i+1 < len(keys) && !keys[i+1].activatedAt.After(now) && now.After(keys[i+1].activatedAt.Add(m.conf.Grace)) {
+			continue
+		}
+		live = append(live, key)
+	}
+
+	m.mu.Lock()
+	m.keys = live
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *KeyManager) loadKey(path string) (*managedKey, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("key cannot sign")
+	}
+	switch signer.(type) {
+	case *rsa.PrivateKey:
+		if m.method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("RSA key does not match algorithm %s", m.conf.Alg)
+		}
+	case ed25519.PrivateKey:
+		if m.method != SigningMethodEd25519 {
+			return nil, fmt.Errorf("Ed25519 key does not match algorithm %s", m.conf.Alg)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", signer)
+	}
+
+	return &managedKey{
+		kid:         strings.TrimSuffix(filepath.Base(path), ".pem"),
+		private:     signer,
+		public:      signer.Public(),
+		activatedAt: info.ModTime(),
+	}, nil
+}
+
+// rotateIfDue writes a new key when there is none yet or when rotation is
+// enabled and the current key is old enough.
+func (m *KeyManager) rotateIfDue(now time.Time) error {
+	m.mu.RLock()
+	var newest *managedKey
+	if len(m.keys) > 0 {
+		newest = m.keys[len(m.keys)-1]
+	}
+	m.mu.RUnlock()
+
+	if newest != nil && (m.conf.RotateEvery <= 0 || now.Before(newest.activatedAt.Add(m.conf.RotateEvery))) {
+		return nil
+	}
+	if err := m.generateKey(now); err != nil {
+		return err
+	}
+	m.log.Info("Generated new signing key", "alg", m.conf.Alg)
+	return m.Reload()
+}
+
+func (m *KeyManager) generateKey(now time.Time) error {
+	var private interface{}
+	var err error
+	if m.method == SigningMethodEd25519 {
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	} else {
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	kid := fmt.Sprintf("%s-%x", now.UTC().Format("20060102T150405"), suffix)
+	path := filepath.Join(m.conf.Dir, kid+".pem")
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+}
+
+func (m *KeyManager) SigningKey() (string, jwt.SigningMethod, interface{}, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	for i := len(m.keys) - 1; i >= 0; i-- {
+		if !m.keys[i].activatedAt.After(now) {
+			return m.keys[i].kid, m.method, m.keys[i].private, nil
+		}
+	}
+	return "", nil, nil, errors.New("no active signing key")
+}
+
+func (m *KeyManager) VerificationKey(t *jwt.Token) (interface{}, error) {
+	if t.Method.Alg() != m.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+	}
+	kid, _ := t.Header["kid"].(string)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, key := range m.keys {
+		if key.kid == kid {
+			return key.public, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+func (m *KeyManager) JWKS() JWKS {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	set := JWKS{Keys: make([]JWK, 0, len(m.keys))}
+	for _, key := range m.keys {
+		jwk := JWK{Kid: key.kid, Use: "sig", Alg: m.method.Alg()}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
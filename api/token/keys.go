@@ -0,0 +1,148 @@
+package token
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	typeAccess  = "access"
+	typeRefresh = "refresh"
+)
+
+var (
+	ErrUnknownKey = errors.New("token signed with an unknown key")
+	ErrNoKeys     = errors.New("signing keys are not configured")
+)
+
+// KeySet signs new tokens and resolves the key that verifies a parsed token.
+type KeySet interface {
+	SigningKey() (kid string, method jwt.SigningMethod, key interface{}, err error)
+	VerificationKey(t *jwt.Token) (interface{}, error)
+	// JWKS returns the public verification keys. Symmetric key sets have none.
+	JWKS() JWKS
+}
+
+// JWK is a public key in JSON Web Key format.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// HMACKeySet signs with a shared secret using HS256.
+type HMACKeySet struct {
+	secret []byte
+}
+
+func NewHMACKeySet(secret string) *HMACKeySet {
+	return &HMACKeySet{secret: []byte(secret)}
+}
+
+func (k *HMACKeySet) SigningKey() (string, jwt.SigningMethod, interface{}, error) {
+	return "", jwt.SigningMethodHS256, k.secret, nil
+}
+
+func (k *HMACKeySet) VerificationKey(t *jwt.Token) (interface{}, error) {
+	if t.Method.Alg() != jwt.SigningMethodHS256.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+	}
+	return k.secret, nil
+}
+
+func (k *HMACKeySet) JWKS() JWKS {
+	return JWKS{Keys: []JWK{}}
+}
+
+// noKeys is in use until UseKeys is called. It neither signs nor verifies.
+type noKeys struct{}
+
+func (noKeys) SigningKey() (string, jwt.SigningMethod, interface{}, error) {
+	return "", nil, nil, ErrNoKeys
+}
+
+func (noKeys) VerificationKey(*jwt.Token) (interface{}, error) {
+	return nil, ErrNoKeys
+}
+
+func (noKeys) JWKS() JWKS {
+	return JWKS{Keys: []JWK{}}
+}
+
+var (
+	keysMu        sync.RWMutex
+	accessKeySet  KeySet = noKeys{}
+	refreshKeySet KeySet = noKeys{}
+)
+
+// UseKeys replaces the key sets access and refresh tokens are signed with.
+// It must be called at startup; until then no token can be issued or
+// verified.
+func UseKeys(access, refresh KeySet) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	accessKeySet = access
+	refreshKeySet = refresh
+}
+
+// AccessKeys returns the key set access tokens are signed with.
+func AccessKeys() KeySet {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	return accessKeySet
+}
+
+func refreshKeys() KeySet {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	return refreshKeySet
+}
+
+func signToken(keys KeySet, claims jwt.MapClaims) (string, error) {
+	kid, method, key, err := keys.SigningKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	return token.SignedString(key)
+}
+
+// parseToken verifies tokenStr with keys. Tokens carrying a typ claim must be
+// of the wanted type, so that a refresh token is never accepted as an access
+// token when both are signed with the same keys.
+func parseToken(tokenStr string, keys KeySet, typ string) (*jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenStr, keys.VerificationKey)
+	// Only a token that is otherwise valid is reported as expired.
+	var verr *jwt.ValidationError
+	if errors.As(err, &verr) && verr.Errors == jwt.ValidationErrorExpired {
+		return nil, ErrTokenExpired
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !(ok && token.Valid) {
+		return nil, errors.New("invalid token")
+	}
+	if t, ok := claims["typ"].(string); ok && t != typ {
+		return nil, fmt.Errorf("expected %s token, got %s", typ, t)
+	}
+
+	return &claims, nil
+}
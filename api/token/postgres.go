@@ -0,0 +1,252 @@
+package token
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PostgresStore persists token state so it survives restarts and is shared
+// by every gateway replica pointing at the same database.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) (*PostgresStore, error) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS refresh_tokens (
+			id         TEXT PRIMARY KEY,
+			family_id  TEXT NOT NULL,
+			user_id    TEXT NOT NULL,
+			role       TEXT NOT NULL,
+			issued_at  TIMESTAMPTZ NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL,
+			used_at    TIMESTAMPTZ
+		);
+		CREATE INDEX IF NOT EXISTS refresh_tokens_family_idx ON refresh_tokens (family_id);
+		CREATE TABLE IF NOT EXISTS refresh_families (
+			id         TEXT PRIMARY KEY,
+			revoked_at TIMESTAMPTZ NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS revoked_tokens (
+			id         TEXT PRIMARY KEY,
+			expires_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS revoked_users (
+			user_id        TEXT PRIMARY KEY,
+			revoked_before TIMESTAMPTZ NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS sessions (
+			id           TEXT PRIMARY KEY,
+			user_id      TEXT NOT NULL,
+			role         TEXT NOT NULL,
+			user_agent   TEXT NOT NULL,
+			ip           TEXT NOT NULL,
+			created_at   TIMESTAMPTZ NOT NULL,
+			last_seen_at TIMESTAMPTZ NOT NULL,
+			expires_at   TIMESTAMPTZ NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS sessions_user_idx ON sessions (user_id);`)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresStore{db: db}, nil
+}
+
+func (s *PostgresStore) Save(ctx context.Context, session *RefreshSession) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (id, family_id, user_id, role, issued_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		session.ID, session.FamilyID, session.UserID, session.Role, session.IssuedAt, session.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE expires_at < now()`)
+	return err
+}
+
+func (s *PostgresStore) Use(ctx context.Context, id string) (*RefreshSession, error) {
+	session := RefreshSession{ID: id}
+	err := s.db.QueryRowContext(ctx, `
+		UPDATE refresh_tokens SET used_at = now()
+		WHERE id = $1 AND used_at IS NULL AND expires_at > now()
+		RETURNING family_id, user_id, role, issued_at, expires_at, used_at`, id).
+		Scan(&session.FamilyID, &session.UserID, &session.Role, &session.IssuedAt, &session.ExpiresAt, &session.UsedAt)
+	if err == nil {
+		return &session, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	var usedAt sql.NullTime
+	err = s.db.QueryRowContext(ctx, `
+		SELECT family_id, user_id, role, issued_at, expires_at, used_at
+		FROM refresh_tokens WHERE id = $1 AND expires_at > now()`, id).
+		Scan(&session.FamilyID, &session.UserID, &session.Role, &session.IssuedAt, &session.ExpiresAt, &usedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRefreshUnknown
+	}
+	if err != nil {
+		return nil, err
+	}
+	session.UsedAt = usedAt.Time
+	return &session, ErrRefreshReused
+}
+
+func (s *PostgresStore) RevokeFamily(ctx context.Context, familyID string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO refresh_families (id, revoked_at, expires_at)
+		SELECT $1, now(), GREATEST(now() + $2 * interval '1 second', COALESCE(MAX(expires_at), now()))
+		FROM refresh_tokens WHERE family_id = $1
+		ON CONFLICT (id) DO NOTHING`, familyID, int64(RefreshTokenTTL/time.Second))
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `DELETE FROM refresh_families WHERE expires_at < now()`)
+	return err
+}
+
+func (s *PostgresStore) FamilyRevoked(ctx context.Context, familyID string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM refresh_families WHERE id = $1)`, familyID).Scan(&exists)
+	return exists, err
+}
+
+func (s *PostgresStore) RevokeToken(ctx context.Context, id string, expiresAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO revoked_tokens (id, expires_at) VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET expires_at = GREATEST(revoked_tokens.expires_at, EXCLUDED.expires_at)`,
+		id, expiresAt)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `DELETE FROM revoked_tokens WHERE expires_at < now()`)
+	return err
+}
+
+func (s *PostgresStore) RevokeUser(ctx context.Context, userID string, at time.Time) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO revoked_users (user_id, revoked_before) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET revoked_before = GREATEST(revoked_users.revoked_before, EXCLUDED.revoked_before)`,
+		userID, at.Truncate(issueResolution))
+	return err
+}
+
+func (s *PostgresStore) IsRevoked(ctx context.Context, userID string, issuedAt time.Time, ids ...string) (bool, error) {
+	var revoked bool
+	err := s.db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE id = ANY($1) AND expires_at > now())
+		    OR EXISTS (SELECT 1 FROM revoked_users WHERE user_id = $2 AND revoked_before >= $3)`,
+		pq.Array(ids), userID, issuedAt).Scan(&revoked)
+	return revoked, err
+}
+
+func (s *PostgresStore) SaveSession(ctx context.Context, session *Session) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO sessions (id, user_id, role, user_agent, ip, created_at, last_seen_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO UPDATE SET user_agent = EXCLUDED.user_agent, ip = EXCLUDED.ip,
+			last_seen_at = EXCLUDED.last_seen_at, expires_at = EXCLUDED.expires_at`,
+		session.ID, session.UserID, session.Role, session.UserAgent, session.IP,
+		session.CreatedAt, session.LastSeenAt, session.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `DELETE FROM sessions WHERE expires_at < now()`)
+	return err
+}
+
+func (s *PostgresStore) TouchSession(ctx context.Context, id, ip, userAgent string, expiresAt time.Time) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE sessions SET ip = $2, user_agent = $3, last_seen_at = now(), expires_at = $4
+		WHERE id = $1`, id, ip, userAgent, expiresAt)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetSession(ctx context.Context, id string) (*Session, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, user_id, role, user_agent, ip, created_at, last_seen_at, expires_at
+		FROM sessions WHERE id = $1 AND expires_at > now()`, id)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := scanSessions(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return nil, ErrSessionNotFound
+	}
+	return sessions[0], nil
+}
+
+func (s *PostgresStore) ListSessions(ctx context.Context, userID string) ([]*Session, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, user_id, role, user_agent, ip, created_at, last_seen_at, expires_at
+		FROM sessions WHERE user_id = $1 AND expires_at > now()
+		ORDER BY last_seen_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanSessions(rows)
+}
+
+func (s *PostgresStore) DeleteSession(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE id = $1`, id)
+	return err
+}
+
+func scanSessions(rows *sql.Rows) ([]*Session, error) {
+	defer rows.Close()
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(&session.ID, &session.UserID, &session.Role, &session.UserAgent, &session.IP,
+			&session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	return sessions, rows.Err()
+}
+
+// Sessions exposes the session table as a SessionStore.
+func (s *PostgresStore) Sessions() SessionStore {
+	return postgresSessions{s}
+}
+
+type postgresSessions struct {
+	s *PostgresStore
+}
+
+func (p postgresSessions) Save(ctx context.Context, session *Session) error {
+	return p.s.SaveSession(ctx, session)
+}
+
+func (p postgresSessions) Touch(ctx context.Context, id, ip, userAgent string, expiresAt time.Time) error {
+	return p.s.TouchSession(ctx, id, ip, userAgent, expiresAt)
+}
+
+func (p postgresSessions) Get(ctx context.Context, id string) (*Session, error) {
+	return p.s.GetSession(ctx, id)
+}
+
+func (p postgresSessions) ListByUser(ctx context.Context, userID string) ([]*Session, error) {
+	return p.s.ListSessions(ctx, userID)
+}
+
+func (p postgresSessions) Delete(ctx context.Context, id string) error {
+	return p.s.DeleteSession(ctx, id)
+}
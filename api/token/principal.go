@@ -0,0 +1,96 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+var (
+	ErrMissingClaims = errors.New("token is missing required claims")
+	ErrTokenRevoked  = errors.New("token has been revoked")
+	ErrTokenExpired  = errors.New("token has expired")
+	// ErrDenylist wraps failures of the denylist, which are not the fault of
+	// the token.
+	ErrDenylist = errors.New("denylist unavailable")
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	UserID    string
+	Role      string
+	TokenID   string
+	SessionID string
+	// APIKeyID is set when the caller is a service account.
+	APIKeyID string
+	// ActorID is the support user acting as UserID while impersonating.
+	ActorID   string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// ParseAccessToken verifies an access token, optionally prefixed with
+// "Bearer ", and returns its principal.
+func ParseAccessToken(raw string) (*Principal, error) {
+	claims, err := ExtractAccesClaim(StripBearer(raw))
+	if err != nil {
+		return nil, err
+	}
+	return principalFromClaims(*claims)
+}
+
+// Authenticate parses raw and rejects it when it is on the denylist.
+func Authenticate(ctx context.Context, denylist Denylist, raw string) (*Principal, error) {
+	p, err := ParseAccessToken(raw)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, 2)
+	for _, id := range []string{p.TokenID, p.SessionID} {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	revoked, err := denylist.IsRevoked(ctx, p.UserID, p.IssuedAt, ids...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDenylist, err)
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+	return p, nil
+}
+
+func StripBearer(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if len(raw) > 7 && strings.EqualFold(raw[:7], "bearer ") {
+		return strings.TrimSpace(raw[7:])
+	}
+	return raw
+}
+
+func principalFromClaims(claims jwt.MapClaims) (*Principal, error) {
+	userID, _ := claims["user_id"].(string)
+	role, _ := claims["role"].(string)
+	exp, ok := claims["exp"].(float64)
+	if userID == "" || role == "" || !ok {
+		return nil, ErrMissingClaims
+	}
+
+	p := &Principal{
+		UserID:    userID,
+		Role:      role,
+		ExpiresAt: time.Unix(int64(exp), 0),
+	}
+	p.TokenID, _ = claims["jti"].(string)
+	p.SessionID, _ = claims["sid"].(string)
+	p.ActorID, _ = claims["act"].(string)
+	if iat, ok := claims["iat"].(float64); ok {
+		p.IssuedAt = fromNumericDate(iat)
+	}
+	return p, nil
+}
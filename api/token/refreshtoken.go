@@ -1,70 +1,131 @@
 package token
 
 import (
-	"api/config"
 	pb "api/genproto/user"
+	"context"
+	"errors"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
 )
 
-func GeneratedRefreshJWTToken(req *pb.LoginResponse) error {
-	conf := config.Load()
-	token := *jwt.New(jwt.SigningMethodHS256)
+const RefreshTokenTTL = 24 * time.Hour
+
+// GeneratedRefreshJWTToken signs a new refresh token for req and returns the
+// session it belongs to. An empty familyID starts a new token family.
+func GeneratedRefreshJWTToken(req *pb.LoginResponse, familyID string) (*RefreshSession, error) {
+	if familyID == "" {
+		familyID = uuid.NewString()
+	}
+	now := issueTime()
+	session := &RefreshSession{
+		ID:        uuid.NewString(),
+		FamilyID:  familyID,
+		UserID:    req.Id,
+		Role:      req.Role,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(RefreshTokenTTL),
+	}
+
 	//payload
-	claims := token.Claims.(jwt.MapClaims)
+	claims := jwt.MapClaims{}
+	claims["typ"] = typeRefresh
+	claims["jti"] = session.ID
+	claims["fid"] = session.FamilyID
 	claims["user_id"] = req.Id
 	claims["role"] = req.Role
-	claims["iat"] = time.Now().Unix()
-	claims["exp"] = time.Now().Add(24 * time.Hour).Unix()
+	claims["iat"] = numericDate(now)
+	claims["exp"] = session.ExpiresAt.Unix()
 
-	newToken, err := token.SignedString([]byte(conf.REFRESH_KEY))
+	newToken, err := signToken(refreshKeys(), claims)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	req.Refresh = newToken
-	return nil
+	return session, nil
 }
 
-func ValidateRefreshToken(tokenStr string) (bool, error) {
-	_, err := ExtractRefreshClaim(tokenStr)
+// IssueRefreshToken signs a refresh token for req and records it in store.
+func IssueRefreshToken(ctx context.Context, store RefreshStore, req *pb.LoginResponse, familyID string) (*RefreshSession, error) {
+	session, err := GeneratedRefreshJWTToken(req, familyID)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	return true, nil
+	if err := store.Save(ctx, session); err != nil {
+		return nil, err
+	}
+	return session, nil
 }
 
-func ExtractRefreshClaim(tokenStr string) (*jwt.MapClaims, error) {
-	conf := config.Load()
-	token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-		return []byte(conf.REFRESH_KEY), nil
-	})
+// IssueTokens starts a new session for req and fills in both tokens.
+func IssueTokens(ctx context.Context, store RefreshStore, req *pb.LoginResponse) (*RefreshSession, error) {
+	session, err := IssueRefreshToken(ctx, store, req, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := GeneratedAccessJWTToken(req, session.FamilyID); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
 
+// RotateRefreshToken exchanges the refresh token in req.Refresh for a new
+// access/refresh pair of the same family. Presenting a refresh token that was
+// already exchanged revokes its whole family, and tokens of sessions or users
+// on the denylist are refused.
+func RotateRefreshToken(ctx context.Context, store RefreshStore, denylist Denylist, req *pb.LoginResponse) (*RefreshSession, error) {
+	claims, err := ExtractRefreshClaim(req.Refresh)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := (*claims)["jti"].(string)
+	if id == "" {
+		return nil, ErrRefreshUnknown
+	}
+
+	session, err := store.Use(ctx, id)
+	if errors.Is(err, ErrRefreshReused) && session != nil {
+		if rerr := store.RevokeFamily(ctx, session.FamilyID); rerr != nil {
+			return nil, rerr
+		}
+		return nil, ErrRefreshReused
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !(ok && token.Valid) {
+	revoked, err := store.FamilyRevoked(ctx, session.FamilyID)
+	if err != nil {
 		return nil, err
 	}
+	if !revoked {
+		revoked, err = denylist.IsRevoked(ctx, session.UserID, session.IssuedAt, session.FamilyID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if revoked {
+		return nil, ErrRefreshRevoked
+	}
 
-	return &claims, nil
+	req.Id = session.UserID
+	req.Role = session.Role
+	if err := GeneratedAccessJWTToken(req, session.FamilyID); err != nil {
+		return nil, err
+	}
+	return IssueRefreshToken(ctx, store, req, session.FamilyID)
 }
 
-func GetUserIdFromRefreshToken(req *pb.LoginResponse) error {
-	conf := config.Load()
-	refreshToken, err := jwt.Parse(req.Refresh, func(token *jwt.Token) (interface{}, error) { return []byte(conf.REFRESH_KEY), nil })
-	if err != nil || !refreshToken.Valid {
-		return err
-	}
-	claims, ok := refreshToken.Claims.(jwt.MapClaims)
-	if !ok {
-		return err
-	}
-	req.Id = claims["user_id"].(string)
-	req.Role = claims["role"].(string)
+func ValidateRefreshToken(tokenStr string) (bool, error) {
+	_, err := ExtractRefreshClaim(tokenStr)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-	return nil
+func ExtractRefreshClaim(tokenStr string) (*jwt.MapClaims, error) {
+	return parseToken(tokenStr, refreshKeys(), typeRefresh)
 }
@@ -0,0 +1,113 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRefreshUnknown = errors.New("refresh token is not known")
+	ErrRefreshReused  = errors.New("refresh token was already used")
+	ErrRefreshRevoked = errors.New("refresh token has been revoked")
+)
+
+// RefreshSession is one issued refresh token. Tokens minted by rotating each
+// other share a FamilyID.
+type RefreshSession struct {
+	ID        string
+	FamilyID  string
+	UserID    string
+	Role      string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	UsedAt    time.Time
+}
+
+// RefreshStore keeps track of issued refresh tokens and revoked families.
+type RefreshStore interface {
+	Save(ctx context.Context, session *RefreshSession) error
+	// Use marks the token as exchanged. If it was exchanged before, the
+	// stored session is returned together with ErrRefreshReused.
+	Use(ctx context.Context, id string) (*RefreshSession, error)
+	RevokeFamily(ctx context.Context, familyID string) error
+	FamilyRevoked(ctx context.Context, familyID string) (bool, error)
+}
+
+type MemoryRefreshStore struct {
+	mu       sync.Mutex
+	sessions map[string]*RefreshSession
+	revoked  map[string]time.Time
+}
+
+func NewMemoryRefreshStore() *MemoryRefreshStore {
+	return &MemoryRefreshStore{
+		sessions: make(map[string]*RefreshSession),
+		revoked:  make(map[string]time.Time),
+	}
+}
+
+func (s *MemoryRefreshStore) Save(ctx context.Context, session *RefreshSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.purge(time.Now())
+	saved := *session
+	s.sessions[session.ID] = &saved
+	return nil
+}
+
+func (s *MemoryRefreshStore) Use(ctx context.Context, id string) (*RefreshSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	session, ok := s.sessions[id]
+	if !ok || now.After(session.ExpiresAt) {
+		return nil, ErrRefreshUnknown
+	}
+	res := *session
+	if !session.UsedAt.IsZero() {
+		return &res, ErrRefreshReused
+	}
+	session.UsedAt = now
+	res.UsedAt = now
+	return &res, nil
+}
+
+func (s *MemoryRefreshStore) RevokeFamily(ctx context.Context, familyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires := time.Now().Add(RefreshTokenTTL)
+	for _, session := range s.sessions {
+		if session.FamilyID == familyID && session.ExpiresAt.After(expires) {
+			expires = session.ExpiresAt
+		}
+	}
+	s.revoked[familyID] = expires
+	return nil
+}
+
+func (s *MemoryRefreshStore) FamilyRevoked(ctx context.Context, familyID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.revoked[familyID]
+	return ok, nil
+}
+
+// purge drops expired sessions and revocations. It must be called with mu held.
+func (s *MemoryRefreshStore) purge(now time.Time) {
+	for id, session := range s.sessions {
+		if now.After(session.ExpiresAt) {
+			delete(s.sessions, id)
+		}
+	}
+	for id, expires := range s.revoked {
+		if now.After(expires) {
+			delete(s.revoked, id)
+		}
+	}
+}
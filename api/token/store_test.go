@@ -0,0 +1,92 @@
+package token_test
+
+import (
+	"api/api/token"
+	pb "api/genproto/user"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func init() {
+	token.UseKeys(token.NewHMACKeySet("access-secret"), token.NewHMACKeySet("refresh-secret"))
+}
+
+func login(t *testing.T, store token.RefreshStore) *pb.LoginResponse {
+	t.Helper()
+	res := &pb.LoginResponse{Id: "user-1", Role: "student"}
+	if _, err := token.IssueTokens(context.Background(), store, res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func rotate(store token.RefreshStore, refresh string) (*pb.LoginResponse, error) {
+	res := &pb.LoginResponse{Refresh: refresh}
+	_, err := token.RotateRefreshToken(context.Background(), store, token.NewMemoryDenylist(), res)
+	return res, err
+}
+
+func TestRotatedTokenIsAcceptedOnce(t *testing.T) {
+	store := token.NewMemoryRefreshStore()
+	first := login(t, store)
+
+	second, err := rotate(store, first.Refresh)
+	if err != nil {
+		t.Fatalf("first rotation: %v", err)
+	}
+	if second.Refresh == "" || second.Refresh == first.Refresh || second.Access == "" {
+		t.Fatal("rotation did not issue new tokens")
+	}
+	if _, err := rotate(store, second.Refresh); err != nil {
+		t.Fatalf("rotating the new token: %v", err)
+	}
+	if _, err := rotate(store, first.Refresh); !errors.Is(err, token.ErrRefreshReused) {
+		t.Fatalf("second use of a rotated token: err = %v, want %v", err, token.ErrRefreshReused)
+	}
+}
+
+func TestReusingRotatedTokenRevokesFamily(t *testing.T) {
+	store := token.NewMemoryRefreshStore()
+	first := login(t, store)
+	second, err := rotate(store, first.Refresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rotate(store, first.Refresh); !errors.Is(err, token.ErrRefreshReused) {
+		t.Fatalf("reuse: err = %v, want %v", err, token.ErrRefreshReused)
+	}
+	// The token issued by the legitimate rotation belongs to the same family
+	// and must be refused too.
+	if _, err := rotate(store, second.Refresh); !errors.Is(err, token.ErrRefreshRevoked) {
+		t.Fatalf("token of the revoked family: err = %v, want %v", err, token.ErrRefreshRevoked)
+	}
+
+	// Other families are untouched.
+	other := login(t, store)
+	if _, err := rotate(store, other.Refresh); err != nil {
+		t.Fatalf("token of another family: %v", err)
+	}
+}
+
+func TestExpiredRefreshTokenIsRejected(t *testing.T) {
+	ctx := context.Background()
+	store := token.NewMemoryRefreshStore()
+	now := time.Now()
+	session := &token.RefreshSession{
+		ID:        "expired",
+		FamilyID:  "family",
+		UserID:    "user-1",
+		Role:      "student",
+		IssuedAt:  now.Add(-2 * token.RefreshTokenTTL),
+		ExpiresAt: now.Add(-time.Minute),
+	}
+	if err := store.Save(ctx, session); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Use(ctx, session.ID); !errors.Is(err, token.ErrRefreshUnknown) {
+		t.Fatalf("err = %v, want %v", err, token.ErrRefreshUnknown)
+	}
+}
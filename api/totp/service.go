@@ -0,0 +1,199 @@
+package totp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotEnrolled     = errors.New("two-factor authentication is not enabled")
+	ErrAlreadyEnrolled = errors.New("two-factor authentication is already enabled")
+	ErrInvalidCode     = errors.New("invalid two-factor code")
+)
+
+const recoveryCodeCount = 10
+
+// Enrollment is the second factor of one user. It only protects logins once
+// it is confirmed with a first valid code.
+type Enrollment struct {
+	UserID    string
+	Secret    string
+	Confirmed bool
+	// RecoveryHashes are the sha256 hashes of the unused recovery codes.
+	RecoveryHashes []string
+	// LastCounter is the time step of the last accepted code; it and older
+	// steps are refused to stop replays.
+	LastCounter int64
+	CreatedAt   time.Time
+}
+
+type Store interface {
+	Get(ctx context.Context, userID string) (*Enrollment, error)
+	Save(ctx context.Context, e *Enrollment) error
+	// Confirm confirms the enrolment of userID at counter if it is still
+	// unconfirmed with secret. It reports whether it did.
+	Confirm(ctx context.Context, userID, secret string, counter int64) (bool, error)
+	// UseCounter moves the last accepted time step of the confirmed
+	// enrolment of userID to counter if it is still older. It reports
+	// whether it did.
+	UseCounter(ctx context.Context, userID string, counter int64) (bool, error)
+	// UseRecoveryCode removes hash from the recovery codes of the confirmed
+	// enrolment of userID. It reports whether hash was there.
+	UseRecoveryCode(ctx context.Context, userID, hash string) (bool, error)
+	Delete(ctx context.Context, userID string) error
+}
+
+// Setup is handed to the user once when they enrol.
+type Setup struct {
+	Secret        string   `json:"secret"`
+	URI           string   `json:"uri"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type Service struct {
+	store  Store
+	issuer string
+	// required lists the roles that may not log in without a second factor.
+	required map[string]bool
+}
+
+func NewService(store Store, issuer string, requiredRoles []string) *Service {
+	s := &Service{store: store, issuer: issuer, required: make(map[string]bool)}
+	for _, role := range requiredRoles {
+		if role = strings.TrimSpace(role); role != "" {
+			s.required[role] = true
+		}
+	}
+	return s
+}
+
+// Required reports whether role must use a second factor.
+func (s *Service) Required(role string) bool {
+	return s.required[role]
+}
+
+// Enabled reports whether userID has a confirmed second factor.
+func (s *Service) Enabled(ctx context.Context, userID string) (bool, error) {
+	e, err := s.store.Get(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	return e != nil && e.Confirmed, nil
+}
+
+// Enroll starts enrolment of userID, replacing an unconfirmed one. account
+// is the label shown in the authenticator app.
+func (s *Service) Enroll(ctx context.Context, userID, account string) (*Setup, error) {
+	prev, err := s.store.Get(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if prev != nil && prev.Confirmed {
+		return nil, ErrAlreadyEnrolled
+	}
+
+	secret, err := GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+	codes, hashes, err := recoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	e := &Enrollment{
+		UserID:         userID,
+		Secret:         secret,
+		RecoveryHashes: hashes,
+		CreatedAt:      time.Now(),
+	}
+	if err := s.store.Save(ctx, e); err != nil {
+		return nil, err
+	}
+	return &Setup{Secret: secret, URI: ProvisioningURI(s.issuer, account, secret), RecoveryCodes: codes}, nil
+}
+
+// Confirm enables the pending enrolment of userID once code matches.
+func (s *Service) Confirm(ctx context.Context, userID, code string) error {
+	e, err := s.store.Get(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		return ErrNotEnrolled
+	}
+	if e.Confirmed {
+		return ErrAlreadyEnrolled
+	}
+	counter, ok := Match(e.Secret, code, time.Now())
+	if !ok {
+		return ErrInvalidCode
+	}
+	confirmed, err := s.store.Confirm(ctx, userID, e.Secret, counter)
+	if err != nil {
+		return err
+	}
+	if !confirmed {
+		// A concurrent confirmation or a new enrolment came first.
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// Verify checks a code from the authenticator app or, failing that, one of
+// the recovery codes, which is then used up. Each code is accepted once,
+// even by concurrent calls.
+func (s *Service) Verify(ctx context.Context, userID, code string) error {
+	e, err := s.store.Get(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if e == nil || !e.Confirmed {
+		return ErrNotEnrolled
+	}
+
+	var used bool
+	if counter, ok := Match(e.Secret, code, time.Now()); ok {
+		used, err = s.store.UseCounter(ctx, userID, counter)
+	} else {
+		used, err = s.store.UseRecoveryCode(ctx, userID, hashRecoveryCode(code))
+	}
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// Disable removes the second factor of userID.
+func (s *Service) Disable(ctx context.Context, userID string) error {
+	return s.store.Delete(ctx, userID)
+}
+
+func recoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		s := hex.EncodeToString(b)
+		codes[i] = fmt.Sprintf("%s-%s", s[:5], s[5:])
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
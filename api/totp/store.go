@@ -0,0 +1,176 @@
+package totp
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+type MemoryStore struct {
+	mu          sync.Mutex
+	enrollments map[string]*Enrollment
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{enrollments: make(map[string]*Enrollment)}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, userID string) (*Enrollment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.enrollments[userID]
+	if !ok {
+		return nil, nil
+	}
+	res := *e
+	res.RecoveryHashes = append([]string(nil), e.RecoveryHashes...)
+	return &res, nil
+}
+
+func (s *MemoryStore) Save(ctx context.Context, e *Enrollment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	saved := *e
+	saved.RecoveryHashes = append([]string(nil), e.RecoveryHashes...)
+	s.enrollments[e.UserID] = &saved
+	return nil
+}
+
+func (s *MemoryStore) Confirm(ctx context.Context, userID, secret string, counter int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.enrollments[userID]
+	if !ok || e.Confirmed || e.Secret != secret {
+		return false, nil
+	}
+	e.Confirmed = true
+	e.LastCounter = counter
+	return true, nil
+}
+
+func (s *MemoryStore) UseCounter(ctx context.Context, userID string, counter int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.enrollments[userID]
+	if !ok || !e.Confirmed || e.LastCounter >= counter {
+		return false, nil
+	}
+	e.LastCounter = counter
+	return true, nil
+}
+
+func (s *MemoryStore) UseRecoveryCode(ctx context.Context, userID, hash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.enrollments[userID]
+	if !ok || !e.Confirmed {
+		return false, nil
+	}
+	i := slices.Index(e.RecoveryHashes, hash)
+	if i < 0 {
+		return false, nil
+	}
+	e.RecoveryHashes = slices.Delete(e.RecoveryHashes, i, i+1)
+	return true, nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.enrollments, userID)
+	return nil
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) (*PostgresStore, error) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS totp_enrollments (
+			user_id         TEXT PRIMARY KEY,
+			secret          TEXT NOT NULL,
+			confirmed       BOOLEAN NOT NULL,
+			recovery_hashes TEXT[] NOT NULL DEFAULT '{}',
+			last_counter    BIGINT NOT NULL,
+			created_at      TIMESTAMPTZ NOT NULL
+		)`)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresStore{db: db}, nil
+}
+
+func (s *PostgresStore) Get(ctx context.Context, userID string) (*Enrollment, error) {
+	e := Enrollment{UserID: userID}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT secret, confirmed, recovery_hashes, last_counter, created_at
+		FROM totp_enrollments WHERE user_id = $1`, userID).
+		Scan(&e.Secret, &e.Confirmed, pq.Array(&e.RecoveryHashes), &e.LastCounter, &e.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (s *PostgresStore) Save(ctx context.Context, e *Enrollment) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO totp_enrollments (user_id, secret, confirmed, recovery_hashes, last_counter, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, confirmed = EXCLUDED.confirmed,
+			recovery_hashes = EXCLUDED.recovery_hashes, last_counter = EXCLUDED.last_counter, created_at = EXCLUDED.created_at`,
+		e.UserID, e.Secret, e.Confirmed, pq.Array(e.RecoveryHashes), e.LastCounter, e.CreatedAt)
+	return err
+}
+
+func (s *PostgresStore) Confirm(ctx context.Context, userID, secret string, counter int64) (bool, error) {
+	return s.update(ctx, `
+		UPDATE totp_enrollments SET confirmed = TRUE, last_counter = $3
+		WHERE user_id = $1 AND secret = $2 AND NOT confirmed`,
+		userID, secret, counter)
+}
+
+func (s *PostgresStore) UseCounter(ctx context.Context, userID string, counter int64) (bool, error) {
+	return s.update(ctx, `
+		UPDATE totp_enrollments SET last_counter = $2
+		WHERE user_id = $1 AND confirmed AND last_counter < $2`,
+		userID, counter)
+}
+
+func (s *PostgresStore) UseRecoveryCode(ctx context.Context, userID, hash string) (bool, error) {
+	return s.update(ctx, `
+		UPDATE totp_enrollments SET recovery_hashes = array_remove(recovery_hashes, $2)
+		WHERE user_id = $1 AND confirmed AND $2 = ANY(recovery_hashes)`,
+		userID, hash)
+}
+
+// update runs a conditional update and reports whether it changed a row.
+func (s *PostgresStore) update(ctx context.Context, query string, args ...any) (bool, error) {
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (s *PostgresStore) Delete(ctx context.Context, userID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM totp_enrollments WHERE user_id = $1`, userID)
+	return err
+}
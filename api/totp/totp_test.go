@@ -0,0 +1,117 @@
+package totp_test
+
+import (
+	"api/api/totp"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 seed of the RFC 6238 test vectors,
+// "12345678901234567890", in base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeMatchesRFC6238(t *testing.T) {
+	// The RFC lists 8 digit codes; 6 digit codes are their last 6 digits.
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		code, err := totp.Code(rfcSecret, totp.Counter(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("code at %d = %s, want %s", tt.unix, code, tt.code)
+		}
+	}
+}
+
+func TestMatchAllowsSkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := totp.Counter(now)
+	for step := int64(-totp.Skew - 1); step <= totp.Skew+1; step++ {
+		code, err := totp.Code(rfcSecret, current+step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counter, ok := totp.Match(rfcSecret, code, now)
+		want := step >= -totp.Skew && step <= totp.Skew
+		if ok != want {
+			t.Errorf("code %d steps away: ok = %v, want %v", step, ok, want)
+		}
+		if ok && counter != current+step {
+			t.Errorf("code %d steps away: counter = %d, want %d", step, counter, current+step)
+		}
+	}
+}
+
+func enrolled(t *testing.T) (*totp.Service, []string, string) {
+	t.Helper()
+	ctx := context.Background()
+	s := totp.NewService(totp.NewMemoryStore(), "test", nil)
+	setup, err := s.Enroll(ctx, "user-1", "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := totp.Code(setup.Secret, totp.Counter(time.Now())-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Confirm(ctx, "user-1", code); err != nil {
+		t.Fatal(err)
+	}
+	return s, setup.RecoveryCodes, setup.Secret
+}
+
+// acceptedOnce verifies code from many goroutines at once and fails unless
+// exactly one is accepted.
+func acceptedOnce(t *testing.T, s *totp.Service, code string) {
+	t.Helper()
+	var accepted atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			switch err := s.Verify(context.Background(), "user-1", code); {
+			case err == nil:
+				accepted.Add(1)
+			case !errors.Is(err, totp.ErrInvalidCode):
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := accepted.Load(); n != 1 {
+		t.Fatalf("code accepted %d times, want once", n)
+	}
+}
+
+func TestCodeIsAcceptedOnce(t *testing.T) {
+	s, _, secret := enrolled(t)
+	code, err := totp.Code(secret, totp.Counter(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acceptedOnce(t, s, code)
+}
+
+func TestRecoveryCodeIsAcceptedOnce(t *testing.T) {
+	s, recovery, _ := enrolled(t)
+	acceptedOnce(t, s, recovery[0])
+	if err := s.Verify(context.Background(), "user-1", recovery[1]); err != nil {
+		t.Fatalf("another recovery code: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer/leastrequest"
+	"google.golang.org/grpc/balancer/roundrobin"
+	_ "google.golang.org/grpc/health"
+	"google.golang.org/grpc/resolver"
+)
+
+// Balancers are the ways calls are spread over the endpoints of an upstream:
+// in turn, or to the endpoint with the fewest calls in flight.
+const (
+	RoundRobin   = "round_robin"
+	LeastRequest = "least_request"
+)
+
+// staticScheme is the scheme of targets that list their endpoints, such as
+// "static:///10.0.0.1:50053,10.0.0.2:50053".
+const staticScheme = "static"
+
+func init() {
+	resolver.Register(staticBuilder{})
+}
+
+// Target turns an upstream setting into a gRPC target. A setting is one
+// address, a comma separated list of addresses, or a target with a scheme
+// such as "dns:///question:50053", which is resolved again as the records
+// change.
+func Target(setting string) (string, error) {
+	if strings.Contains(setting, "://") {
+		return setting, nil
+	}
+	addrs := strings.Split(setting, ",")
+	for i, addr := range addrs {
+		addrs[i] = strings.TrimSpace(addr)
+		if addrs[i] == "" {
+			return "", fmt.Errorf("%q has an empty address", setting)
+		}
+	}
+	if len(addrs) == 1 {
+		return addrs[0], nil
+	}
+	return staticScheme + ":///" + strings.Join(addrs, ","), nil
+}
+
+// Balance returns the dial options that spread calls over the endpoints of
+// an upstream with balancer. With healthCheck, endpoints are checked with the
+// gRPC health protocol and get no calls while they are not serving. Servers
+// that do not implement it count as serving.
+func Balance(balancer string, healthCheck bool) ([]grpc.DialOption, error) {
+	var lb string
+	switch balancer {
+	case RoundRobin:
+		lb = fmt.Sprintf(`{%q: {}}`, roundrobin.Name)
+	case LeastRequest:
+		lb = fmt.Sprintf(`{%q: {"choiceCount": 2}}`, leastrequest.Name)
+	default:
+		return nil, fmt.Errorf("%q is not one of %s or %s", balancer, RoundRobin, LeastRequest)
+	}
+	config := `{"loadBalancingConfig": [` + lb + `]`
+	if healthCheck {
+		config += `, "healthCheckConfig": {"serviceName": ""}`
+	}
+	config += `}`
+	return []grpc.DialOption{
+		grpc.WithDefaultServiceConfig(config),
+		// Service configs published in DNS would replace the balancer.
+		grpc.WithDisableServiceConfig(),
+	}, nil
+}
+
+// staticBuilder resolves static targets to the endpoints they list.
+type staticBuilder struct{}
+
+func (staticBuilder) Scheme() string { return staticScheme }
+
+func (staticBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	// The round_robin and least_request balancers still read Addresses.
+	var state resolver.State
+	for _, addr := range strings.Split(target.Endpoint(), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			state.Addresses = append(state.Addresses, resolver.Address{Addr: addr})
+			state.Endpoints = append(state.Endpoints, resolver.Endpoint{Addresses: []resolver.Address{{Addr: addr}}})
+		}
+	}
+	if len(state.Addresses) == 0 {
+		return nil, errors.New("static target lists no address")
+	}
+	if err := cc.UpdateState(state); err != nil {
+		return nil, err
+	}
+	return staticResolver{}, nil
+}
+
+// staticResolver has nothing to resolve again.
+type staticResolver struct{}
+
+func (staticResolver) ResolveNow(resolver.ResolveNowOptions) {}
+func (staticResolver) Close()                                {}
@@ -0,0 +1,139 @@
+package upstream_test
+
+import (
+	"api/api/upstream"
+	pb "api/genproto/user"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// endpoint is an in-process users service with the gRPC health protocol.
+type endpoint struct {
+	users  *fakeUsers
+	health *health.Server
+	addr   string
+}
+
+func startEndpoints(t *testing.T, n int) []*endpoint {
+	t.Helper()
+	endpoints := make([]*endpoint, n)
+	for i := range endpoints {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := &endpoint{users: &fakeUsers{}, health: health.NewServer(), addr: lis.Addr().String()}
+		srv := grpc.NewServer()
+		pb.RegisterUsersServer(srv, e.users)
+		healthpb.RegisterHealthServer(srv, e.health)
+		go srv.Serve(lis)
+		t.Cleanup(srv.Stop)
+		endpoints[i] = e
+	}
+	return endpoints
+}
+
+// dialBalanced dials every endpoint as one upstream, the way the gateway
+// dials a comma separated setting.
+func dialBalanced(t *testing.T, balancer string, endpoints []*endpoint) pb.UsersClient {
+	t.Helper()
+	addrs := make([]string, len(endpoints))
+	for i, e := range endpoints {
+		addrs[i] = e.addr
+	}
+	target, err := upstream.Target(strings.Join(addrs, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := upstream.Balance(balancer, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewUsersClient(conn)
+}
+
+// spread makes n calls and returns how many reached each endpoint.
+func spread(t *testing.T, client pb.UsersClient, endpoints []*endpoint, n int) []int32 {
+	t.Helper()
+	before := make([]int32, len(endpoints))
+	for i, e := range endpoints {
+		before[i] = e.users.calls.Load()
+	}
+	for i := 0; i < n; i++ {
+		if err := call(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := make([]int32, len(endpoints))
+	for i, e := range endpoints {
+		got[i] = e.users.calls.Load() - before[i]
+	}
+	return got
+}
+
+// eventually retries cond until it holds or a few seconds have passed.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestBalancersSpreadCalls(t *testing.T) {
+	for _, balancer := range []string{upstream.RoundRobin, upstream.LeastRequest} {
+		t.Run(balancer, func(t *testing.T) {
+			endpoints := startEndpoints(t, 3)
+			client := dialBalanced(t, balancer, endpoints)
+
+			// Endpoints join as their connections become ready.
+			eventually(t, "every endpoint gets calls", func() bool {
+				return !slices.Contains(spread(t, client, endpoints, 30), 0)
+			})
+		})
+	}
+}
+
+func TestNotServingEndpointIsEjectedAndReadmitted(t *testing.T) {
+	for _, balancer := range []string{upstream.RoundRobin, upstream.LeastRequest} {
+		t.Run(balancer, func(t *testing.T) {
+			endpoints := startEndpoints(t, 3)
+			client := dialBalanced(t, balancer, endpoints)
+			eventually(t, "every endpoint gets calls", func() bool {
+				return !slices.Contains(spread(t, client, endpoints, 30), 0)
+			})
+
+			sick := endpoints[1]
+			sick.health.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+			eventually(t, "the endpoint that is not serving gets no calls", func() bool {
+				return spread(t, client, endpoints, 30)[1] == 0
+			})
+			got := spread(t, client, endpoints, 30)
+			if got[1] != 0 || got[0] == 0 || got[2] == 0 {
+				t.Fatalf("calls per endpoint = %v, want none on endpoint 1 only", got)
+			}
+
+			sick.health.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+			eventually(t, "the recovered endpoint gets calls again", func() bool {
+				return spread(t, client, endpoints, 30)[1] > 0
+			})
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// Breaker states.
+const (
+	Closed   = "closed"
+	Open     = "open"
+	HalfOpen = "half_open"
+)
+
+// BreakerConfig sets when a breaker opens and how it recovers.
+type BreakerConfig struct {
+	// Window is the period calls are counted over before the counts start
+	// again.
+	Window time.Duration
+	// MinCalls is the number of calls in a window below which the breaker
+	// does not open.
+	MinCalls int
+	// ErrorRate is the share of failed calls, from 0 to 1, that opens the
+	// breaker.
+	ErrorRate float64
+	// SlowCall is the duration above which a call counts as slow, and
+	// SlowRate the share of slow calls that opens the breaker.
+	SlowCall time.Duration
+	SlowRate float64
+	// OpenFor is how long the breaker fails calls before it lets Probes calls
+	// through, at least one. It closes when they all succeed.
+	OpenFor time.Duration
+	Probes  int
+}
+
+// BreakerState is a snapshot of a breaker.
+type BreakerState struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+	// Calls, Failures and Slow are counted since WindowStart.
+	Calls       int       `json:"calls"`
+	Failures    int       `json:"failures"`
+	Slow        int       `json:"slow"`
+	WindowStart time.Time `json:"window_start"`
+	// OpenedAt and RetryAt are set while the breaker is not closed.
+	OpenedAt time.Time `json:"opened_at,omitempty"`
+	RetryAt  time.Time `json:"retry_at,omitempty"`
+}
+
+// Breaker stops calls to an upstream that keeps failing or is too slow, so
+// that callers fail fast instead of waiting for a timeout.
+type Breaker struct {
+	name string
+
+	mu          sync.Mutex
+	conf        BreakerConfig
+	state       string
+	calls       int
+	failures    int
+	slow        int
+	windowStart time.Time
+	openedAt    time.Time
+	probes      int
+	passed      int
+}
+
+func NewBreaker(name string, conf BreakerConfig) *Breaker {
+	return &Breaker{name: name, conf: conf, state: Closed, windowStart: time.Now()}
+}
+
+func (b *Breaker) Name() string { return b.name }
+
+// SetConfig replaces the thresholds. The state is kept.
+func (b *Breaker) SetConfig(conf BreakerConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conf = conf
+}
+
+// State returns a snapshot of the breaker.
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(time.Now())
+	res := BreakerState{
+		Name:        b.name,
+		State:       b.state,
+		Calls:       b.calls,
+		Failures:    b.failures,
+		Slow:        b.slow,
+		WindowStart: b.windowStart,
+	}
+	if b.state != Closed {
+		res.OpenedAt = b.openedAt
+		res.RetryAt = b.openedAt.Add(b.conf.OpenFor)
+	}
+	return res
+}
+
+// Ready reports whether calls may be made now, and otherwise when to try
+// again. It does not take one of the calls allowed while half-open.
+func (b *Breaker) Ready() (bool, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(time.Now())
+	if b.state == Open {
+		return false, b.openedAt.Add(b.conf.OpenFor)
+	}
+	return true, time.Time{}
+}
+
+// advance moves an open breaker to half-open once OpenFor has passed, and
+// starts a new window when the current one is over. b.mu must be held.
+func (b *Breaker) advance(now time.Time) {
+	if b.state == Open && now.Sub(b.openedAt) >= b.conf.OpenFor {
+		b.state = HalfOpen
+		b.probes, b.passed = 0, 0
+	}
+	if b.state == Closed && now.Sub(b.windowStart) >= b.conf.Window {
+		b.calls, b.failures, b.slow = 0, 0, 0
+		b.windowStart = now
+	}
+}
+
+// probeCount is the number of calls let through while half-open. Without
+// one the breaker would never close again. b.mu must be held.
+func (b *Breaker) probeCount() int {
+	return max(1, b.conf.Probes)
+}
+
+// allow takes permission for one call.
+func (b *Breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(time.Now())
+	switch b.state {
+	case Open:
+		return false
+	case HalfOpen:
+		if b.probes >= b.probeCount() {
+			return false
+		}
+		b.probes++
+	}
+	return true
+}
+
+// done records the outcome of an allowed call.
+func (b *Breaker) done(failed bool, elapsed time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	slow := b.conf.SlowCall > 0 && elapsed > b.conf.SlowCall
+
+	if b.state == HalfOpen {
+		if failed || slow {
+			b.open(now)
+			return
+		}
+		b.passed++
+		if b.passed >= b.probeCount() {
+			b.state = Closed
+			b.calls, b.failures, b.slow = 0, 0, 0
+			b.windowStart = now
+		}
+		return
+	}
+	if b.state != Closed {
+		return
+	}
+
+	b.calls++
+	if failed {
+		b.failures++
+	}
+	if slow {
+		b.slow++
+	}
+	if b.calls < b.conf.MinCalls {
+		return
+	}
+	calls := float64(b.calls)
+	if float64(b.failures)/calls >= b.conf.ErrorRate || (b.conf.SlowCall > 0 && float64(b.slow)/calls >= b.conf.SlowRate) {
+		b.open(now)
+	}
+}
+
+func (b *Breaker) open(now time.Time) {
+	b.state = Open
+	b.openedAt = now
+}
+
+// failure reports whether err means the upstream is unhealthy. Application
+// errors are not failures, even Internal and Unknown, which services such as
+// the user service also answer wrong passwords with; otherwise callers could
+// open the breaker for everyone with bad requests.
+func failure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// Unary returns the interceptor to dial with. It must come before the
+// Interceptor, so that a call and its retries count once. Health checks go
+// through without being counted, so that they report the service itself
+// even while the breaker is open.
+func (b *Breaker) Unary() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if method == healthpb.Health_Check_FullMethodName {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		if !b.allow() {
+			return status.Error(codes.Unavailable, fmt.Sprintf("circuit breaker of the %s service is open", b.name))
+		}
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		b.done(failure(err), time.Since(start))
+		return err
+	}
+}
@@ -0,0 +1,198 @@
+package upstream_test
+
+import (
+	"api/api/upstream"
+	pb "api/genproto/user"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Behaviours of fakeUsers.
+const (
+	serve int32 = iota
+	fail
+	stall
+	reject
+)
+
+const slowCall = 50 * time.Millisecond
+
+// fakeUsers answers GetProfile as told by mode and counts the calls that
+// reached it. In reject mode it answers with the application error code.
+type fakeUsers struct {
+	pb.UnimplementedUsersServer
+	mode  atomic.Int32
+	calls atomic.Int32
+	code  atomic.Uint32
+}
+
+func (f *fakeUsers) GetProfile(ctx context.Context, _ *pb.GetProfileRequest) (*pb.GetProfileResponse, error) {
+	f.calls.Add(1)
+	switch f.mode.Load() {
+	case fail:
+		return nil, status.Error(codes.Unavailable, "down")
+	case stall:
+		time.Sleep(2 * slowCall)
+	case reject:
+		return nil, status.Error(codes.Code(f.code.Load()), "rejected")
+	}
+	return &pb.GetProfileResponse{}, nil
+}
+
+// dialBreaker serves fake over bufconn and returns a client whose calls go
+// through breaker.
+func dialBreaker(t *testing.T, fake *fakeUsers, breaker *upstream.Breaker) pb.UsersClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	pb.RegisterUsersServer(srv, fake)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(breaker.Unary()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewUsersClient(conn)
+}
+
+func breakerConfig(probes int) upstream.BreakerConfig {
+	return upstream.BreakerConfig{
+		Window:    time.Minute,
+		MinCalls:  2,
+		ErrorRate: 0.5,
+		SlowCall:  slowCall,
+		SlowRate:  0.5,
+		OpenFor:   100 * time.Millisecond,
+		Probes:    probes,
+	}
+}
+
+func call(client pb.UsersClient) error {
+	_, err := client.GetProfile(context.Background(), &pb.GetProfileRequest{Id: "user-1"})
+	return err
+}
+
+func wantState(t *testing.T, breaker *upstream.Breaker, want string) {
+	t.Helper()
+	if got := breaker.State().State; got != want {
+		t.Fatalf("state = %s, want %s", got, want)
+	}
+}
+
+// tripAndRecover opens breaker with calls that behave like mode, then checks
+// that it fails fast, half-opens after OpenFor and closes once probes calls
+// succeed.
+func tripAndRecover(t *testing.T, mode int32, probes int) {
+	fake := &fakeUsers{}
+	breaker := upstream.NewBreaker("user", breakerConfig(probes))
+	client := dialBreaker(t, fake, breaker)
+
+	if err := call(client); err != nil {
+		t.Fatal(err)
+	}
+	wantState(t, breaker, upstream.Closed)
+
+	fake.mode.Store(mode)
+	for breaker.State().State == upstream.Closed {
+		if fake.calls.Load() > 10 {
+			t.Fatal("breaker did not open")
+		}
+		call(client)
+	}
+	wantState(t, breaker, upstream.Open)
+
+	reached := fake.calls.Load()
+	if err := call(client); status.Code(err) != codes.Unavailable {
+		t.Fatalf("call while open: err = %v, want Unavailable", err)
+	}
+	if fake.calls.Load() != reached {
+		t.Fatal("call reached the server while the breaker was open")
+	}
+
+	time.Sleep(breakerConfig(probes).OpenFor)
+	wantState(t, breaker, upstream.HalfOpen)
+
+	// A probe that fails again opens the breaker again.
+	call(client)
+	wantState(t, breaker, upstream.Open)
+	time.Sleep(breakerConfig(probes).OpenFor)
+	wantState(t, breaker, upstream.HalfOpen)
+
+	fake.mode.Store(serve)
+	for i := 0; i < max(1, probes); i++ {
+		if err := call(client); err != nil {
+			t.Fatalf("probe %d: %v", i+1, err)
+		}
+	}
+	wantState(t, breaker, upstream.Closed)
+}
+
+func TestBreakerOpensOnFailures(t *testing.T) {
+	tripAndRecover(t, fail, 2)
+}
+
+func TestBreakerOpensOnSlowCalls(t *testing.T) {
+	tripAndRecover(t, stall, 2)
+}
+
+func TestBreakerWithoutProbesStillCloses(t *testing.T) {
+	tripAndRecover(t, fail, 0)
+}
+
+func TestApplicationErrorsDoNotOpenBreaker(t *testing.T) {
+	for _, code := range []codes.Code{codes.Internal, codes.Unknown, codes.InvalidArgument, codes.NotFound, codes.Unauthenticated} {
+		fake := &fakeUsers{}
+		fake.mode.Store(reject)
+		fake.code.Store(uint32(code))
+		breaker := upstream.NewBreaker("user", breakerConfig(1))
+		client := dialBreaker(t, fake, breaker)
+
+		for i := 0; i < 20; i++ {
+			if err := call(client); status.Code(err) != code {
+				t.Fatalf("%s: err = %v, want the application error", code, err)
+			}
+		}
+		if state := breaker.State().State; state != upstream.Closed {
+			t.Errorf("%s: state = %s after 20 errors, want %s", code, state, upstream.Closed)
+		}
+	}
+}
+
+func TestHalfOpenBreakerLimitsProbes(t *testing.T) {
+	fake := &fakeUsers{}
+	breaker := upstream.NewBreaker("user", breakerConfig(1))
+	client := dialBreaker(t, fake, breaker)
+
+	fake.mode.Store(fail)
+	call(client)
+	call(client)
+	wantState(t, breaker, upstream.Open)
+	time.Sleep(breakerConfig(1).OpenFor)
+
+	// The probe stalls; a second call made meanwhile is refused.
+	fake.mode.Store(stall)
+	done := make(chan error, 1)
+	go func() { done <- call(client) }()
+	for fake.calls.Load() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := call(client); status.Code(err) != codes.Unavailable {
+		t.Fatalf("second call while half-open: err = %v, want Unavailable", err)
+	}
+	<-done
+}
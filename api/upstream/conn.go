@@ -0,0 +1,77 @@
+package upstream
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// drainAfter is how long a replaced connection stays open for the calls
+// and streams still using it.
+const drainAfter = time.Minute
+
+// Conn is a gRPC client connection whose target can be changed while
+// clients use it. Clients are created once from a Conn and follow its
+// changes.
+type Conn struct {
+	opts []grpc.DialOption
+
+	mu      sync.Mutex
+	target  string
+	current atomic.Pointer[grpc.ClientConn]
+}
+
+var _ grpc.ClientConnInterface = (*Conn)(nil)
+
+// Dial connects lazily to target. opts are kept for the connections made
+// when the target changes.
+func Dial(target string, opts ...grpc.DialOption) (*Conn, error) {
+	cc, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{opts: opts, target: target}
+	c.current.Store(cc)
+	return c, nil
+}
+
+// Target returns the address calls are sent to.
+func (c *Conn) Target() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.target
+}
+
+// SetTarget sends new calls to target. Calls and streams already started
+// finish on the old connection, which is closed after drainAfter.
+func (c *Conn) SetTarget(target string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if target == c.target {
+		return nil
+	}
+	cc, err := grpc.NewClient(target, c.opts...)
+	if err != nil {
+		return err
+	}
+	old := c.current.Swap(cc)
+	c.target = target
+	time.AfterFunc(drainAfter, func() { old.Close() })
+	return nil
+}
+
+func (c *Conn) Invoke(ctx context.Context, method string, args, reply interface{}, opts ...grpc.CallOption) error {
+	return c.current.Load().Invoke(ctx, method, args, reply, opts...)
+}
+
+func (c *Conn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return c.current.Load().NewStream(ctx, desc, method, opts...)
+}
+
+// Close closes the current connection.
+func (c *Conn) Close() error {
+	return c.current.Load().Close()
+}
@@ -0,0 +1,227 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// reads are the idempotent calls, which are retried. Other calls may change
+// state, and a call that timed out may still have been applied, so they are
+// never retried.
+var reads = map[string]bool{
+	"/group.GroupService/GetAllGroups":                          true,
+	"/group.GroupService/GetGroupById":                          true,
+	"/group.GroupService/GetGroupStudents":                      true,
+	"/group.GroupService/GetStudentGroups":                      true,
+	"/group.GroupService/GetTeacherGroups":                      true,
+	"/notification.Notifications/GetAllNotifications":           true,
+	"/question.InputService/GetAllQuestionInputsByQuestionId":   true,
+	"/question.InputService/GetQuestionInput":                   true,
+	"/question.OutputService/GetAllQuestionOutputsByQuestionId": true,
+	"/question.OutputService/GetQUestionOutPutByInputId":        true,
+	"/question.OutputService/GetQuestionOutput":                 true,
+	"/question.QuestionService/GetAllQuestions":                 true,
+	"/question.QuestionService/GetQuestion":                     true,
+	"/question.QuestionService/IsQuestionExist":                 true,
+	"/question.TestCaseService/GetAllTestCasesByQuestionId":     true,
+	"/question.TestCaseService/GetTestCase":                     true,
+	"/subject.SubjectService/GetAllSubjects":                    true,
+	"/subject.SubjectService/GetSubject":                        true,
+	"/task.TaskService/GetTask":                                 true,
+	"/topic.TopicService/GetAllTopics":                          true,
+	"/topic.TopicService/GetTopicIdByName":                      true,
+	"/user.Users/GetAllUsers":                                   true,
+	"/user.Users/GetProfile":                                    true,
+}
+
+// Policy sets the deadline and retries of unary calls.
+type Policy struct {
+	// Timeout is the deadline of each attempt of a call that Timeouts does
+	// not name.
+	Timeout time.Duration
+	// Timeouts are deadlines by full method ("/topic.TopicService/GetAllTopics"),
+	// method ("GetAllTopics") or service ("topic.TopicService"). The most
+	// specific one applies.
+	Timeouts map[string]time.Duration
+	// Retries is how many times a read is tried again after Unavailable or
+	// DeadlineExceeded. The wait before a retry doubles from Backoff up to
+	// MaxBackoff, with jitter.
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// ParseTimeouts reads per-call deadlines in YAML or JSON, keyed like
+// Policy.Timeouts:
+//
+//	GetAllQuestions: 10s
+//	topic.TopicService: 3s
+func ParseTimeouts(text string) (map[string]time.Duration, error) {
+	raw := make(map[string]string)
+	if err := yaml.NewDecoder(strings.NewReader(text)).Decode(&raw); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	timeouts := make(map[string]time.Duration, len(raw))
+	for name, value := range raw {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%s: %q is not a positive duration", name, value)
+		}
+		timeouts[name] = d
+	}
+	return timeouts, nil
+}
+
+func (p Policy) timeout(method string) time.Duration {
+	service, name, _ := strings.Cut(strings.TrimPrefix(method, "/"), "/")
+	for _, key := range []string{method, name, service} {
+		if d, ok := p.Timeouts[key]; ok {
+			return d
+		}
+	}
+	return p.Timeout
+}
+
+// backoff is the wait before retry n, counted from 1: half of the
+// exponential delay plus a random part of the other half.
+func (p Policy) backoff(n int) time.Duration {
+	d := p.Backoff << (n - 1)
+	if d > p.MaxBackoff || d <= 0 {
+		d = p.MaxBackoff
+	}
+	if d < 2 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// Interceptor applies a Policy, which can be replaced at run time, to the
+// unary calls of a connection.
+type Interceptor struct {
+	policy atomic.Pointer[Policy]
+}
+
+func NewInterceptor(p Policy) *Interceptor {
+	i := &Interceptor{}
+	i.SetPolicy(p)
+	return i
+}
+
+func (i *Interceptor) SetPolicy(p Policy) {
+	i.policy.Store(&p)
+}
+
+// Unary returns the interceptor to dial with.
+func (i *Interceptor) Unary() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		p := i.policy.Load()
+		timeout := p.timeout(method)
+		attempts := 1
+		if reads[method] {
+			attempts += p.Retries
+		}
+
+		start := time.Now()
+		call := Call{Method: method, Timeout: timeout}
+		var err error
+		for call.Attempts = 1; ; call.Attempts++ {
+			attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+			var endpoint peer.Peer
+			err = invoker(attemptCtx, method, req, reply, cc, append(opts, grpc.Peer(&endpoint))...)
+			cancel()
+			if endpoint.Addr != nil {
+				call.Endpoint = endpoint.Addr.String()
+			}
+			code := status.Code(err)
+			// A done ctx is the caller's own deadline or cancellation.
+			if call.Attempts == attempts || (code != codes.Unavailable && code != codes.DeadlineExceeded) || ctx.Err() != nil {
+				break
+			}
+			if !sleep(ctx, p.backoff(call.Attempts)) {
+				break
+			}
+		}
+		call.Code = status.Code(err)
+		call.Elapsed = time.Since(start)
+		if t := traceOf(ctx); t != nil {
+			t.add(call)
+		}
+		return err
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Call is the outcome of a unary call. Endpoint is the address the last
+// attempt was sent to, and is empty when no endpoint was picked.
+type Call struct {
+	Method   string
+	Attempts int
+	Timeout  time.Duration
+	Code     codes.Code
+	Elapsed  time.Duration
+	Endpoint string
+}
+
+func (c Call) String() string {
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = "none"
+	}
+	return fmt.Sprintf("%s; attempts=%d; timeout=%s; code=%s; elapsed=%s; endpoint=%s", c.Method, c.Attempts, c.Timeout, c.Code, c.Elapsed.Round(time.Millisecond), endpoint)
+}
+
+type traceKey struct{}
+
+// Trace collects the calls made with a context.
+type Trace struct {
+	mu    sync.Mutex
+	calls []Call
+}
+
+// WithTrace returns a context that records the calls made with it in the
+// returned Trace.
+func WithTrace(ctx context.Context) (context.Context, *Trace) {
+	t := &Trace{}
+	return context.WithValue(ctx, traceKey{}, t), t
+}
+
+func traceOf(ctx context.Context) *Trace {
+	t, _ := ctx.Value(traceKey{}).(*Trace)
+	return t
+}
+
+func (t *Trace) add(c Call) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.calls = append(t.calls, c)
+}
+
+// Calls returns the calls recorded so far.
+func (t *Trace) Calls() []Call {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Call(nil), t.calls...)
+}
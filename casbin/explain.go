@@ -0,0 +1,88 @@
+package casbin
+
+import (
+	"slices"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/util"
+)
+
+// Explanation is why a subject may or may not call a route.
+type Explanation struct {
+	// Roles are the roles the subject holds in the domain, directly or
+	// through inheritance, including the subject itself.
+	Roles []string
+	// Rules are the p rules of those roles for the path, whatever their
+	// method. They are the rules the decision was made from.
+	Rules []Rule
+	// Deciding is the rule that allowed the request, if any.
+	Deciding *Rule
+	Allowed  bool
+}
+
+// Explain evaluates the request "sub, dom, obj, act" against e like the
+// permission middleware does, and reports how the decision was reached.
+func Explain(e casbin.IEnforcer, sub, dom, obj, act string) (*Explanation, error) {
+	allowed, matched, err := e.EnforceEx(sub, dom, obj, act)
+	if err != nil {
+		return nil, err
+	}
+	res := &Explanation{Allowed: allowed}
+	if allowed && len(matched) > 0 {
+		res.Deciding = &Rule{PType: "p", Values: matched}
+	}
+
+	roles, err := e.GetImplicitRolesForUser(sub, dom)
+	if err != nil {
+		return nil, err
+	}
+	res.Roles = append([]string{sub}, roles...)
+
+	policies, err := e.GetPolicy()
+	if err != nil {
+		return nil, err
+	}
+	for _, values := range policies {
+		if slices.Contains(res.Roles, values[0]) && util.KeyMatch(dom, values[1]) && util.KeyMatch(obj, values[2]) {
+			res.Rules = append(res.Rules, Rule{PType: "p", Values: values})
+		}
+	}
+	return res, nil
+}
+
+// Simulate returns an enforcer, without a database, holding the rules of e
+// with add applied and remove taken away. Policy edits can be tried on it
+// before they are applied to e.
+func Simulate(e casbin.IEnforcer, add, remove []Rule) (*casbin.SyncedEnforcer, error) {
+	m := e.GetModel().Copy()
+	m.ClearPolicy()
+	sim, err := newEnforcer(m)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := storedRules(e)
+	if err != nil {
+		return nil, err
+	}
+	removed := make(map[string]bool, len(remove))
+	for _, rule := range remove {
+		removed[rule.String()] = true
+	}
+	for _, rule := range append(stored, add...) {
+		if removed[rule.String()] {
+			continue
+		}
+		has, err := hasRule(sim, rule)
+		if err != nil {
+			return nil, err
+		}
+		if has {
+			continue
+		}
+		if err := addRule(sim, rule); err != nil {
+			return nil, err
+		}
+	}
+	return sim, nil
+}
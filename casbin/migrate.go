@@ -0,0 +1,188 @@
+package casbin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/casbin/casbin/v2"
+)
+
+// migrationLock is the advisory lock key that serializes policy migrations of
+// gateway replicas starting at the same time.
+const migrationLock = 0x636173_62696e
+
+// PolicyFile is the declared set of policies.
+type PolicyFile struct {
+	Version  int
+	Checksum string
+	Rules    []Rule
+}
+
+// LoadPolicyFile reads a policy file in casbin CSV format. The version is
+// taken from a "# version: N" comment.
+func LoadPolicyFile(path string) (*PolicyFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules, version, err := ParsePolicy(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("%s: missing \"# version: N\" comment", path)
+	}
+	sum := sha256.Sum256(data)
+	return &PolicyFile{Version: version, Checksum: hex.EncodeToString(sum[:]), Rules: rules}, nil
+}
+
+// MigrationResult summarizes one migration.
+type MigrationResult struct {
+	Applied bool
+	Added   []Rule
+	// Stale are stored rules the file no longer declares. They are removed
+	// only when pruning.
+	Stale   []Rule
+	Removed bool
+}
+
+func createMigrationTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS casbin_policy_migrations (
+			id         SERIAL PRIMARY KEY,
+			version    INT NOT NULL,
+			checksum   TEXT NOT NULL,
+			added      INT NOT NULL,
+			stale      INT NOT NULL,
+			removed    INT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+	return err
+}
+
+// upgradeRules moves rules stored before domains were added to the model
+// into AnyDomain. Such rules have one field less and cannot be loaded by the
+// current model, so this runs before the enforcer is created.
+func upgradeRules(ctx context.Context, db *sql.DB) (int64, error) {
+	var upgraded int64
+	for _, query := range []string{
+		`UPDATE casbin_rule SET v3 = v2, v2 = v1, v1 = '*' WHERE ptype = 'p' AND v3 = ''`,
+		`UPDATE casbin_rule SET v2 = '*' WHERE ptype = 'g' AND v2 = ''`,
+	} {
+		res, err := db.ExecContext(ctx, query)
+		if err != nil {
+			return upgraded, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return upgraded, err
+		}
+		upgraded += n
+	}
+	return upgraded, nil
+}
+
+// Migrate brings the stored policies in line with file, unless this exact
+// file has been applied before. Rules added at runtime are therefore kept
+// until the file changes, and are then reported as stale or, with prune,
+// removed. The caller must hold the migration lock.
+func Migrate(ctx context.Context, db *sql.DB, enforcer casbin.IEnforcer, file *PolicyFile, prune bool) (*MigrationResult, error) {
+	var applied bool
+	err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM casbin_policy_migrations WHERE checksum = $1)`, file.Checksum).Scan(&applied)
+	if err != nil {
+		return nil, err
+	}
+	if applied {
+		return &MigrationResult{}, nil
+	}
+
+	if err := enforcer.LoadPolicy(); err != nil {
+		return nil, err
+	}
+
+	res := &MigrationResult{Applied: true}
+	declared := make(map[string]bool)
+	for _, rule := range file.Rules {
+		declared[rule.String()] = true
+		has, err := hasRule(enforcer, rule)
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			if err := addRule(enforcer, rule); err != nil {
+				return nil, err
+			}
+			res.Added = append(res.Added, rule)
+		}
+	}
+
+	stored, err := storedRules(enforcer)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range stored {
+		if declared[rule.String()] {
+			continue
+		}
+		res.Stale = append(res.Stale, rule)
+		if prune {
+			if err := removeRule(enforcer, rule); err != nil {
+				return nil, err
+			}
+		}
+	}
+	res.Removed = prune
+
+	removed := 0
+	if prune {
+		removed = len(res.Stale)
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO casbin_policy_migrations (version, checksum, added, stale, removed)
+		VALUES ($1, $2, $3, $4, $5)`,
+		file.Version, file.Checksum, len(res.Added), len(res.Stale), removed)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// withMigrationLock runs fn while holding a session level advisory lock on
+// a dedicated connection of db.
+func withMigrationLock(ctx context.Context, db *sql.DB, fn func() error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLock); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLock)
+	return fn()
+}
+
+func logMigration(logger *slog.Logger, file *PolicyFile, res *MigrationResult) {
+	if !res.Applied {
+		logger.Info("Casbin policies up to date", "version", file.Version)
+		return
+	}
+	for _, rule := range res.Added {
+		logger.Info("Added Casbin policy", "rule", rule.String())
+	}
+	for _, rule := range res.Stale {
+		if res.Removed {
+			logger.Info("Removed undeclared Casbin policy", "rule", rule.String())
+		} else {
+			logger.Warn("Casbin policy is not declared in the policy file", "rule", rule.String())
+		}
+	}
+	logger.Info("Casbin policies migrated", "version", file.Version, "added", len(res.Added), "stale", len(res.Stale))
+}
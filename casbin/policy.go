@@ -0,0 +1,203 @@
+package casbin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/casbin/casbin/v2"
+)
+
+// AnyDomain is the domain of rules and grants that apply to every subject.
+const AnyDomain = "*"
+
+// Rule is one line of a policy file, such as
+// "p, admin, *, /api/user/all, GET".
+type Rule struct {
+	PType  string
+	Values []string
+}
+
+func (r Rule) String() string {
+	return strings.Join(append([]string{r.PType}, r.Values...), ", ")
+}
+
+// ParsePolicy reads rules in casbin CSV format: "p" rules and "g" role
+// grants, one per line, with "#" comments. The version is taken from a
+// "# version: N" comment and is zero when there is none.
+func ParsePolicy(r io.Reader) ([]Rule, int, error) {
+	var rules []Rule
+	version := 0
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(line[1:]), "version:"); ok {
+				var err error
+				if version, err = strconv.Atoi(strings.TrimSpace(v)); err != nil {
+					return nil, 0, fmt.Errorf("line %d: invalid version", n)
+				}
+			}
+			continue
+		}
+
+		fields := strings.Split(line, ",")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		rule := Rule{PType: fields[0], Values: fields[1:]}
+		if err := rule.Validate(); err != nil {
+			return nil, 0, fmt.Errorf("line %d: %w", n, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	return rules, version, nil
+}
+
+// FormatPolicy writes rules in the format read by ParsePolicy.
+func FormatPolicy(w io.Writer, rules []Rule) error {
+	for _, rule := range rules {
+		if _, err := fmt.Fprintln(w, rule.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks that rule fits the model: "p, sub, dom, obj, act" or
+// "g, user, role, dom".
+func (r Rule) Validate() error {
+	want := 0
+	switch r.PType {
+	case "p":
+		want = 4
+	case "g":
+		want = 3
+	default:
+		return fmt.Errorf("unknown rule type %q", r.PType)
+	}
+	if len(r.Values) != want {
+		return fmt.Errorf("%s rule needs %d fields, got %d", r.PType, want, len(r.Values))
+	}
+	for _, v := range r.Values {
+		if v == "" {
+			return fmt.Errorf("%s rule has an empty field", r.PType)
+		}
+	}
+	if r.PType == "p" && !strings.HasPrefix(r.Values[2], "/") {
+		return fmt.Errorf("path %q must start with /", r.Values[2])
+	}
+	return nil
+}
+
+// Rules returns every rule of e.
+func Rules(e casbin.IEnforcer) ([]Rule, error) {
+	return storedRules(e)
+}
+
+// Replace makes the rules of e for which scope returns true equal to rules,
+// leaving the others alone. Only the difference is applied, so requests
+// never see a partially emptied policy.
+func Replace(e casbin.IEnforcer, rules []Rule, scope func(Rule) bool) (added, removed int, err error) {
+	stored, err := storedRules(e)
+	if err != nil {
+		return 0, 0, err
+	}
+	want := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		want[rule.String()] = true
+	}
+	have := make(map[string]bool, len(stored))
+	remove := map[string][][]string{}
+	for _, rule := range stored {
+		have[rule.String()] = true
+		if scope(rule) && !want[rule.String()] {
+			remove[rule.PType] = append(remove[rule.PType], rule.Values)
+		}
+	}
+	add := map[string][][]string{}
+	for _, rule := range rules {
+		if !have[rule.String()] {
+			add[rule.PType] = append(add[rule.PType], rule.Values)
+			have[rule.String()] = true
+		}
+	}
+
+	for ptype, values := range add {
+		if ptype == "g" {
+			_, err = e.AddNamedGroupingPolicies(ptype, values)
+		} else {
+			_, err = e.AddNamedPolicies(ptype, values)
+		}
+		if err != nil {
+			return added, removed, err
+		}
+		added += len(values)
+	}
+	for ptype, values := range remove {
+		if ptype == "g" {
+			_, err = e.RemoveNamedGroupingPolicies(ptype, values)
+		} else {
+			_, err = e.RemoveNamedPolicies(ptype, values)
+		}
+		if err != nil {
+			return added, removed, err
+		}
+		removed += len(values)
+	}
+	return added, removed, nil
+}
+
+func hasRule(e casbin.IEnforcer, rule Rule) (bool, error) {
+	if rule.PType == "g" {
+		return e.HasNamedGroupingPolicy(rule.PType, rule.Values)
+	}
+	return e.HasNamedPolicy(rule.PType, rule.Values)
+}
+
+func addRule(e casbin.IEnforcer, rule Rule) error {
+	var err error
+	if rule.PType == "g" {
+		_, err = e.AddNamedGroupingPolicy(rule.PType, rule.Values)
+	} else {
+		_, err = e.AddNamedPolicy(rule.PType, rule.Values)
+	}
+	return err
+}
+
+func removeRule(e casbin.IEnforcer, rule Rule) error {
+	var err error
+	if rule.PType == "g" {
+		_, err = e.RemoveNamedGroupingPolicy(rule.PType, rule.Values)
+	} else {
+		_, err = e.RemoveNamedPolicy(rule.PType, rule.Values)
+	}
+	return err
+}
+
+func storedRules(e casbin.IEnforcer) ([]Rule, error) {
+	var rules []Rule
+	policies, err := e.GetPolicy()
+	if err != nil {
+		return nil, err
+	}
+	for _, values := range policies {
+		rules = append(rules, Rule{PType: "p", Values: values})
+	}
+	grants, err := e.GetGroupingPolicy()
+	if err != nil {
+		return nil, err
+	}
+	for _, values := range grants {
+		rules = append(rules, Rule{PType: "g", Values: values})
+	}
+	return rules, nil
+}
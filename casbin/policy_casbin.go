@@ -1,199 +1,194 @@
 package casbin
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 
 	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/util"
 	xormadapter "github.com/casbin/xorm-adapter/v2"
+	"github.com/lib/pq"
+	"xorm.io/xorm"
 )
 
+// DB is where the policy database lives.
+type DB struct {
+	Host     string
+	Port     int
+	Name     string
+	User     string
+	Password string
+}
+
+// DSN is the connection string of the policy database.
+func (d DB) DSN() string {
+	return d.server() + " dbname=" + d.Name
+}
+
+// server is the connection string of the database server, without a
+// database, which may not exist yet.
+func (d DB) server() string {
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s sslmode=disable", d.Host, d.Port, d.User, d.Password)
+}
+
 const (
-	host     = "postgres-db-casbin"
-	port     = "5432"
-	dbname   = "casbin"
-	username = "postgres"
-	password = "1234"
+	modelFile  = "casbin/model.conf"
+	policyFile = "casbin/policy.csv"
 )
 
-func CasbinEnforcer(logger *slog.Logger) (*casbin.Enforcer, error) {
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s sslmode=disable", host, port, username, password)
-	db, err := sql.Open("postgres", connStr)
+// CasbinEnforcer connects to the policy database and migrates it to the
+// policies declared in policyFile. With prune, stored rules that the file no
+// longer declares are removed instead of only being reported. The returned
+// closer closes the connections of the enforcer to the database.
+func CasbinEnforcer(logger *slog.Logger, conn DB, prune bool) (*casbin.SyncedEnforcer, io.Closer, error) {
+	db, err := sql.Open("postgres", conn.server()+" dbname=postgres")
 	if err != nil {
 		logger.Error("Error connecting to database", "error", err.Error())
-		return nil, err
+		return nil, nil, err
 	}
 	defer db.Close()
 
-	_, err = db.Exec("DROP DATABASE IF EXISTS casbin")
+	file, err := LoadPolicyFile(policyFile)
 	if err != nil {
-		logger.Error("Error dropping Casbin database", "error", err.Error())
-		return nil, err
+		logger.Error("Error reading Casbin policy file", "error", err.Error())
+		return nil, nil, err
 	}
 
-	adapter, err := xormadapter.NewAdapter("postgres", fmt.Sprintf("host=%s port=%s user=%s dbname=%s password=%s sslmode=disable", host, port, username, dbname, password))
+	var enforcer *casbin.SyncedEnforcer
+	var engine *xorm.Engine
+	err = withMigrationLock(context.Background(), db, func() error {
+		// The database and the table of the adapter are created on first
+		// use, so they are created under the lock as well.
+		var adapter *xormadapter.Adapter
+		adapter, engine, err = openAdapter(context.Background(), db, conn)
+		if err != nil {
+			logger.Error("Error creating Casbin adapter", "error", err.Error())
+			return err
+		}
+
+		policyDB, err := sql.Open("postgres", conn.DSN())
+		if err != nil {
+			return err
+		}
+		defer policyDB.Close()
+		upgraded, err := upgradeRules(context.Background(), policyDB)
+		if err != nil {
+			logger.Error("Error upgrading Casbin rules", "error", err.Error())
+			return err
+		}
+		if upgraded > 0 {
+			logger.Info("Moved Casbin rules into the default domain", "rules", upgraded)
+		}
+
+		enforcer, err = newEnforcer(modelFile, adapter)
+		if err != nil {
+			logger.Error("Error creating Casbin enforcer", "error", err.Error())
+			return err
+		}
+
+		if err := createMigrationTable(policyDB); err != nil {
+			logger.Error("Error creating Casbin migration table", "error", err.Error())
+			return err
+		}
+
+		res, err := Migrate(context.Background(), policyDB, enforcer, file, prune)
+		if err != nil {
+			logger.Error("Error migrating Casbin policies", "error", err.Error())
+			return err
+		}
+		logMigration(logger, file, res)
+		return nil
+	})
 	if err != nil {
-		logger.Error("Error creating Casbin adapter", "error", err.Error())
-		return nil, err
-	}
-
-	enforcer, err := casbin.NewEnforcer("casbin/model.conf", adapter)
-	if err != nil {
-		logger.Error("Error creating Casbin enforcer", "error", err.Error())
-		return nil, err
+		if engine != nil {
+			engine.Close()
+		}
+		return nil, nil, err
 	}
 
 	err = enforcer.LoadPolicy()
 	if err != nil {
 		logger.Error("Error loading Casbin policy", "error", err.Error())
-		return nil, err
+		engine.Close()
+		return nil, nil, err
 	}
 
-	policies := [][]string{
-		//user
-		{"admin", "/api/user/register", "POST"},
-		{"admin", "/api/user/all", "GET"},
-		{"admin", "/api/user/updateprofile", "PUT"},
-		{"admin", "/api/user/update", "PUT"},
-		{"admin", "/api/user/photo", "POST"},
-
-		{"student", "/api/user/getprofile", "GET"},
-		{"student", "/api/user/updateprofile", "PUT"},
-		{"student", "/api/user/photo", "POST"},
-		{"student", "/api/user/photo", "DELETE"},
-
-		{"teacher", "/api/user/getprofile", "GET"},
-		{"teacher", "/api/user/updateprofile", "PUT"},
-		{"teacher", "/api/user/photo", "POST"},
-
-		{"support", "/api/user/getprofile", "GET"},
-		{"support", "/api/user/updateprofile", "PUT"},
-		{"support", "/api/user/photo", "POST"},
-
-		//group
-		{"admin", "/api/groups/create", "POST"},
-		{"admin", "/api/groups/update", "PUT"},
-		{"admin", "/api/groups/delete", "DELETE"},
-		{"admin", "/api/groups/getById/:group_id", "GET"},
-		{"admin", "/api/groups/getAll", "GET"},
-		{"admin", "/api/groups/add-student", "POST"},
-		{"admin", "/api/groups/delete-student", "DELETE"},
-		{"admin", "/api/groups/add-teacher", "POST"},
-		{"admin", "/api/groups/delete-teacher", "DELETE"},
-		{"admin", "/api/groups/student-groups/:hh_id", "GET"},
-		{"admin", "/api/groups/teacher-groups/:id", "GET"},
-		{"admin", "/api/groups/students/:group_id", "GET"},
-		{"student", "/api/groups/student-groups/:hh_id", "GET"},
-		{"teacher", "/api/groups/teacher-groups/:id", "GET"},
-
-
-		//topic
-		{"admin", "/api/topics/create", "POST"},
-		{"admin", "/api/topics/update", "PUT"},
-		{"admin", "/api/topics/delete/:topic_id", "DELETE"},
-		{"admin", "/api/topics/getAll", "GET"},
-
-		{"teacher", "/api/topics/create", "POST"},
-		{"teacher", "/api/topics/update", "PUT"},
-		{"teacher", "/api/topics/delete/:topic_id", "DELETE"},
-		{"teacher", "/api/topics/getAll", "GET"},
-
-		{"student", "/api/topics/getAll", "GET"},
-
-		//subject
-		{"admin", "/api/subjects/create", "POST"},
-		{"admin", "/api/subjects/get/:id", "GET"},
-		{"admin", "/api/subjects/getall", "GET"},
-		{"admin", "/api/subjects/update/:id", "PUT"},
-		{"admin", "/api/subjects/delete/:id", "DELETE"},
-
-		{"teacher", "/api/subjects/create", "POST"},
-		{"teacher", "/api/subjects/get/:id", "GET"},
-		{"teacher", "/api/subjects/getall", "GET"},
-		{"teacher", "/api/subjects/update/:id", "PUT"},
-
-		{"student", "/api/subjects/get/:id", "GET"},
-		{"student", "/api/subjects/getall", "GET"},
-
-		//question
-		{"admin", "/api/questions/create", "POST"},
-		{"admin", "/api/questions/:id", "GET"},
-		{"admin", "/api/questions/update/:id", "PUT"},
-		{"admin", "/api/questions/delete/:id", "DELETE"},
-		{"admin", "/api/questions/getAll", "GET"},
-		{"admin", "/api/questions/upload-image/:id", "POST"},
-		{"admin", "/api/questions/delete-image/:id", "DELETE"},
-
-		{"teacher", "/api/questions/create", "POST"},
-		{"teacher", "/api/questions/:id", "GET"},
-		{"teacher", "/api/questions/update/:id", "PUT"},
-		{"teacher", "/api/questions/delete/:id", "DELETE"},
-		{"teacher", "/api/questions/getAll", "GET"},
-		{"teacher", "/api/questions/upload-image/:id", "POST"},
-		{"teacher", "/api/questions/delete-image/:id", "DELETE"},
-
-		{"student", "/api/questions/:id", "GET"},
-
-		//question output
-		{"admin", "/api/question-outputs/create", "POST"},
-		{"admin", "/api/question-outputs/:id", "GET"},
-		{"admin", "/api/question-outputs/question/:question_id", "GET"},
-		{"admin", "/api/question-outputs/delete/:id", "DELETE"},
-
-		{"teacher", "/api/question-outputs/create", "POST"},
-		{"teacher", "/api/question-outputs/:id", "GET"},
-		{"teacher", "/api/question-outputs/question/:question_id", "GET"},
-		{"teacher", "/api/question-outputs/delete/:id", "DELETE"},
-
-		//question input
-		{"admin", "/api/question-inputs/create", "POST"},
-		{"admin", "/api/question-inputs/:id", "GET"},
-		{"admin", "/api/question-inputs/question/:question_id", "GET"},
-		{"admin", "/api/question-inputs/delete/:id", "DELETE"},
-
-		{"teacher", "/api/question-inputs/create", "POST"},
-		{"teacher", "/api/question-inputs/:id", "GET"},
-		{"teacher", "/api/question-inputs/question/:question_id", "GET"},
-		{"teacher", "/api/question-inputs/delete/:id", "DELETE"},
-
-		//test case
-		{"admin", "/api/test-cases/create", "POST"},
-		{"admin", "/api/test-cases/:id", "GET"},
-		{"admin", "/api/test-cases/question/:question_id", "GET"},
-		{"admin", "/api/test-cases/delete/:id", "DELETE"},
-
-		{"teacher", "/api/test-cases/create", "POST"},
-		{"teacher", "/api/test-cases/:id", "GET"},
-		{"teacher", "/api/test-cases/question/:question_id", "GET"},
-		{"teacher", "/api/test-cases/delete/:id", "DELETE"},
-
-		//task
-		{"teacher", "/api/task/create", "POST"},
-		{"teacher", "/api/task/delete", "DELETE"},
-		{"teacher", "/api/task/get", "GET"},
-		{"student", "/api/task/get", "GET"},
-
-		// admin
-		{"admin", "/api/task/create", "POST"},
-		{"admin", "/api/task/delete", "DELETE"},
-		{"admin", "/api/task/get", "GET"},
-
-		//student
-		{"student", "/api/check/submit", "POST"},
+	return enforcer, engine, nil
+}
+
+// openAdapter creates the policy database on server unless it exists, and
+// opens an adapter on it. The adapter is built on an engine of its own,
+// because xormadapter.NewAdapter gives no way to close its connections.
+func openAdapter(ctx context.Context, server *sql.DB, conn DB) (*xormadapter.Adapter, *xorm.Engine, error) {
+	if _, err := server.ExecContext(ctx, "CREATE DATABASE "+pq.QuoteIdentifier(conn.Name)); err != nil {
+		// 42P04 is duplicate_database.
+		var pqErr *pq.Error
+		if !errors.As(err, &pqErr) || pqErr.Code != "42P04" {
+			return nil, nil, err
+		}
 	}
+	engine, err := xorm.NewEngine("postgres", conn.DSN())
+	if err != nil {
+		return nil, nil, err
+	}
+	adapter, err := xormadapter.NewAdapterByEngine(engine)
+	if err != nil {
+		engine.Close()
+		return nil, nil, err
+	}
+	return adapter, engine, nil
+}
 
-	_, err = enforcer.AddPolicies(policies)
+func newEnforcer(params ...interface{}) (*casbin.SyncedEnforcer, error) {
+	enforcer, err := casbin.NewSyncedEnforcer(params...)
 	if err != nil {
-		logger.Error("Error adding Casbin policy", "error", err.Error())
 		return nil, err
 	}
+	// Grants in AnyDomain apply in every subject.
+	enforcer.AddNamedDomainMatchingFunc("g", "keyMatch", util.KeyMatch)
+	return enforcer, nil
+}
 
-	err = enforcer.SavePolicy()
+// LoadEnforcer returns an enforcer holding only the rules of a policy file,
+// without a database. It is meant for checking policy files offline.
+func LoadEnforcer(modelPath, policyPath string) (*casbin.SyncedEnforcer, error) {
+	file, err := LoadPolicyFile(policyPath)
 	if err != nil {
-		logger.Error("Error saving Casbin policy", "error", err.Error())
 		return nil, err
 	}
-
+	enforcer, err := newEnforcer(modelPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range file.Rules {
+		if err := addRule(enforcer, rule); err != nil {
+			return nil, err
+		}
+	}
 	return enforcer, nil
 }
+
+// Watch reloads the policy of enforcer whenever another replica changes it,
+// and tells the other replicas about changes made through enforcer.
+func Watch(enforcer *casbin.SyncedEnforcer, notifier Notifier, logger *slog.Logger) error {
+	watcher, err := NewWatcher(notifier)
+	if err != nil {
+		return err
+	}
+	if err := enforcer.SetWatcher(watcher); err != nil {
+		return err
+	}
+	// The default callback reloads without taking the lock of the synced
+	// enforcer.
+	return watcher.SetUpdateCallback(func(string) {
+		if err := enforcer.LoadPolicy(); err != nil {
+			logger.Error("Error reloading Casbin policy", "error", err.Error())
+			return
+		}
+		logger.Info("Casbin policy reloaded")
+	})
+}
@@ -0,0 +1,126 @@
+package casbin_test
+
+import (
+	"api/api"
+	"api/api/handler"
+	"api/api/policycheck"
+	"api/casbin"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// inherits is the role hierarchy of policy.csv. A role may call every route
+// that the roles it inherits could call before.
+var inherits = map[string][]string{
+	"admin":   {"teacher", "student"},
+	"teacher": {"student"},
+}
+
+// added are the routes that the baseline policies did not allow to a role,
+// listed for the lowest role of the hierarchy that has them.
+var added = []struct {
+	role, method, path string
+}{
+	{"student", "DELETE", "/api/user/2fa"},
+	{"student", "POST", "/api/user/2fa/confirm"},
+	{"student", "POST", "/api/user/2fa/enroll"},
+	{"student", "GET", "/api/user/authz/explain"},
+	{"student", "GET", "/api/user/flags"},
+	{"student", "POST", "/api/user/logout"},
+	{"student", "POST", "/api/user/logout-all"},
+	{"student", "GET", "/api/user/sessions"},
+	{"student", "DELETE", "/api/user/sessions/:id"},
+	{"support", "POST", "/api/support/impersonate"},
+	{"support", "DELETE", "/api/user/2fa"},
+	{"support", "POST", "/api/user/2fa/confirm"},
+	{"support", "POST", "/api/user/2fa/enroll"},
+	{"support", "GET", "/api/user/authz/explain"},
+	{"support", "GET", "/api/user/flags"},
+	{"support", "POST", "/api/user/logout"},
+	{"support", "POST", "/api/user/logout-all"},
+	{"support", "GET", "/api/user/sessions"},
+	{"support", "DELETE", "/api/user/sessions/:id"},
+	{"admin", "GET", "/api/admin/api-keys"},
+	{"admin", "POST", "/api/admin/api-keys"},
+	{"admin", "DELETE", "/api/admin/api-keys/:id"},
+	{"admin", "GET", "/api/admin/authz/explain"},
+	{"admin", "POST", "/api/admin/authz/explain"},
+	{"admin", "GET", "/api/admin/breakers"},
+	{"admin", "GET", "/api/admin/config"},
+	{"admin", "POST", "/api/admin/config/reload"},
+	{"admin", "GET", "/api/admin/flags"},
+	{"admin", "DELETE", "/api/admin/flags/:name"},
+	{"admin", "PUT", "/api/admin/flags/:name"},
+	{"admin", "GET", "/api/admin/health"},
+	{"admin", "GET", "/api/admin/impersonation/audit"},
+	{"admin", "GET", "/api/admin/impersonation/grants"},
+	{"admin", "POST", "/api/admin/impersonation/grants"},
+	{"admin", "DELETE", "/api/admin/impersonation/grants/:id"},
+	{"admin", "DELETE", "/api/admin/lockouts"},
+	{"admin", "GET", "/api/admin/lockouts"},
+	{"admin", "DELETE", "/api/admin/policies"},
+	{"admin", "GET", "/api/admin/policies"},
+	{"admin", "POST", "/api/admin/policies"},
+	{"admin", "PUT", "/api/admin/policies"},
+	{"admin", "GET", "/api/admin/policies/export"},
+	{"admin", "POST", "/api/admin/policies/import"},
+	{"admin", "DELETE", "/api/admin/roles/users"},
+	{"admin", "GET", "/api/admin/roles/users"},
+	{"admin", "POST", "/api/admin/roles/users"},
+	{"admin", "DELETE", "/api/admin/users/:id/2fa"},
+	{"admin", "DELETE", "/api/admin/users/:id/sessions"},
+	{"admin", "GET", "/api/admin/users/:id/sessions"},
+	{"admin", "DELETE", "/api/admin/users/:id/sessions/:session_id"},
+	{"admin", "DELETE", "/api/user/delete/:id"},
+	{"subject_lead", "POST", "/api/question-inputs/create"},
+	{"subject_lead", "GET", "/api/question-inputs/question/:question_id"},
+	{"subject_lead", "GET", "/api/questions/:id"},
+	{"subject_lead", "POST", "/api/questions/create"},
+	{"subject_lead", "DELETE", "/api/questions/delete-image/:id"},
+	{"subject_lead", "DELETE", "/api/questions/delete/:id"},
+	{"subject_lead", "PUT", "/api/questions/update/:id"},
+	{"subject_lead", "POST", "/api/questions/upload-image/:id"},
+	{"subject_lead", "POST", "/api/test-cases/create"},
+	{"subject_lead", "GET", "/api/test-cases/question/:question_id"},
+	{"subject_lead", "POST", "/api/topics/create"},
+	{"subject_lead", "DELETE", "/api/topics/delete/:topic_id"},
+	{"subject_lead", "PUT", "/api/topics/update"},
+}
+
+func TestPolicyKeepsBaselineAccess(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	baseline, err := casbin.LoadEnforcer("model.conf", "testdata/policy_baseline.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := casbin.LoadEnforcer("model.conf", "policy.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra := make(map[string]bool)
+	for _, a := range added {
+		extra[a.role+" "+a.method+" "+a.path] = true
+	}
+
+	routes := policycheck.Routes(api.Router(&handler.Handler{}))
+	for _, role := range []string{"admin", "teacher", "student", "support", "subject_lead"} {
+		for _, route := range routes {
+			want := false
+			for _, r := range append([]string{role}, inherits[role]...) {
+				ok, err := baseline.Enforce(r, casbin.AnyDomain, route.Path, route.Method)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want = want || ok || extra[r+" "+route.Method+" "+route.Path]
+			}
+			got, err := current.Enforce(role, casbin.AnyDomain, route.Path, route.Method)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("%s %s: allowed = %v for %s, want %v", route.Method, route.Path, got, role, want)
+			}
+		}
+	}
+}
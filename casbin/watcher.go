@@ -0,0 +1,155 @@
+package casbin
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Notifier carries policy change notices between gateway replicas.
+type Notifier interface {
+	Publish(ctx context.Context, payload string) error
+	// Subscribe calls fn for every published payload, including the ones
+	// published by this replica. An empty payload means notices may have
+	// been missed and the policy should be reloaded anyway.
+	Subscribe(fn func(payload string)) error
+	Close() error
+}
+
+// Watcher is a casbin watcher that reloads the policy of this replica
+// whenever another replica changes it.
+type Watcher struct {
+	id       string
+	notifier Notifier
+
+	mu       sync.Mutex
+	callback func(string)
+}
+
+func NewWatcher(notifier Notifier) (*Watcher, error) {
+	w := &Watcher{id: uuid.NewString(), notifier: notifier}
+	if err := notifier.Subscribe(w.receive); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Watcher) SetUpdateCallback(callback func(string)) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.callback = callback
+	return nil
+}
+
+// Update is called by the enforcer after it changed the policy.
+func (w *Watcher) Update() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return w.notifier.Publish(ctx, w.id)
+}
+
+func (w *Watcher) Close() {
+	w.notifier.Close()
+}
+
+func (w *Watcher) receive(payload string) {
+	if payload == w.id {
+		return
+	}
+	w.mu.Lock()
+	callback := w.callback
+	w.mu.Unlock()
+	if callback != nil {
+		callback(payload)
+	}
+}
+
+// LocalNotifier delivers notices within the process. It connects enforcers
+// in tests and is enough for a single replica.
+type LocalNotifier struct {
+	mu          sync.Mutex
+	subscribers []func(string)
+}
+
+func NewLocalNotifier() *LocalNotifier {
+	return &LocalNotifier{}
+}
+
+func (n *LocalNotifier) Publish(ctx context.Context, payload string) error {
+	n.mu.Lock()
+	subscribers := append([]func(string){}, n.subscribers...)
+	n.mu.Unlock()
+	for _, fn := range subscribers {
+		fn(payload)
+	}
+	return nil
+}
+
+func (n *LocalNotifier) Subscribe(fn func(string)) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.subscribers = append(n.subscribers, fn)
+	return nil
+}
+
+func (n *LocalNotifier) Close() error {
+	return nil
+}
+
+const notifyChannel = "casbin_policy"
+
+// PostgresNotifier delivers notices through LISTEN/NOTIFY of the policy
+// database.
+type PostgresNotifier struct {
+	db       *sql.DB
+	listener *pq.Listener
+	log      *slog.Logger
+}
+
+func NewPostgresNotifier(dsn string, logger *slog.Logger) (*PostgresNotifier, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			logger.Error("Casbin policy listener", "error", err.Error())
+		}
+	})
+	if err := listener.Listen(notifyChannel); err != nil {
+		listener.Close()
+		db.Close()
+		return nil, err
+	}
+	return &PostgresNotifier{db: db, listener: listener, log: logger}, nil
+}
+
+func (n *PostgresNotifier) Publish(ctx context.Context, payload string) error {
+	_, err := n.db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, notifyChannel, payload)
+	return err
+}
+
+func (n *PostgresNotifier) Subscribe(fn func(string)) error {
+	go func() {
+		for notice := range n.listener.Notify {
+			// A nil notice follows a reconnect, after which notices sent
+			// while disconnected are lost.
+			if notice == nil {
+				fn("")
+				continue
+			}
+			fn(notice.Extra)
+		}
+	}()
+	return nil
+}
+
+func (n *PostgresNotifier) Close() error {
+	n.listener.Close()
+	return n.db.Close()
+}
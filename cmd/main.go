@@ -2,7 +2,16 @@ package main
 
 import (
 	"api/api"
+	"api/api/apikey"
+	"api/api/flags"
 	"api/api/handler"
+	"api/api/health"
+	"api/api/impersonation"
+	"api/api/lockout"
+	"api/api/reset"
+	"api/api/token"
+	"api/api/totp"
+	"api/api/upstream"
 	"api/casbin"
 	"api/config"
 	"api/genproto/group"
@@ -13,7 +22,19 @@ import (
 	"api/genproto/topic"
 	"api/genproto/user"
 	"api/logs"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"google.golang.org/grpc"
@@ -21,20 +42,69 @@ import (
 )
 
 func main() {
-	conf := config.Load()
-	hand := NewHandler()
-	router := api.Router(hand)
-	log.Printf("server is running...")
-	log.Fatal(router.Run(conf.API_ROUTER))
+	store, err := config.NewStore(os.Args[1:], CheckSettings)
+	if err != nil {
+		log.Fatalf("invalid configuration:\n%v", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	hand, closers := NewHandler(store)
+	go store.Watch(ctx, hand.Log)
+	server := &http.Server{Addr: store.Current().API_ROUTER, Handler: api.Router(hand)}
+	go func() {
+		log.Printf("server is running...")
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	<-ctx.Done()
+	// A second signal stops the gateway at once.
+	stop()
+	Shutdown(server, hand, store.Current().SHUTDOWN_GRACE, closers)
+}
+
+// closer is a connection that is closed on shutdown.
+type closer struct {
+	name string
+	io.Closer
+}
+
+// Shutdown stops accepting connections, tells WebSocket clients to
+// reconnect and waits up to grace for running requests, such as checker
+// streams, before cutting them off. It then closes closers in order.
+func Shutdown(server *http.Server, hand *handler.Handler, grace time.Duration, closers []closer) {
+	hand.Log.Info("Shutting down", "grace", grace.String())
+	hand.Log.Info("Closed WebSockets", "count", hand.Drain())
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		hand.Log.Warn("Cut off requests still running after the grace period", "error", err.Error())
+		server.Close()
+	}
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			hand.Log.Error("Failed to close connection", "name", c.name, "error", err.Error())
+		}
+	}
+	hand.Log.Info("Shut down")
 }
 
-func NewHandler() *handler.Handler {
-	conf := config.Load()
-	connUser, err := grpc.NewClient(conf.USER_SERVICE, grpc.WithTransportCredentials(insecure.NewCredentials()))
+// NewHandler connects to the upstreams and databases. The returned closers
+// close those connections, upstreams first.
+func NewHandler(store *config.Store) (*handler.Handler, []closer) {
+	conf := store.Current()
+	calls := upstream.NewInterceptor(RPCPolicy(conf))
+	breakers := map[string]*upstream.Breaker{
+		"user":     upstream.NewBreaker("user", BreakerConfig(conf)),
+		"question": upstream.NewBreaker("question", BreakerConfig(conf)),
+	}
+	// UPSTREAM_BALANCER and the targets were validated on load.
+	balance, _ := upstream.Balance(conf.UPSTREAM_BALANCER, conf.UPSTREAM_HEALTH_CHECK)
+	connUser, err := DialUpstream(conf.USER_SERVICE, breakers["user"], calls, balance)
 	if err != nil {
 		panic(err)
 	}
-	connQuestion, err := grpc.NewClient(conf.QUESTION_SERVICE, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	connQuestion, err := DialUpstream(conf.QUESTION_SERVICE, breakers["question"], calls, balance)
 	if err != nil {
 		panic(err)
 	}
@@ -50,17 +120,94 @@ func NewHandler() *handler.Handler {
 	QuestionTest := question.NewTestCaseServiceClient(connQuestion)
 	Task := task.NewTaskServiceClient(connQuestion)
 
-	logs := logs.NewLogger()
-	en, err := casbin.CasbinEnforcer(logs)
+	level := new(slog.LevelVar)
+	_ = level.UnmarshalText([]byte(conf.LOG_LEVEL))
+	logs := logs.NewLogger(level)
+	// FEATURE_FLAGS was validated on load.
+	defined, _ := flags.Parse(conf.FEATURE_FLAGS)
+	featureFlags := flags.NewSet(defined)
+	ApplyReloads(store, logs, level, featureFlags, calls, breakers, connUser, connQuestion)
+	en, policyEngine, err := casbin.CasbinEnforcer(logs, PolicyDB(conf), conf.CASBIN_PRUNE_POLICIES)
 	if err != nil {
 		log.Fatal("error in creating casbin enforcer", err)
 	}
+	notifier, err := NewPolicyNotifier(conf, logs)
+	if err != nil {
+		log.Fatal("error in creating casbin notifier", err)
+	}
+	if err := casbin.Watch(en, notifier, logs); err != nil {
+		log.Fatal("error in creating casbin watcher", err)
+	}
+	if err := SetupSigningKeys(conf, logs); err != nil {
+		log.Fatal("error in loading signing keys", err)
+	}
+	db, err := OpenStoreDB(conf)
+	if err != nil {
+		log.Fatal("error in connecting to token store", err)
+	}
+	refreshStore, denylist, sessions, err := NewTokenStores(db)
+	if err != nil {
+		log.Fatal("error in creating token stores", err)
+	}
+	apiKeys, err := NewAPIKeyStore(db)
+	if err != nil {
+		log.Fatal("error in creating api key store", err)
+	}
+	impersonations, err := NewImpersonationStore(db)
+	if err != nil {
+		log.Fatal("error in creating impersonation store", err)
+	}
+	resetCodes, err := NewResetStore(db)
+	if err != nil {
+		log.Fatal("error in creating password reset store", err)
+	}
+	twoFactor, err := NewTwoFactorStore(db)
+	if err != nil {
+		log.Fatal("error in creating two-factor store", err)
+	}
+	loginGuard, err := NewLoginGuard(conf, db)
+	if err != nil {
+		log.Fatal("error in creating login lockout store", err)
+	}
+	policyDB, err := sql.Open("postgres", PolicyDB(conf).DSN())
+	if err != nil {
+		log.Fatal("error in connecting to policy database", err)
+	}
+	resets := reset.NewService(resetCodes, reset.Options{
+		TTL:         conf.RESET_CODE_TTL,
+		ResendAfter: conf.RESET_RESEND_AFTER,
+		MaxAttempts: conf.RESET_MAX_ATTEMPTS,
+	})
+	closers := []closer{
+		{"user service", connUser},
+		{"question service", connQuestion},
+		{"policy notifier", notifier},
+		{"policy database", policyEngine},
+		{"policy health check", policyDB},
+	}
+	if db != nil {
+		closers = append(closers, closer{"token store", db})
+	}
 	return &handler.Handler{
+		Config:         store,
 		User:           User,
 		Notification:   Notification,
 		Group:          Group,
 		Log:            logs,
 		Enforcer:       en,
+		RefreshStore:   refreshStore,
+		Denylist:       denylist,
+		Lockout:        loginGuard,
+		Sessions:       sessions,
+		APIKeys:        apikey.NewService(apiKeys),
+		Impersonation:  impersonations,
+		ImpersonateTTL: conf.IMPERSONATION_TOKEN_TTL,
+		Reset:          resets,
+		ResetSender:    NewResetSender(conf, logs),
+		TwoFactor:      totp.NewService(twoFactor, conf.TOTP_ISSUER, strings.Split(conf.MFA_REQUIRED_ROLES, ",")),
+		Flags:          featureFlags,
+		Breakers:       breakers,
+		Health:         HealthChecks(store, connUser, connQuestion, policyDB),
 		Question:       Question,
 		QuestionOutput: QuestionOutput,
 		QuestionInput:  QuestionInput,
@@ -69,5 +216,236 @@ func NewHandler() *handler.Handler {
 		Subject:        Subject,
 		Task:           Task,
 		Connections:    make(map[string]*websocket.Conn),
+		SessionConns:   make(map[string]*websocket.Conn),
+	}, closers
+}
+
+// CheckSettings validates the settings that config keeps as plain strings
+// and the flags and upstream packages parse: the upstream targets, the
+// balancer, the per-method timeouts and the feature flags. The store runs it
+// on load and on every reload, so ApplyReloads can rely on them.
+func CheckSettings(conf config.Config) error {
+	var errs []error
+	for _, setting := range []struct{ key, value string }{
+		{"USER_SERVICE", conf.USER_SERVICE},
+		{"QUESTION_SERVICE", conf.QUESTION_SERVICE},
+	} {
+		if _, err := upstream.Target(setting.value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", setting.key, err))
+		}
+	}
+	if _, err := upstream.Balance(conf.UPSTREAM_BALANCER, false); err != nil {
+		errs = append(errs, fmt.Errorf("UPSTREAM_BALANCER: %w", err))
+	}
+	if _, err := upstream.ParseTimeouts(conf.UPSTREAM_TIMEOUTS); err != nil {
+		errs = append(errs, fmt.Errorf("UPSTREAM_TIMEOUTS: %w", err))
+	}
+	if _, err := flags.Parse(conf.FEATURE_FLAGS); err != nil {
+		errs = append(errs, fmt.Errorf("FEATURE_FLAGS: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// ApplyReloads moves the log level, feature flags, call policy, breakers and
+// upstream connections to the values of every reloaded configuration.
+func ApplyReloads(store *config.Store, logger *slog.Logger, level *slog.LevelVar, featureFlags *flags.Set, calls *upstream.Interceptor, breakers map[string]*upstream.Breaker, user, question *upstream.Conn) {
+	store.OnReload(func(conf config.Config) {
+		// LOG_LEVEL and FEATURE_FLAGS were validated on load.
+		_ = level.UnmarshalText([]byte(conf.LOG_LEVEL))
+		defined, _ := flags.Parse(conf.FEATURE_FLAGS)
+		featureFlags.Define(defined)
+		calls.SetPolicy(RPCPolicy(conf))
+		for _, b := range breakers {
+			b.SetConfig(BreakerConfig(conf))
+		}
+		for conn, setting := range map[*upstream.Conn]string{user: conf.USER_SERVICE, question: conf.QUESTION_SERVICE} {
+			target, _ := upstream.Target(setting)
+			if err := conn.SetTarget(target); err != nil {
+				logger.Error("Failed to switch upstream", "target", target, "error", err.Error())
+			}
+		}
+	})
+}
+
+// HealthChecks are the checks of the dependencies that HEALTH_REQUIRED can
+// name. The checker has no health endpoint, so it is only dialed.
+func HealthChecks(store *config.Store, user, question *upstream.Conn, policyDB *sql.DB) *health.Checker {
+	checker := health.NewChecker()
+	checker.Add("user", health.GRPC(user))
+	checker.Add("question", health.GRPC(question))
+	checker.Add("casbin", health.SQL(policyDB))
+	checker.Add("minio", health.HTTP(func() string {
+		return "http://" + store.Current().MINIO_URL + "/minio/health/live"
+	}))
+	checker.Add("checker", health.Reachable(func() string { return store.Current().CHECKER_URL }))
+	return checker
+}
+
+// DialUpstream connects to the endpoints of an upstream service named by
+// setting and spreads calls over them with balance. The breaker sees a call
+// once, however often it is retried.
+func DialUpstream(setting string, breaker *upstream.Breaker, calls *upstream.Interceptor, balance []grpc.DialOption) (*upstream.Conn, error) {
+	target, err := upstream.Target(setting)
+	if err != nil {
+		return nil, err
+	}
+	opts := append([]grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithChainUnaryInterceptor(breaker.Unary(), calls.Unary()),
+	}, balance...)
+	return upstream.Dial(target, opts...)
+}
+
+func BreakerConfig(conf config.Config) upstream.BreakerConfig {
+	return upstream.BreakerConfig{
+		Window:    conf.BREAKER_WINDOW,
+		MinCalls:  conf.BREAKER_MIN_CALLS,
+		ErrorRate: conf.BREAKER_ERROR_RATE,
+		SlowCall:  conf.BREAKER_SLOW_CALL,
+		SlowRate:  conf.BREAKER_SLOW_RATE,
+		OpenFor:   conf.BREAKER_OPEN_FOR,
+		Probes:    conf.BREAKER_PROBES,
+	}
+}
+
+// RPCPolicy is the deadline and retry policy of calls to the upstream
+// services.
+func RPCPolicy(conf config.Config) upstream.Policy {
+	// UPSTREAM_TIMEOUTS was validated on load.
+	timeouts, _ := upstream.ParseTimeouts(conf.UPSTREAM_TIMEOUTS)
+	return upstream.Policy{
+		Timeout:    conf.UPSTREAM_TIMEOUT,
+		Timeouts:   timeouts,
+		Retries:    conf.UPSTREAM_RETRIES,
+		Backoff:    conf.UPSTREAM_RETRY_BACKOFF,
+		MaxBackoff: conf.UPSTREAM_RETRY_MAX_BACKOFF,
+	}
+}
+
+func PolicyDB(conf config.Config) casbin.DB {
+	return casbin.DB{
+		Host:     conf.CASBIN_DB_HOST,
+		Port:     conf.CASBIN_DB_PORT,
+		Name:     conf.CASBIN_DB_NAME,
+		User:     conf.CASBIN_DB_USER,
+		Password: conf.CASBIN_DB_PASSWORD,
+	}
+}
+
+// NewPolicyNotifier picks how policy changes reach the other replicas.
+func NewPolicyNotifier(conf config.Config, logger *slog.Logger) (casbin.Notifier, error) {
+	if conf.CASBIN_WATCHER == "local" {
+		return casbin.NewLocalNotifier(), nil
+	}
+	return casbin.NewPostgresNotifier(PolicyDB(conf).DSN(), logger)
+}
+
+// OpenStoreDB connects to the database shared by the gateway replicas. It
+// returns nil when TOKEN_STORE keeps state in memory.
+func OpenStoreDB(conf config.Config) (*sql.DB, error) {
+	if conf.TOKEN_STORE != "postgres" {
+		return nil, nil
+	}
+	return sql.Open("postgres", conf.TOKEN_STORE_DSN)
+}
+
+func NewTokenStores(db *sql.DB) (token.RefreshStore, token.Denylist, token.SessionStore, error) {
+	if db == nil {
+		return token.NewMemoryRefreshStore(), token.NewMemoryDenylist(), token.NewMemorySessionStore(), nil
+	}
+	store, err := token.NewPostgresStore(db)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return store, store, store.Sessions(), nil
+}
+
+func NewAPIKeyStore(db *sql.DB) (apikey.Store, error) {
+	if db == nil {
+		return apikey.NewMemoryStore(), nil
+	}
+	return apikey.NewPostgresStore(db)
+}
+
+func NewImpersonationStore(db *sql.DB) (impersonation.Store, error) {
+	if db == nil {
+		return impersonation.NewMemoryStore(10000), nil
+	}
+	return impersonation.NewPostgresStore(db)
+}
+
+func NewResetStore(db *sql.DB) (reset.Store, error) {
+	if db == nil {
+		return reset.NewMemoryStore(), nil
+	}
+	return reset.NewPostgresStore(db)
+}
+
+func NewTwoFactorStore(db *sql.DB) (totp.Store, error) {
+	if db == nil {
+		return totp.NewMemoryStore(), nil
+	}
+	return totp.NewPostgresStore(db)
+}
+
+// NewResetSender picks the outbound channel for reset codes. "log" only
+// writes codes to the log; config refuses it without DEBUG.
+func NewResetSender(conf config.Config, logger *slog.Logger) reset.Sender {
+	if conf.RESET_CHANNEL == "smtp" {
+		return reset.SMTPSender{
+			Addr:     conf.SMTP_ADDR,
+			From:     conf.SMTP_FROM,
+			To:       conf.SMTP_TO,
+			Username: conf.SMTP_USER,
+			Password: conf.SMTP_PASSWORD,
+		}
+	}
+	return reset.LogSender{Log: logger}
+}
+
+// SetupSigningKeys switches token signing to asymmetric keys unless HS256 is
+// configured, in which case ACCES_KEY and REFRESH_KEY stay in use.
+func SetupSigningKeys(conf config.Config, logger *slog.Logger) error {
+	if conf.JWT_ALG == "HS256" {
+		token.UseKeys(token.NewHMACKeySet(conf.ACCES_KEY), token.NewHMACKeySet(conf.REFRESH_KEY))
+		return nil
+	}
+	keys, err := token.NewKeyManager(token.KeyManagerConfig{
+		Alg:         conf.JWT_ALG,
+		Dir:         conf.JWT_KEYS_DIR,
+		RotateEvery: conf.JWT_ROTATE_EVERY,
+		Grace:       conf.JWT_KEY_GRACE,
+		Reload:      conf.JWT_KEYS_RELOAD,
+	}, logger)
+	if err != nil {
+		return err
+	}
+	go keys.Run(context.Background())
+	token.UseKeys(keys, keys)
+	return nil
+}
+
+// NewLoginGuard throttles logins with counters in db, shared by every
+// replica, or in memory when db is nil.
+func NewLoginGuard(conf config.Config, db *sql.DB) (*lockout.Guard, error) {
+	user := lockout.Policy{
+		Threshold: conf.LOGIN_MAX_FAILURES,
+		BaseDelay: conf.LOGIN_BACKOFF_BASE,
+		MaxDelay:  conf.LOGIN_BACKOFF_MAX,
+		Lockout:   conf.LOGIN_LOCKOUT,
+		Window:    conf.LOGIN_FAILURE_WINDOW,
+	}
+	// Whole classrooms share one address, so an IP is not slowed down and
+	// tolerates more failures than a single account before it is locked.
+	ip := user
+	ip.Threshold = conf.LOGIN_IP_MAX_FAILURES
+	ip.BaseDelay = 0
+	if db == nil {
+		return lockout.NewGuard(lockout.NewMemoryStore(conf.LOGIN_FAILURE_WINDOW), user, ip), nil
+	}
+	store, err := lockout.NewPostgresStore(db, conf.LOGIN_FAILURE_WINDOW)
+	if err != nil {
+		return nil, err
 	}
+	return lockout.NewGuard(store, user, ip), nil
 }
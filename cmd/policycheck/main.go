@@ -0,0 +1,44 @@
+// Command policycheck compares the routes of the gateway with a casbin policy
+// file. It prints routes that no rule guards, rules for routes that do not
+// exist and roles that cannot reach any route, and exits with status 1 when
+// it finds any.
+package main
+
+import (
+	"api/api"
+	"api/api/handler"
+	"api/api/policycheck"
+	"api/casbin"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+func main() {
+	modelPath := flag.String("model", "casbin/model.conf", "casbin model file")
+	policyPath := flag.String("policy", "casbin/policy.csv", "casbin policy file")
+	flag.Parse()
+
+	enforcer, err := casbin.LoadEnforcer(*modelPath, *policyPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "policycheck:", err)
+		os.Exit(2)
+	}
+
+	// The router is only walked, so the handler needs no clients.
+	gin.SetMode(gin.ReleaseMode)
+	routes := policycheck.Routes(api.Router(&handler.Handler{}))
+
+	report, err := policycheck.Check(routes, enforcer)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "policycheck:", err)
+		os.Exit(2)
+	}
+	report.Write(os.Stdout)
+	if report.Drift() {
+		os.Exit(1)
+	}
+	fmt.Printf("%d routes match the policy\n", len(routes))
+}
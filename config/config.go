@@ -1,42 +1,426 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"log/slog"
+	"net/url"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
-	"github.com/spf13/cast"
 )
 
+// Config is the configuration of the gateway. Every field is read from, in
+// order of precedence, a command line flag such as --user-service, the
+// USER_SERVICE environment variable, the YAML config file and its default.
+// A setting can also be read from a file named by KEY_FILE, such as
+// ACCES_KEY_FILE, which is how secrets are mounted.
 type Config struct {
-	USER_SERVICE     string
-	API_ROUTER       string
-	QUESTION_SERVICE string
+	// APP_ENV is "development" or "production". Production refuses to start
+	// with the default signing keys.
+	APP_ENV string
+
+	// USER_SERVICE and QUESTION_SERVICE are an address, a comma separated
+	// list of addresses or a gRPC target such as dns:///question:50053.
+	// Calls are spread over the addresses by UPSTREAM_BALANCER, round_robin
+	// or least_request, and with UPSTREAM_HEALTH_CHECK addresses that fail
+	// gRPC health checks get no calls. The balancer settings only apply
+	// after a restart.
+	USER_SERVICE          string
+	API_ROUTER            string
+	QUESTION_SERVICE      string
+	UPSTREAM_BALANCER     string
+	UPSTREAM_HEALTH_CHECK bool
+	// UPSTREAM_TIMEOUT is the deadline of each attempt of a call to the user
+	// and question services. UPSTREAM_TIMEOUTS overrides it per service or
+	// method, as YAML or JSON such as {"GetAllQuestions": "10s"}.
+	UPSTREAM_TIMEOUT  time.Duration
+	UPSTREAM_TIMEOUTS string
+	// UPSTREAM_RETRIES is how many times a read is tried again when the
+	// service is unavailable or too slow, waiting from UPSTREAM_RETRY_BACKOFF
+	// up to UPSTREAM_RETRY_MAX_BACKOFF in between. Writes are never retried.
+	UPSTREAM_RETRIES           int
+	UPSTREAM_RETRY_BACKOFF     time.Duration
+	UPSTREAM_RETRY_MAX_BACKOFF time.Duration
+
+	// BREAKER_* set the circuit breakers of the user and question services.
+	// A breaker opens when, among at least BREAKER_MIN_CALLS calls in
+	// BREAKER_WINDOW, the share of failures reaches BREAKER_ERROR_RATE or
+	// the share of calls slower than BREAKER_SLOW_CALL reaches
+	// BREAKER_SLOW_RATE. After BREAKER_OPEN_FOR it lets BREAKER_PROBES calls
+	// through and closes if they succeed.
+	BREAKER_WINDOW     time.Duration
+	BREAKER_MIN_CALLS  int
+	BREAKER_ERROR_RATE float64
+	BREAKER_SLOW_CALL  time.Duration
+	BREAKER_SLOW_RATE  float64
+	BREAKER_OPEN_FOR   time.Duration
+	BREAKER_PROBES     int
+
+	// DEBUG reports the outcome of upstream calls, with their retries,
+	// deadlines and endpoints, in X-Upstream-Call response headers.
+	DEBUG bool
+
+	// LOG_LEVEL is debug, info, warn or error.
+	LOG_LEVEL string
+	// CORS_ORIGINS is a comma separated list of origins browsers may call
+	// the gateway from, or "*" for any.
+	CORS_ORIGINS string
+	// RATE_LIMIT is the number of requests per second a client IP may make,
+	// with bursts of up to RATE_BURST. 0 turns rate limiting off.
+	RATE_LIMIT int
+	RATE_BURST int
+
+	// FEATURE_FLAGS defines the feature flags, as YAML or JSON keyed by flag
+	// name. In the config file it is written as a nested map. The "checker"
+	// flag limits POST /api/check/submit to the callers it is on for.
+	FEATURE_FLAGS string
+
+	// HEALTH_REQUIRED is a comma separated list of the dependencies that
+	// must be up for the gateway to be ready: user, question, casbin, minio
+	// and checker. Each check gives up after HEALTH_TIMEOUT. The public
+	// health endpoints reuse results for HEALTH_CACHE_TTL.
+	HEALTH_REQUIRED  string
+	HEALTH_TIMEOUT   time.Duration
+	HEALTH_CACHE_TTL time.Duration
+
+	// SHUTDOWN_GRACE is how long running requests, such as checker streams,
+	// may take to finish when the gateway is stopped.
+	SHUTDOWN_GRACE time.Duration
+
+	// CONFIG_WATCH_INTERVAL is how often the config files are checked for
+	// changes. 0 only reloads on SIGHUP.
+	CONFIG_WATCH_INTERVAL time.Duration
 
 	ACCES_KEY   string
 	REFRESH_KEY string
 	MINIO_URL   string
+
+	MINIO_ACCESS_KEY string
+	MINIO_SECRET_KEY string
+
+	// CHECKER_URL is the endpoint ProxyChecker streams solutions to.
+	CHECKER_URL string
+
+	// TOKEN_STORE is postgres, or memory, which loses revocations on restart
+	// and is not shared by replicas, and is only allowed with DEBUG.
+	TOKEN_STORE     string
+	TOKEN_STORE_DSN string
+
+	JWT_ALG          string
+	JWT_KEYS_DIR     string
+	JWT_ROTATE_EVERY time.Duration
+	JWT_KEY_GRACE    time.Duration
+	JWT_KEYS_RELOAD  time.Duration
+
+	LOGIN_MAX_FAILURES    int
+	LOGIN_IP_MAX_FAILURES int
+	LOGIN_BACKOFF_BASE    time.Duration
+	LOGIN_BACKOFF_MAX     time.Duration
+	LOGIN_LOCKOUT         time.Duration
+	LOGIN_FAILURE_WINDOW  time.Duration
+
+	IMPERSONATION_TOKEN_TTL time.Duration
+
+	RESET_CODE_TTL     time.Duration
+	RESET_RESEND_AFTER time.Duration
+	RESET_MAX_ATTEMPTS int
+	// RESET_CHANNEL is smtp, or log, which writes codes to the log and is
+	// only allowed with DEBUG.
+	RESET_CHANNEL string
+
+	SMTP_ADDR     string
+	SMTP_FROM     string
+	SMTP_TO       string
+	SMTP_USER     string
+	SMTP_PASSWORD string
+
+	TOTP_ISSUER string
+	// MFA_REQUIRED_ROLES is a comma separated list of roles that cannot log
+	// in without a second factor.
+	MFA_REQUIRED_ROLES string
+
+	CASBIN_PRUNE_POLICIES bool
+	// CASBIN_WATCHER is "postgres" to share policy changes between replicas
+	// or "local" for a single replica.
+	CASBIN_WATCHER string
+
+	CASBIN_DB_HOST     string
+	CASBIN_DB_PORT     int
+	CASBIN_DB_NAME     string
+	CASBIN_DB_USER     string
+	CASBIN_DB_PASSWORD string
+}
+
+// Dependencies are the dependencies HEALTH_REQUIRED can name.
+var Dependencies = []string{"user", "question", "casbin", "minio", "checker"}
+
+// Default signing keys, which production refuses.
+const (
+	defaultAccessKey  = "flashsalee"
+	defaultRefreshKey = "OzNur"
+)
+
+// Check validates settings that config stores as plain values and other
+// packages parse, such as the upstream targets and the feature flags.
+type Check func(Config) error
+
+// Load reads the configuration from args, the environment, .env and the
+// YAML file named by --config or CONFIG_FILE, config.yaml if it exists, and
+// validates it with Validate and checks. The error lists every invalid
+// setting.
+func Load(args []string, checks ...Check) (Config, error) {
+	config, _, err := load(args, checks)
+	return config, err
 }
 
-func Load() Config {
-	if err := godotenv.Load(".env"); err != nil {
+// load is Load that also returns the files the configuration was read from.
+func load(args []string, checks []Check) (Config, []string, error) {
+	flags, path, err := flagSource(args)
+	if err != nil {
+		return Config{}, nil, err
+	}
+	env := envSource()
+	sources := []source{flags, env}
+	files := []string{".env"}
+	// .env is read as its own source instead of being copied into the
+	// environment, so that changes to it are picked up on reload.
+	dotenv, err := godotenv.Read(".env")
+	if err != nil {
 		log.Print("No .env file found?")
+	} else {
+		sources = append(sources, source{name: ".env", values: dotenv})
+	}
+	if path == "" {
+		path = env.values["CONFIG_FILE"]
+	}
+	if path == "" {
+		if _, err := os.Stat("config.yaml"); err == nil {
+			path = "config.yaml"
+		}
+	}
+	if path != "" {
+		file, err := fileSource(path)
+		if err != nil {
+			return Config{}, nil, err
+		}
+		sources = append(sources, file)
+		files = append(files, path)
 	}
 
+	l := newLoader(sources...)
 	config := Config{}
-	config.USER_SERVICE = cast.ToString(Coalesce("USER_SERVICE", ":50051"))
-	config.API_ROUTER = cast.ToString(Coalesce("API_ROUTER", ":8080"))
-	config.ACCES_KEY = cast.ToString(Coalesce("ACCES_KEY", "flashsalee"))
-	config.REFRESH_KEY = cast.ToString(Coalesce("REFRESH_KEY", "OzNur"))
-	config.MINIO_URL = cast.ToString(Coalesce("MINIO_URL", "localhost:9000"))
-	config.QUESTION_SERVICE = cast.ToString(Coalesce("QUESTION_SERVICE", ":50053"))
-
-	return config
+	config.APP_ENV = l.string("APP_ENV", "development")
+	config.USER_SERVICE = l.string("USER_SERVICE", ":50051")
+	config.API_ROUTER = l.string("API_ROUTER", ":8080")
+	config.ACCES_KEY = l.string("ACCES_KEY", defaultAccessKey)
+	config.REFRESH_KEY = l.string("REFRESH_KEY", defaultRefreshKey)
+	config.MINIO_URL = l.string("MINIO_URL", "localhost:9000")
+	config.MINIO_ACCESS_KEY = l.string("MINIO_ACCESS_KEY", "test")
+	config.MINIO_SECRET_KEY = l.string("MINIO_SECRET_KEY", "minioadmin")
+	config.CHECKER_URL = l.string("CHECKER_URL", "http://localhost:50054/check")
+	config.QUESTION_SERVICE = l.string("QUESTION_SERVICE", ":50053")
+	config.UPSTREAM_BALANCER = l.string("UPSTREAM_BALANCER", "round_robin")
+	config.UPSTREAM_HEALTH_CHECK = l.bool("UPSTREAM_HEALTH_CHECK", true)
+	config.UPSTREAM_TIMEOUT = l.duration("UPSTREAM_TIMEOUT", "10s")
+	config.UPSTREAM_TIMEOUTS = l.string("UPSTREAM_TIMEOUTS", "")
+	config.UPSTREAM_RETRIES = l.int("UPSTREAM_RETRIES", 2)
+	config.UPSTREAM_RETRY_BACKOFF = l.duration("UPSTREAM_RETRY_BACKOFF", "100ms")
+	config.UPSTREAM_RETRY_MAX_BACKOFF = l.duration("UPSTREAM_RETRY_MAX_BACKOFF", "2s")
+	config.BREAKER_WINDOW = l.duration("BREAKER_WINDOW", "30s")
+	config.BREAKER_MIN_CALLS = l.int("BREAKER_MIN_CALLS", 10)
+	config.BREAKER_ERROR_RATE = l.float("BREAKER_ERROR_RATE", 0.5)
+	config.BREAKER_SLOW_CALL = l.duration("BREAKER_SLOW_CALL", "5s")
+	config.BREAKER_SLOW_RATE = l.float("BREAKER_SLOW_RATE", 0.8)
+	config.BREAKER_OPEN_FOR = l.duration("BREAKER_OPEN_FOR", "15s")
+	config.BREAKER_PROBES = l.int("BREAKER_PROBES", 3)
+	config.DEBUG = l.bool("DEBUG", false)
+	config.LOG_LEVEL = l.string("LOG_LEVEL", "debug")
+	config.CORS_ORIGINS = l.string("CORS_ORIGINS", "*")
+	config.RATE_LIMIT = l.int("RATE_LIMIT", 0)
+	config.RATE_BURST = l.int("RATE_BURST", 20)
+	config.FEATURE_FLAGS = l.string("FEATURE_FLAGS", "")
+	config.HEALTH_REQUIRED = l.string("HEALTH_REQUIRED", "user,question,casbin")
+	config.HEALTH_TIMEOUT = l.duration("HEALTH_TIMEOUT", "2s")
+	config.HEALTH_CACHE_TTL = l.duration("HEALTH_CACHE_TTL", "5s")
+	config.SHUTDOWN_GRACE = l.duration("SHUTDOWN_GRACE", "25s")
+	config.CONFIG_WATCH_INTERVAL = l.duration("CONFIG_WATCH_INTERVAL", "5s")
+	config.TOKEN_STORE = l.string("TOKEN_STORE", "postgres")
+	config.TOKEN_STORE_DSN = l.string("TOKEN_STORE_DSN", "host=postgres-db-casbin port=5432 user=postgres password=1234 dbname=postgres sslmode=disable")
+	config.JWT_ALG = l.string("JWT_ALG", "HS256")
+	config.JWT_KEYS_DIR = l.string("JWT_KEYS_DIR", "keys")
+	config.JWT_ROTATE_EVERY = l.duration("JWT_ROTATE_EVERY", "0s")
+	config.JWT_KEY_GRACE = l.duration("JWT_KEY_GRACE", "48h")
+	config.JWT_KEYS_RELOAD = l.duration("JWT_KEYS_RELOAD", "1m")
+	config.LOGIN_MAX_FAILURES = l.int("LOGIN_MAX_FAILURES", 5)
+	config.LOGIN_IP_MAX_FAILURES = l.int("LOGIN_IP_MAX_FAILURES", 50)
+	config.LOGIN_BACKOFF_BASE = l.duration("LOGIN_BACKOFF_BASE", "1s")
+	config.LOGIN_BACKOFF_MAX = l.duration("LOGIN_BACKOFF_MAX", "1m")
+	config.LOGIN_LOCKOUT = l.duration("LOGIN_LOCKOUT", "15m")
+	config.LOGIN_FAILURE_WINDOW = l.duration("LOGIN_FAILURE_WINDOW", "15m")
+	config.IMPERSONATION_TOKEN_TTL = l.duration("IMPERSONATION_TOKEN_TTL", "15m")
+	config.RESET_CODE_TTL = l.duration("RESET_CODE_TTL", "10m")
+	config.RESET_RESEND_AFTER = l.duration("RESET_RESEND_AFTER", "1m")
+	config.RESET_MAX_ATTEMPTS = l.int("RESET_MAX_ATTEMPTS", 5)
+	config.RESET_CHANNEL = l.string("RESET_CHANNEL", "smtp")
+	config.SMTP_ADDR = l.string("SMTP_ADDR", "localhost:25")
+	config.SMTP_FROM = l.string("SMTP_FROM", "noreply@localhost")
+	config.SMTP_TO = l.string("SMTP_TO", "{hh_id}@localhost")
+	config.SMTP_USER = l.string("SMTP_USER", "")
+	config.SMTP_PASSWORD = l.string("SMTP_PASSWORD", "")
+	config.TOTP_ISSUER = l.string("TOTP_ISSUER", "ALL")
+	config.MFA_REQUIRED_ROLES = l.string("MFA_REQUIRED_ROLES", "")
+	config.CASBIN_PRUNE_POLICIES = l.bool("CASBIN_PRUNE_POLICIES", false)
+	config.CASBIN_WATCHER = l.string("CASBIN_WATCHER", "postgres")
+	config.CASBIN_DB_HOST = l.string("CASBIN_DB_HOST", "postgres-db-casbin")
+	config.CASBIN_DB_PORT = l.int("CASBIN_DB_PORT", 5432)
+	config.CASBIN_DB_NAME = l.string("CASBIN_DB_NAME", "casbin")
+	config.CASBIN_DB_USER = l.string("CASBIN_DB_USER", "postgres")
+	config.CASBIN_DB_PASSWORD = l.string("CASBIN_DB_PASSWORD", "1234")
+
+	errs := []error{l.err(), config.Validate()}
+	for _, check := range checks {
+		errs = append(errs, check(config))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return Config{}, nil, err
+	}
+	return config, files, nil
+}
+
+// Validate reports every setting that has a value the gateway cannot run
+// with, except those left to the Checks passed to Load.
+func (c Config) Validate() error {
+	var errs []error
+	oneOf := func(key, value string, allowed ...string) {
+		if !slices.Contains(allowed, value) {
+			errs = append(errs, fmt.Errorf("%s: %q is not one of %v", key, value, allowed))
+		}
+	}
+	positive := func(key string, d time.Duration) {
+		if d <= 0 {
+			errs = append(errs, fmt.Errorf("%s: must be greater than 0, got %s", key, d))
+		}
+	}
+	atLeastOne := func(key string, n int) {
+		if n < 1 {
+			errs = append(errs, fmt.Errorf("%s: must be at least 1, got %d", key, n))
+		}
+	}
+	share := func(key string, f float64) {
+		if f <= 0 || f > 1 {
+			errs = append(errs, fmt.Errorf("%s: must be greater than 0 and at most 1, got %g", key, f))
+		}
+	}
+
+	oneOf("APP_ENV", c.APP_ENV, "development", "production")
+	oneOf("TOKEN_STORE", c.TOKEN_STORE, "memory", "postgres")
+	oneOf("JWT_ALG", c.JWT_ALG, "HS256", "RS256", "EdDSA")
+	oneOf("RESET_CHANNEL", c.RESET_CHANNEL, "log", "smtp")
+	oneOf("CASBIN_WATCHER", c.CASBIN_WATCHER, "postgres", "local")
+
+	if c.JWT_ROTATE_EVERY < 0 {
+		errs = append(errs, fmt.Errorf("JWT_ROTATE_EVERY: must not be negative, got %s", c.JWT_ROTATE_EVERY))
+	}
+	positive("UPSTREAM_TIMEOUT", c.UPSTREAM_TIMEOUT)
+	positive("UPSTREAM_RETRY_BACKOFF", c.UPSTREAM_RETRY_BACKOFF)
+	positive("UPSTREAM_RETRY_MAX_BACKOFF", c.UPSTREAM_RETRY_MAX_BACKOFF)
+	positive("BREAKER_WINDOW", c.BREAKER_WINDOW)
+	positive("BREAKER_SLOW_CALL", c.BREAKER_SLOW_CALL)
+	positive("BREAKER_OPEN_FOR", c.BREAKER_OPEN_FOR)
+	atLeastOne("BREAKER_MIN_CALLS", c.BREAKER_MIN_CALLS)
+	atLeastOne("BREAKER_PROBES", c.BREAKER_PROBES)
+	share("BREAKER_ERROR_RATE", c.BREAKER_ERROR_RATE)
+	share("BREAKER_SLOW_RATE", c.BREAKER_SLOW_RATE)
+	if c.UPSTREAM_RETRIES < 0 {
+		errs = append(errs, fmt.Errorf("UPSTREAM_RETRIES: must not be negative, got %d", c.UPSTREAM_RETRIES))
+	}
+	positive("JWT_KEY_GRACE", c.JWT_KEY_GRACE)
+	positive("JWT_KEYS_RELOAD", c.JWT_KEYS_RELOAD)
+	positive("LOGIN_BACKOFF_BASE", c.LOGIN_BACKOFF_BASE)
+	positive("LOGIN_BACKOFF_MAX", c.LOGIN_BACKOFF_MAX)
+	positive("LOGIN_LOCKOUT", c.LOGIN_LOCKOUT)
+	positive("LOGIN_FAILURE_WINDOW", c.LOGIN_FAILURE_WINDOW)
+	positive("IMPERSONATION_TOKEN_TTL", c.IMPERSONATION_TOKEN_TTL)
+	positive("RESET_CODE_TTL", c.RESET_CODE_TTL)
+	positive("RESET_RESEND_AFTER", c.RESET_RESEND_AFTER)
+	atLeastOne("LOGIN_MAX_FAILURES", c.LOGIN_MAX_FAILURES)
+	atLeastOne("LOGIN_IP_MAX_FAILURES", c.LOGIN_IP_MAX_FAILURES)
+	atLeastOne("RESET_MAX_ATTEMPTS", c.RESET_MAX_ATTEMPTS)
+	if c.RATE_LIMIT < 0 {
+		errs = append(errs, fmt.Errorf("RATE_LIMIT: must not be negative, got %d", c.RATE_LIMIT))
+	}
+	if c.RATE_LIMIT > 0 {
+		atLeastOne("RATE_BURST", c.RATE_BURST)
+	}
+	positive("HEALTH_TIMEOUT", c.HEALTH_TIMEOUT)
+	positive("HEALTH_CACHE_TTL", c.HEALTH_CACHE_TTL)
+	positive("SHUTDOWN_GRACE", c.SHUTDOWN_GRACE)
+	for _, name := range c.Required() {
+		oneOf("HEALTH_REQUIRED", name, Dependencies...)
+	}
+	if c.CONFIG_WATCH_INTERVAL < 0 {
+		errs = append(errs, fmt.Errorf("CONFIG_WATCH_INTERVAL: must not be negative, got %s", c.CONFIG_WATCH_INTERVAL))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LOG_LEVEL)); err != nil {
+		errs = append(errs, fmt.Errorf("LOG_LEVEL: %q is not one of debug, info, warn or error", c.LOG_LEVEL))
+	}
+	for _, origin := range c.Origins() {
+		if origin == "*" {
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			errs = append(errs, fmt.Errorf("CORS_ORIGINS: %q is not an origin such as https://example.com", origin))
+		}
+	}
+	if c.CASBIN_DB_PORT < 1 || c.CASBIN_DB_PORT > 65535 {
+		errs = append(errs, fmt.Errorf("CASBIN_DB_PORT: %d is not a port", c.CASBIN_DB_PORT))
+	}
+	if u, err := url.Parse(c.CHECKER_URL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("CHECKER_URL: %q is not an absolute URL", c.CHECKER_URL))
+	}
+
+	if c.TOKEN_STORE == "memory" && !c.DEBUG {
+		errs = append(errs, errors.New("TOKEN_STORE: memory is only allowed with DEBUG, for local setups"))
+	}
+	// The log channel writes live codes to the log.
+	if c.RESET_CHANNEL == "log" && !c.DEBUG {
+		errs = append(errs, errors.New("RESET_CHANNEL: log is only allowed with DEBUG, for local setups"))
+	}
+	if c.APP_ENV == "production" && c.JWT_ALG == "HS256" {
+		if c.ACCES_KEY == defaultAccessKey || c.ACCES_KEY == "" {
+			errs = append(errs, errors.New("ACCES_KEY: the default signing key cannot be used in production"))
+		}
+		if c.REFRESH_KEY == defaultRefreshKey || c.REFRESH_KEY == "" {
+			errs = append(errs, errors.New("REFRESH_KEY: the default signing key cannot be used in production"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Origins returns CORS_ORIGINS as a list.
+func (c Config) Origins() []string {
+	var origins []string
+	for _, origin := range strings.Split(c.CORS_ORIGINS, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
 }
 
-func Coalesce(key string, defaultValue interface{}) interface{} {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
+// Required returns HEALTH_REQUIRED as a list.
+func (c Config) Required() []string {
+	var names []string
+	for _, name := range strings.Split(c.HEALTH_REQUIRED, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
 	}
-	return defaultValue
+	return names
 }
@@ -0,0 +1,137 @@
+package config_test
+
+import (
+	"api/config"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// inDir runs the test in a new directory holding files, where Load looks
+// for .env and config.yaml.
+func inDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	inDir(t, map[string]string{
+		"config.yaml": "user_service: yaml:1\nquestion_service: yaml:3\nminio_url: yaml:9000\ncasbin:\n  db_host: yaml-host\n",
+		".env":        "USER_SERVICE=dotenv:1\nQUESTION_SERVICE=dotenv:3\nCASBIN_DB_HOST=dotenv-host\n",
+	})
+	t.Setenv("USER_SERVICE", "env:1")
+	t.Setenv("CASBIN_DB_HOST", "env-host")
+
+	conf, err := config.Load([]string{"--user-service", "flag:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key, got, want string
+	}{
+		{"USER_SERVICE", conf.USER_SERVICE, "flag:1"},
+		{"CASBIN_DB_HOST", conf.CASBIN_DB_HOST, "env-host"},
+		{"QUESTION_SERVICE", conf.QUESTION_SERVICE, "dotenv:3"},
+		{"MINIO_URL", conf.MINIO_URL, "yaml:9000"},
+		{"CASBIN_DB_NAME", conf.CASBIN_DB_NAME, "casbin"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.key, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadRefusesUnknownSettings(t *testing.T) {
+	inDir(t, map[string]string{"config.yaml": "user_servce: :50051\n"})
+	if _, err := config.Load([]string{"--rate-limt", "5"}); err == nil ||
+		!strings.Contains(err.Error(), "USER_SERVCE") || !strings.Contains(err.Error(), "RATE_LIMT") {
+		t.Fatalf("err = %v, want both unknown settings", err)
+	}
+}
+
+func TestLoadReadsSecretFiles(t *testing.T) {
+	dir := inDir(t, map[string]string{"access_key": "mounted-secret\n"})
+	t.Setenv("ACCES_KEY_FILE", filepath.Join(dir, "access_key"))
+	conf, err := config.Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.ACCES_KEY != "mounted-secret" {
+		t.Fatalf("ACCES_KEY = %q, want the trimmed file content", conf.ACCES_KEY)
+	}
+
+	t.Setenv("ACCES_KEY_FILE", filepath.Join(dir, "missing"))
+	if _, err := config.Load(nil); err == nil || !strings.Contains(err.Error(), "ACCES_KEY_FILE") {
+		t.Fatalf("err = %v, want an error about ACCES_KEY_FILE", err)
+	}
+}
+
+func TestProductionRefusesDefaultKeys(t *testing.T) {
+	inDir(t, nil)
+	t.Setenv("APP_ENV", "production")
+	_, err := config.Load(nil)
+	if err == nil || !strings.Contains(err.Error(), "ACCES_KEY") || !strings.Contains(err.Error(), "REFRESH_KEY") {
+		t.Fatalf("err = %v, want both default keys refused", err)
+	}
+
+	t.Setenv("ACCES_KEY", "production-access-key")
+	t.Setenv("REFRESH_KEY", "production-refresh-key")
+	if _, err := config.Load(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadRunsChecks(t *testing.T) {
+	inDir(t, nil)
+	var checked config.Config
+	_, err := config.Load([]string{"--user-service", "checked:1"}, func(conf config.Config) error {
+		checked = conf
+		return errors.New("checked")
+	})
+	if err == nil || checked.USER_SERVICE != "checked:1" {
+		t.Fatalf("err = %v, checked %q, want the check to see the config and fail the load", err, checked.USER_SERVICE)
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	store := config.NewStaticStore(config.Config{
+		ACCES_KEY:          "secret",
+		CASBIN_DB_PASSWORD: "",
+		USER_SERVICE:       ":50051",
+		UPSTREAM_TIMEOUT:   5 * time.Second,
+	})
+	shown := store.Redacted()
+	tests := []struct {
+		key  string
+		want interface{}
+	}{
+		{"ACCES_KEY", "[redacted]"},
+		// An empty secret shows that it is not set.
+		{"CASBIN_DB_PASSWORD", ""},
+		{"USER_SERVICE", ":50051"},
+		{"UPSTREAM_TIMEOUT", "5s"},
+	}
+	for _, tt := range tests {
+		if shown[tt.key] != tt.want {
+			t.Errorf("%s = %v, want %v", tt.key, shown[tt.key], tt.want)
+		}
+	}
+}
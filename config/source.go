@@ -0,0 +1,226 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"gopkg.in/yaml.v3"
+)
+
+// source is one layer of settings keyed by their environment variable name,
+// such as USER_SERVICE.
+type source struct {
+	name   string
+	values map[string]string
+	// strict sources may only contain known settings.
+	strict bool
+}
+
+func envSource() source {
+	values := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if key, value, ok := strings.Cut(kv, "="); ok {
+			values[key] = value
+		}
+	}
+	return source{name: "environment", values: values}
+}
+
+// structured are settings whose value is a YAML document. In a file they are
+// written as nested YAML instead of a string.
+var structured = map[string]bool{
+	"FEATURE_FLAGS":     true,
+	"UPSTREAM_TIMEOUTS": true,
+}
+
+// fileSource reads a YAML file. Nested keys are joined with "_", so
+// "casbin: {db_host: x}" sets CASBIN_DB_HOST, and lists are joined with ",".
+func fileSource(path string) (source, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return source{}, err
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return source{}, fmt.Errorf("%s: %w", path, err)
+	}
+	values := make(map[string]string)
+	flatten("", doc, values)
+	return source{name: path, values: values, strict: true}, nil
+}
+
+func flatten(prefix string, doc map[string]interface{}, values map[string]string) {
+	for key, value := range doc {
+		key = strings.ToUpper(prefix + key)
+		if structured[key] {
+			text, ok := value.(string)
+			if !ok {
+				// Values decoded from YAML always encode again.
+				data, _ := yaml.Marshal(value)
+				text = string(data)
+			}
+			values[key] = text
+			continue
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flatten(key+"_", v, values)
+		case []interface{}:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[key] = strings.Join(items, ",")
+		case nil:
+			values[key] = ""
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+}
+
+// flagSource reads "--name=value", "--name value" and "-name value"
+// arguments, where name is a setting in lower case with dashes, such as
+// --user-service. A flag without a value is "true". The --config flag names
+// the YAML file and is returned separately.
+func flagSource(args []string) (source, string, error) {
+	values := make(map[string]string)
+	configPath := ""
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || arg == "-" || arg == "--" {
+			return source{}, "", fmt.Errorf("unexpected argument %q", arg)
+		}
+		name, value, ok := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !ok {
+			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			} else {
+				value = "true"
+			}
+		}
+		if name == "config" {
+			configPath = value
+			continue
+		}
+		values[strings.ToUpper(strings.ReplaceAll(name, "-", "_"))] = value
+	}
+	return source{name: "flags", values: values, strict: true}, configPath, nil
+}
+
+// loader looks settings up in its sources, first source first, and collects
+// every problem so that they can be reported together.
+type loader struct {
+	sources []source
+	known   map[string]bool
+	errs    []error
+}
+
+func newLoader(sources ...source) *loader {
+	return &loader{sources: sources, known: make(map[string]bool)}
+}
+
+// lookup returns the value of key. A KEY_FILE setting names a file holding
+// the value, which is how secrets are passed without putting them in the
+// environment.
+func (l *loader) lookup(key string) (string, bool) {
+	l.known[key] = true
+	l.known[key+"_FILE"] = true
+	for _, src := range l.sources {
+		if value, ok := src.values[key]; ok {
+			return value, true
+		}
+		if path, ok := src.values[key+"_FILE"]; ok {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				l.errs = append(l.errs, fmt.Errorf("%s_FILE: %w", key, err))
+				return "", false
+			}
+			return strings.TrimSpace(string(data)), true
+		}
+	}
+	return "", false
+}
+
+func (l *loader) string(key, def string) string {
+	if value, ok := l.lookup(key); ok {
+		return value
+	}
+	return def
+}
+
+func (l *loader) int(key string, def int) int {
+	value, ok := l.lookup(key)
+	if !ok {
+		return def
+	}
+	n, err := cast.ToIntE(value)
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: %q is not a number", key, value))
+	}
+	return n
+}
+
+func (l *loader) float(key string, def float64) float64 {
+	value, ok := l.lookup(key)
+	if !ok {
+		return def
+	}
+	f, err := cast.ToFloat64E(value)
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: %q is not a number", key, value))
+	}
+	return f
+}
+
+func (l *loader) bool(key string, def bool) bool {
+	value, ok := l.lookup(key)
+	if !ok {
+		return def
+	}
+	b, err := cast.ToBoolE(value)
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: %q is not true or false", key, value))
+	}
+	return b
+}
+
+func (l *loader) duration(key, def string) time.Duration {
+	value, ok := l.lookup(key)
+	if !ok {
+		value = def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: %q is not a duration such as 30s or 15m", key, value))
+	}
+	return d
+}
+
+// err reports every problem found, including settings in a file or flag
+// that do not exist.
+func (l *loader) err() error {
+	errs := l.errs
+	for _, src := range l.sources {
+		if !src.strict {
+			continue
+		}
+		var unknown []string
+		for key := range src.values {
+			if !l.known[key] {
+				unknown = append(unknown, key)
+			}
+		}
+		sort.Strings(unknown)
+		for _, key := range unknown {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %s", src.name, key))
+		}
+	}
+	return errors.Join(errs...)
+}
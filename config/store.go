@@ -0,0 +1,238 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Reloadable are the settings a reload changes. The others, such as the
+// signing keys and databases, keep their startup value until the gateway is
+// restarted.
+var Reloadable = []string{
+	"USER_SERVICE",
+	"QUESTION_SERVICE",
+	"CHECKER_URL",
+	"UPSTREAM_TIMEOUT",
+	"UPSTREAM_TIMEOUTS",
+	"UPSTREAM_RETRIES",
+	"UPSTREAM_RETRY_BACKOFF",
+	"UPSTREAM_RETRY_MAX_BACKOFF",
+	"BREAKER_WINDOW",
+	"BREAKER_MIN_CALLS",
+	"BREAKER_ERROR_RATE",
+	"BREAKER_SLOW_CALL",
+	"BREAKER_SLOW_RATE",
+	"BREAKER_OPEN_FOR",
+	"BREAKER_PROBES",
+	"DEBUG",
+	"LOG_LEVEL",
+	"CORS_ORIGINS",
+	"RATE_LIMIT",
+	"RATE_BURST",
+	"FEATURE_FLAGS",
+	"HEALTH_REQUIRED",
+	"HEALTH_TIMEOUT",
+	"SHUTDOWN_GRACE",
+}
+
+// secrets are redacted when the configuration is shown.
+var secrets = []string{
+	"ACCES_KEY",
+	"REFRESH_KEY",
+	"MINIO_SECRET_KEY",
+	"TOKEN_STORE_DSN",
+	"SMTP_PASSWORD",
+	"CASBIN_DB_PASSWORD",
+}
+
+// Reload is the outcome of a reload.
+type Reload struct {
+	// Changed are the settings that took a new value.
+	Changed []string `json:"changed"`
+	// Ignored are settings that changed but only apply after a restart.
+	Ignored []string `json:"ignored"`
+}
+
+// Store holds the active configuration and replaces it atomically on reload.
+type Store struct {
+	args   []string
+	checks []Check
+	static bool
+
+	mu       sync.Mutex
+	files    []string
+	modified map[string]time.Time
+	current  atomic.Pointer[Config]
+	onReload []func(Config)
+}
+
+// NewStore loads the configuration like Load. args and checks are kept to
+// read and validate the configuration again on reload.
+func NewStore(args []string, checks ...Check) (*Store, error) {
+	conf, files, err := load(args, checks)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{args: args, checks: checks}
+	s.current.Store(&conf)
+	s.setFiles(files)
+	return s, nil
+}
+
+// NewStaticStore holds conf and never reloads. It is meant for tools and
+// tests.
+func NewStaticStore(conf Config) *Store {
+	s := &Store{static: true}
+	s.current.Store(&conf)
+	return s
+}
+
+// Current returns the active configuration.
+func (s *Store) Current() Config {
+	return *s.current.Load()
+}
+
+// OnReload registers f to be called with the new configuration after every
+// reload that changed a setting. Callbacks run one at a time, in order.
+func (s *Store) OnReload(f func(Config)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onReload = append(s.onReload, f)
+}
+
+// Reload reads the configuration again and applies the reloadable settings.
+// An invalid configuration is rejected as a whole and the active one is kept.
+func (s *Store) Reload() (*Reload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.static {
+		return nil, errors.New("configuration cannot be reloaded")
+	}
+	// A rejected file is not read again until it changes once more.
+	s.setFiles(s.files)
+	loaded, files, err := load(s.args, s.checks)
+	if err != nil {
+		return nil, err
+	}
+	s.setFiles(files)
+
+	old := s.Current()
+	next := old
+	res := &Reload{Changed: []string{}, Ignored: []string{}}
+	from, to, into := reflect.ValueOf(old), reflect.ValueOf(loaded), reflect.ValueOf(&next).Elem()
+	for i := 0; i < from.NumField(); i++ {
+		name := from.Type().Field(i).Name
+		if reflect.DeepEqual(from.Field(i).Interface(), to.Field(i).Interface()) {
+			continue
+		}
+		if !slices.Contains(Reloadable, name) {
+			res.Ignored = append(res.Ignored, name)
+			continue
+		}
+		into.Field(i).Set(to.Field(i))
+		res.Changed = append(res.Changed, name)
+	}
+	if len(res.Changed) == 0 {
+		return res, nil
+	}
+
+	s.current.Store(&next)
+	for _, f := range s.onReload {
+		f(next)
+	}
+	return res, nil
+}
+
+// Watch reloads the configuration on SIGHUP, and when one of its files
+// changes if CONFIG_WATCH_INTERVAL is set, until ctx is done. Rejected
+// reloads are logged and the active configuration stays in use.
+func (s *Store) Watch(ctx context.Context, logger *slog.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if every := s.Current().CONFIG_WATCH_INTERVAL; every > 0 {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.Info("Reloading config on SIGHUP")
+		case <-tick:
+			if !s.filesChanged() {
+				continue
+			}
+			logger.Info("Reloading config after a file change")
+		}
+		res, err := s.Reload()
+		if err != nil {
+			logger.Error("Rejected config reload", "error", err.Error())
+			continue
+		}
+		logger.Info("Reloaded config", "changed", res.Changed, "ignored", res.Ignored)
+	}
+}
+
+// setFiles records files and their modification times. s.mu must be held
+// or s not yet shared.
+func (s *Store) setFiles(files []string) {
+	s.files = files
+	s.modified = make(map[string]time.Time, len(files))
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			s.modified[file] = info.ModTime()
+		}
+	}
+}
+
+func (s *Store) filesChanged() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, file := range s.files {
+		var modified time.Time
+		if info, err := os.Stat(file); err == nil {
+			modified = info.ModTime()
+		}
+		if !modified.Equal(s.modified[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redacted returns the active configuration by setting name, with secrets
+// hidden, for display.
+func (s *Store) Redacted() map[string]interface{} {
+	conf := reflect.ValueOf(s.Current())
+	res := make(map[string]interface{}, conf.NumField())
+	for i := 0; i < conf.NumField(); i++ {
+		name := conf.Type().Field(i).Name
+		value := conf.Field(i).Interface()
+		switch v := value.(type) {
+		case time.Duration:
+			value = v.String()
+		case string:
+			if v != "" && slices.Contains(secrets, name) {
+				value = "[redacted]"
+			}
+		}
+		res[name] = value
+	}
+	return res
+}
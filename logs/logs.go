@@ -6,9 +6,11 @@ import (
 	"os"
 )
 
-func NewLogger() *slog.Logger {
+// NewLogger writes to app.log. level is read on every record, so a
+// *slog.LevelVar changes the level of a running logger.
+func NewLogger(level slog.Leveler) *slog.Logger {
 	opts := &slog.HandlerOptions{
-		Level: slog.LevelDebug,
+		Level: level,
 	}
 
 	file, err := os.OpenFile("app.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
@@ -3,9 +3,41 @@ package model
 import "api/genproto/question"
 
 type Error struct {
+	// Code is a stable, machine-readable reason. It is set on authentication
+	// and authorization failures, when a request is throttled and when an
+	// upstream service is unavailable.
+	Code    string `json:"code,omitempty"`
 	Message string `json:"message"`
 }
 
+// Codes of authentication, authorization, throttling and availability
+// failures. Clients may rely on them; the messages may change.
+const (
+	// 401
+	CodeMissingCredentials = "missing_credentials"
+	CodeInvalidToken       = "invalid_token"
+	CodeTokenExpired       = "token_expired"
+	CodeTokenRevoked       = "token_revoked"
+	CodeInvalidAPIKey      = "invalid_api_key"
+	CodeAPIKeyExpired      = "api_key_expired"
+	CodeAPIKeyRevoked      = "api_key_revoked"
+
+	// 403
+	CodePermissionDenied   = "permission_denied"
+	CodeAPIKeyScope        = "api_key_scope"
+	CodeImpersonationLimit = "impersonation_not_allowed"
+	CodeNotResourceOwner   = "not_resource_owner"
+
+	// 429
+	CodeRateLimited = "rate_limited"
+
+	// 500
+	CodeInternal = "internal_error"
+
+	// 503
+	CodeUpstreamUnavailable = "upstream_unavailable"
+)
+
 type GetAllQuestionsRequest struct {
 	TopicId    string `form:"topic_id"`
 	Type       string `form:"type"`